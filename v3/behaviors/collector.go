@@ -12,6 +12,9 @@ package behaviors
 //--------------------
 
 import (
+	"encoding/json"
+	"fmt"
+
 	"github.com/tideland/gocn/v3/cells"
 )
 
@@ -21,19 +24,29 @@ import (
 
 // EventData represents the pure collected event data.
 type EventData struct {
-	Topic   string
-	Payload cells.Payload
+	Topic    string
+	Payload  cells.Payload
+	Metadata cells.Metadata
 }
 
 // newEventData returns the passed event as event data to collect.
 func newEventData(event cells.Event) EventData {
 	data := EventData{
-		Topic:   event.Topic(),
-		Payload: event.Payload(),
+		Topic:    event.Topic(),
+		Payload:  event.Payload(),
+		Metadata: event.Metadata(),
 	}
 	return data
 }
 
+// collectedSnapshot is one collected event in a snapshot. The
+// payload is encoded with the JSON codec, the metadata is kept
+// separately, as the codec cannot set it.
+type collectedSnapshot struct {
+	Event    json.RawMessage `json:"event"`
+	Metadata cells.Metadata  `json:"metadata"`
+}
+
 // collectorBehavior collects events for debugging.
 type collectorBehavior struct {
 	ctx       cells.Context
@@ -46,7 +59,9 @@ type collectorBehavior struct {
 // The event is passed through. The collected events can be requested with
 // the topic "collected?" and will be stored in the scene store named in
 // the events payload. Additionally the collection can be resetted with
-// "reset!".
+// "reset!". The collected events are kept in snapshots encoded
+// with the JSON payload codec, payload values which cannot be
+// encoded are kept as strings.
 func NewCollectorBehavior(max int) cells.Behavior {
 	return &collectorBehavior{nil, max, []EventData{}}
 }
@@ -88,4 +103,68 @@ func (b *collectorBehavior) Recover(err interface{}) error {
 	return nil
 }
 
+// Snapshot is specified on the cells.Snapshotter interface.
+func (b *collectorBehavior) Snapshot() ([]byte, error) {
+	codec := cells.NewJSONPayloadCodec()
+	snapshots := make([]collectedSnapshot, len(b.collected))
+	for i, collected := range b.collected {
+		event, err := cells.NewEvent(collected.Topic, b.encodableValues(codec, collected), nil)
+		if err != nil {
+			return nil, err
+		}
+		data, err := codec.Encode(event)
+		if err != nil {
+			return nil, err
+		}
+		snapshots[i] = collectedSnapshot{data, collected.Metadata}
+	}
+	return json.Marshal(snapshots)
+}
+
+// encodableValues returns the payload values of the collected
+// event. Values the codec cannot encode are stringified.
+func (b *collectorBehavior) encodableValues(codec cells.PayloadCodec, collected EventData) cells.PayloadValues {
+	values := cells.PayloadValues{}
+	if collected.Payload == nil {
+		return values
+	}
+	collected.Payload.Do(func(key string, value interface{}) error {
+		if key == cells.ResponseChanPayload {
+			return nil
+		}
+		if event, err := cells.NewEvent(collected.Topic, cells.PayloadValues{key: value}, nil); err == nil {
+			if _, err = codec.Encode(event); err != nil {
+				b.ctx.Logger().Warn("collector stringifies payload value for snapshot", "key", key, cells.LogErrorKey, err)
+				value = fmt.Sprintf("%v", value)
+			}
+		}
+		values[key] = value
+		return nil
+	})
+	return values
+}
+
+// Restore is specified on the cells.Snapshotter interface.
+func (b *collectorBehavior) Restore(snapshot []byte) error {
+	codec := cells.NewJSONPayloadCodec()
+	snapshots := []collectedSnapshot{}
+	if err := json.Unmarshal(snapshot, &snapshots); err != nil {
+		return err
+	}
+	collected := make([]EventData, len(snapshots))
+	for i, cs := range snapshots {
+		event, err := codec.Decode(cs.Event)
+		if err != nil {
+			return err
+		}
+		collected[i] = EventData{
+			Topic:    event.Topic(),
+			Payload:  event.Payload(),
+			Metadata: cs.Metadata,
+		}
+	}
+	b.collected = collected
+	return nil
+}
+
 // EOF
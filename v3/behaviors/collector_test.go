@@ -12,6 +12,7 @@ package behaviors_test
 //--------------------
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/tideland/gocn/v3/behaviors"
@@ -50,4 +51,45 @@ func TestCollectorBehavior(t *testing.T) {
 	assert.Length(collected, 0)
 }
 
+// TestCollectorBehaviorSnapshot tests the restoring of the
+// collected events after a restart.
+func TestCollectorBehaviorSnapshot(t *testing.T) {
+	assert := asserts.NewTestingAssertion(t, true)
+	env := cells.NewEnvironment(cells.ID("collector-snapshot"), cells.SnapshotDirectory(t.TempDir(), 0))
+	defer env.Stop()
+
+	env.StartCell("collector", behaviors.NewCollectorBehavior(10))
+	for i := 0; i < 5; i++ {
+		env.EmitNew("collector", "collect", i, nil)
+	}
+	// Values which cannot be encoded are stringified.
+	env.EmitNew("collector", "collect", cells.PayloadValues{cells.DefaultPayload: 5, "done": make(chan struct{})}, nil)
+
+	testsupport.LetItWork()
+
+	before, err := env.Request("collector", cells.CollectedTopic, nil, nil, cells.DefaultTimeout)
+	assert.Nil(err)
+	err = env.Snapshot("collector")
+	assert.Nil(err)
+	err = env.StopCell("collector")
+	assert.Nil(err)
+	err = env.StartCell("collector", behaviors.NewCollectorBehavior(10))
+	assert.Nil(err)
+
+	after, err := env.Request("collector", cells.CollectedTopic, nil, nil, cells.DefaultTimeout)
+	assert.Nil(err)
+	assert.Length(after, 6)
+	for i, data := range after.([]behaviors.EventData) {
+		expected := before.([]behaviors.EventData)[i]
+		assert.Equal(data.Topic, "collect")
+		assert.Equal(data.Metadata.ID, expected.Metadata.ID)
+		value, err := data.Payload.GetInt(cells.DefaultPayload, -1)
+		assert.Nil(err)
+		assert.Equal(value, i)
+	}
+	done, err := after.([]behaviors.EventData)[5].Payload.GetString("done", "")
+	assert.Nil(err)
+	assert.True(strings.HasPrefix(done, "0x"))
+}
+
 // EOF
@@ -12,6 +12,8 @@ package behaviors
 //--------------------
 
 import (
+	"encoding/json"
+
 	"github.com/tideland/gocn/v3/cells"
 )
 
@@ -36,7 +38,8 @@ type counterBehavior struct {
 // NewCounterBehavior creates a counter behavior based on the passed
 // function. It increments and emits those counters named by the result
 // of the counter function. The counters can be retrieved with the
-// request "counters?" and reset with "reset!".
+// request "counters?" and reset with "reset!". The counters are kept
+// in snapshots.
 func NewCounterBehavior(cf CounterFunc) cells.Behavior {
 	return &counterBehavior{nil, cf, make(Counters)}
 }
@@ -86,6 +89,21 @@ func (b *counterBehavior) Recover(err interface{}) error {
 	return nil
 }
 
+// Snapshot is specified on the cells.Snapshotter interface.
+func (b *counterBehavior) Snapshot() ([]byte, error) {
+	return json.Marshal(b.counters)
+}
+
+// Restore is specified on the cells.Snapshotter interface.
+func (b *counterBehavior) Restore(snapshot []byte) error {
+	counters := make(Counters)
+	if err := json.Unmarshal(snapshot, &counters); err != nil {
+		return err
+	}
+	b.counters = counters
+	return nil
+}
+
 // copyCounters copies the counters for a request.
 func (b *counterBehavior) copyCounters() Counters {
 	copiedCounters := make(Counters)
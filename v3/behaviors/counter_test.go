@@ -64,4 +64,31 @@ func TestCounterBehavior(t *testing.T) {
 	assert.Empty(counters, "zero counted events")
 }
 
+// TestCounterBehaviorSnapshot tests the restoring of the
+// counters after a restart.
+func TestCounterBehaviorSnapshot(t *testing.T) {
+	assert := asserts.NewTestingAssertion(t, true)
+	env := cells.NewEnvironment(cells.ID("counter-snapshot"), cells.SnapshotDirectory(t.TempDir(), 0))
+	defer env.Stop()
+
+	cf := func(id string, event cells.Event) []string {
+		return []string{event.Topic()}
+	}
+	env.StartCell("counter", behaviors.NewCounterBehavior(cf))
+	env.EmitNew("counter", "a", nil, nil)
+	env.EmitNew("counter", "b", nil, nil)
+	env.EmitNew("counter", "a", nil, nil)
+
+	testsupport.LetItWork()
+
+	err := env.StopCell("counter")
+	assert.Nil(err)
+	err = env.StartCell("counter", behaviors.NewCounterBehavior(cf))
+	assert.Nil(err)
+
+	counters, err := env.Request("counter", cells.CountersTopic, nil, nil, cells.DefaultTimeout)
+	assert.Nil(err)
+	assert.Equal(counters, behaviors.Counters{"a": 2, "b": 1})
+}
+
 // EOF
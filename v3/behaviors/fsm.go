@@ -12,7 +12,11 @@ package behaviors
 //--------------------
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"reflect"
+	"sort"
 
 	"github.com/tideland/gocn/v3/cells"
 )
@@ -36,6 +40,13 @@ func (s FSMStatus) String() string {
 	return fmt.Sprintf("<FSM done: %v / error: %v>", s.Done, s.Error)
 }
 
+// fsmSnapshot is the encoded state of the FSM.
+type fsmSnapshot struct {
+	State string
+	Done  bool
+	Error string
+}
+
 // fsmBehavior runs the finite state machine.
 type fsmBehavior struct {
 	ctx   cells.Context
@@ -101,19 +112,108 @@ func (b *fsmBehavior) Recover(err interface{}) error {
 
 // RequestFSMStatus retrieves the status of a FSM cell.
 func RequestFSMStatus(env cells.Environment, id string) FSMStatus {
-	response, err := env.Request(id, cells.StatusTopic, nil, nil, cells.DefaultTimeout)
+	status, err := cells.RequestAs[FSMStatus](env, id, cells.StatusTopic, nil, nil, cells.DefaultTimeout)
 	if err != nil {
 		return FSMStatus{
 			Error: err,
 		}
 	}
-	status, ok := response.(FSMStatus)
-	if !ok {
-		return FSMStatus{
-			Error: cells.NewInvalidResponseError(response),
+	return status
+}
+
+//--------------------
+// NAMED FSM BEHAVIOR
+//--------------------
+
+// namedFSMBehavior runs a finite state machine with states
+// registered under names, so that it can be snapshotted.
+type namedFSMBehavior struct {
+	*fsmBehavior
+	initial string
+	states  map[string]FSMState
+}
+
+// NewNamedFSMBehavior creates a finite state machine behavior like
+// NewFSMBehavior() with states registered under names, starting with
+// the initial one. Snapshots contain the name of the current state,
+// so all states the functions may return have to be registered. They
+// are told apart by their functions, so e.g. closures created by the
+// same function literal cannot be different states. Data of the
+// receivers of state methods is not part of the snapshots.
+func NewNamedFSMBehavior(initial string, states map[string]FSMState) cells.Behavior {
+	return &namedFSMBehavior{
+		fsmBehavior: &fsmBehavior{nil, states[initial], false, nil},
+		initial:     initial,
+		states:      states,
+	}
+}
+
+// Init the behavior.
+func (b *namedFSMBehavior) Init(ctx cells.Context) error {
+	if b.state == nil {
+		return fmt.Errorf("unknown initial FSM state %q", b.initial)
+	}
+	return b.fsmBehavior.Init(ctx)
+}
+
+// Snapshot is specified on the cells.Snapshotter interface.
+func (b *namedFSMBehavior) Snapshot() ([]byte, error) {
+	snapshot := fsmSnapshot{
+		Done: b.done,
+	}
+	if b.state != nil {
+		name, err := b.stateName(b.state)
+		if err != nil {
+			return nil, err
 		}
+		snapshot.State = name
 	}
-	return status
+	if b.err != nil {
+		snapshot.Error = b.err.Error()
+	}
+	return json.Marshal(snapshot)
+}
+
+// Restore is specified on the cells.Snapshotter interface.
+func (b *namedFSMBehavior) Restore(data []byte) error {
+	var snapshot fsmSnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return err
+	}
+	var state FSMState
+	if snapshot.State != "" {
+		s, ok := b.states[snapshot.State]
+		if !ok {
+			return fmt.Errorf("unknown FSM state %q", snapshot.State)
+		}
+		state = s
+	}
+	b.state = state
+	b.done = snapshot.Done
+	b.err = nil
+	if snapshot.Error != "" {
+		b.err = errors.New(snapshot.Error)
+	}
+	return nil
+}
+
+// stateName returns the name the state is registered with.
+func (b *namedFSMBehavior) stateName(state FSMState) (string, error) {
+	pointer := reflect.ValueOf(state).Pointer()
+	names := []string{}
+	for name, s := range b.states {
+		if s != nil && reflect.ValueOf(s).Pointer() == pointer {
+			names = append(names, name)
+		}
+	}
+	switch len(names) {
+	case 0:
+		return "", fmt.Errorf("current FSM state is not registered")
+	case 1:
+		return names[0], nil
+	}
+	sort.Strings(names)
+	return "", fmt.Errorf("current FSM state cannot be told apart from %v", names)
 }
 
 // EOF
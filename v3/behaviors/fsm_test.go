@@ -13,6 +13,8 @@ package behaviors_test
 
 import (
 	"fmt"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/tideland/gocn/v3/behaviors"
@@ -104,6 +106,63 @@ func TestFSMBehavior(t *testing.T) {
 	assert.ErrorMatch(status.Error, "illegal topic in state 'locked': chewing-gum")
 }
 
+// TestFSMBehaviorSnapshot tests the restoring of the
+// current state after a restart.
+func TestFSMBehaviorSnapshot(t *testing.T) {
+	assert := asserts.NewTestingAssertion(t, true)
+	dir := t.TempDir()
+	env := cells.NewEnvironment(cells.ID("fsm-snapshot"), cells.SnapshotDirectory(dir, 0))
+	defer env.Stop()
+
+	info := func(id string) string {
+		info, err := env.Request(id, "info?", nil, nil, cells.DefaultTimeout)
+		assert.Nil(err)
+		return info.(string)
+	}
+
+	lockA := lockMachine{}
+	env.StartCell("lock", behaviors.NewNamedFSMBehavior("locked", lockA.States()))
+	env.EmitNew("lock", "coin!", 50, nil)
+	env.EmitNew("lock", "coin!", 60, nil)
+
+	testsupport.LetItWork()
+
+	assert.Equal(info("lock"), "state 'unlocked' with 10 cents")
+
+	// Restart with a fresh machine, the cents are not
+	// part of the snapshot.
+	err := env.StopCell("lock")
+	assert.Nil(err)
+	snapshot, err := os.ReadFile(filepath.Join(dir, "lock.snapshot"))
+	assert.Nil(err)
+	assert.Equal(string(snapshot), `{"State":"unlocked","Done":false,"Error":""}`)
+	lockB := lockMachine{}
+	err = env.StartCell("lock", behaviors.NewNamedFSMBehavior("locked", lockB.States()))
+	assert.Nil(err)
+	assert.Equal(info("lock"), "state 'unlocked' with 0 cents")
+
+	// Unknown state.
+	err = env.StopCell("lock")
+	assert.Nil(err)
+	lockC := lockMachine{}
+	states := map[string]behaviors.FSMState{"locked": lockC.Locked}
+	err = env.StartCell("lock", behaviors.NewNamedFSMBehavior("locked", states))
+	assert.True(cells.IsRestoreError(err))
+
+	// Unknown initial state.
+	err = env.StartCell("unknown", behaviors.NewNamedFSMBehavior("open", lockC.States()))
+	assert.ErrorMatch(err, `.*unknown initial FSM state "open".*`)
+
+	// Unregistered current state.
+	err = env.StartCell("unregistered", behaviors.NewNamedFSMBehavior("locked", states))
+	assert.Nil(err)
+	env.EmitNew("unregistered", "coin!", 150, nil)
+	testsupport.LetItWork()
+	err = env.Snapshot("unregistered")
+	assert.True(cells.IsSnapshotError(err))
+	assert.ErrorMatch(err, ".*current FSM state is not registered.*")
+}
+
 //--------------------
 // HELPERS
 //--------------------
@@ -123,6 +182,14 @@ type lockMachine struct {
 	cents int
 }
 
+// States returns the states of the machine with their names.
+func (m *lockMachine) States() map[string]behaviors.FSMState {
+	return map[string]behaviors.FSMState{
+		"locked":   m.Locked,
+		"unlocked": m.Unlocked,
+	}
+}
+
 // Locked represents the locked state receiving coins.
 func (m *lockMachine) Locked(ctx cells.Context, event cells.Event) (behaviors.FSMState, error) {
 	switch event.Topic() {
@@ -12,7 +12,9 @@ package behaviors
 //--------------------
 
 import (
-	"github.com/tideland/goas/v2/logger"
+	"log/slog"
+	"sort"
+
 	"github.com/tideland/gocn/v3/cells"
 )
 
@@ -26,7 +28,8 @@ type loggerBehavior struct {
 }
 
 // NewLoggerBehavior creates a logging behavior. It logs emitted
-// events with info level.
+// events with info level to the logger of the environment. The
+// payload values are logged as attributes in the group "payload".
 func NewLoggerBehavior() cells.Behavior {
 	return &loggerBehavior{}
 }
@@ -44,7 +47,21 @@ func (b *loggerBehavior) Terminate() error {
 
 // ProcessEvent logs the event at info level.
 func (b *loggerBehavior) ProcessEvent(event cells.Event) error {
-	logger.Infof("(%s) processing: %q", b.ctx.ID(), event)
+	attrs := []slog.Attr{}
+	if event.Payload() != nil {
+		event.Payload().Do(func(key string, value interface{}) error {
+			if key != cells.ResponseChanPayload {
+				attrs = append(attrs, slog.Any(key, value))
+			}
+			return nil
+		})
+	}
+	sort.Slice(attrs, func(i, j int) bool { return attrs[i].Key < attrs[j].Key })
+	args := make([]interface{}, len(attrs))
+	for i, attr := range attrs {
+		args[i] = attr
+	}
+	b.ctx.Logger().Info("processing event", cells.LogTopicKey, event.Topic(), slog.Group("payload", args...))
 	return nil
 }
 
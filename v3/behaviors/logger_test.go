@@ -0,0 +1,70 @@
+// Tideland Go Cell Network - Behaviors - Unit Tests - Logger
+//
+// Copyright (C) 2010-2014 Frank Mueller / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package behaviors_test
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/tideland/gocn/v3/behaviors"
+	"github.com/tideland/gocn/v3/cells"
+	"github.com/tideland/gocn/v3/testsupport"
+	"github.com/tideland/gots/v3/asserts"
+)
+
+//--------------------
+// TESTS
+//--------------------
+
+// TestLoggerBehavior tests the logger behavior.
+func TestLoggerBehavior(t *testing.T) {
+	assert := asserts.NewTestingAssertion(t, true)
+	buf := &syncBuffer{}
+	handler := slog.NewTextHandler(buf, nil)
+	env := cells.NewEnvironment(cells.ID("logger-behavior"), cells.Logger(handler))
+	defer env.Stop()
+
+	env.StartCell("logger", behaviors.NewLoggerBehavior())
+	env.EmitNew("logger", "foo", cells.PayloadValues{"a": 1, "b": "two"}, nil)
+
+	testsupport.LetItWork()
+
+	logged := buf.String()
+	assert.True(strings.Contains(logged, `msg="processing event" environment=logger-behavior cell=logger behavior=*behaviors.loggerBehavior topic=foo payload.a=1 payload.b=two`))
+}
+
+//--------------------
+// HELPERS
+//--------------------
+
+// syncBuffer is a buffer which can be written concurrently.
+type syncBuffer struct {
+	mux sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	return b.buf.String()
+}
+
+// EOF
@@ -70,4 +70,35 @@ func TestMapperBehavior(t *testing.T) {
 	assertPayload(collected, 2, "GHI")
 }
 
+// TestMapperBehaviorMetadata tests the metadata of mapped events.
+func TestMapperBehaviorMetadata(t *testing.T) {
+	assert := asserts.NewTestingAssertion(t, true)
+	env := cells.NewEnvironment(cells.ID("mapper-behavior-metadata"))
+	defer env.Stop()
+
+	mf := func(id string, event cells.Event) (cells.Event, error) {
+		return cells.NewEvent(strings.ToUpper(event.Topic()), nil, nil)
+	}
+
+	env.StartCell("mapper", behaviors.NewMapperBehavior(mf))
+	env.StartCell("collector", behaviors.NewCollectorBehavior(10))
+	env.Subscribe("mapper", "collector")
+
+	event, err := cells.NewEvent("a", nil, nil)
+	assert.Nil(err)
+	env.Emit("mapper", event)
+
+	testsupport.LetItWork()
+
+	collected, err := env.Request("collector", cells.CollectedTopic, nil, nil, cells.DefaultTimeout)
+	assert.Nil(err)
+	assert.Length(collected, 1)
+	md := collected.([]behaviors.EventData)[0].Metadata
+	assert.Different(md.ID, event.Metadata().ID)
+	assert.Equal(md.CausationID, event.Metadata().ID)
+	assert.Equal(md.CorrelationID, event.Metadata().CorrelationID)
+	assert.Equal(md.SourceID, "mapper")
+	assert.Equal(md.Hops, 1)
+}
+
 // EOF
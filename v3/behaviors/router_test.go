@@ -61,4 +61,32 @@ func TestRouterBehavior(t *testing.T) {
 	test("test-5", 1)
 }
 
+// TestRouterBehaviorMetadata tests the metadata of routed events.
+func TestRouterBehaviorMetadata(t *testing.T) {
+	assert := asserts.NewTestingAssertion(t, true)
+	env := cells.NewEnvironment(cells.ID("router-behavior-metadata"))
+	defer env.Stop()
+
+	rf := func(id string, event cells.Event, subscribers []string) []string {
+		return subscribers
+	}
+	env.StartCell("router", behaviors.NewRouterBehavior(rf))
+	env.StartCell("collector", behaviors.NewCollectorBehavior(10))
+	env.Subscribe("router", "collector")
+
+	event, err := cells.NewEvent("a", nil, nil)
+	assert.Nil(err)
+	env.Emit("router", event)
+
+	testsupport.LetItWork()
+
+	collected, err := env.Request("collector", cells.CollectedTopic, nil, nil, cells.DefaultTimeout)
+	assert.Nil(err)
+	assert.Length(collected, 1)
+	md := collected.([]behaviors.EventData)[0].Metadata
+	assert.Equal(md.ID, event.Metadata().ID)
+	assert.Equal(md.SourceID, "router")
+	assert.Equal(md.Hops, 1)
+}
+
 // EOF
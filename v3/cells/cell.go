@@ -12,11 +12,15 @@ package cells
 //--------------------
 
 import (
+	"context"
+	"log/slog"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/tideland/goas/v1/scene"
 	"github.com/tideland/goas/v2/identifier"
-	"github.com/tideland/goas/v2/logger"
 	"github.com/tideland/goas/v2/loop"
 	"github.com/tideland/goas/v2/monitoring"
 	"github.com/tideland/goas/v3/errors"
@@ -26,47 +30,79 @@ import (
 // CELL
 //--------------------
 
+// recoveryPolicy defines how often a cell may recover.
+type recoveryPolicy struct {
+	maxRecoveries int
+	window        time.Duration
+	backoff       time.Duration
+}
+
 // cell for event processing.
 type cell struct {
+	mux         sync.RWMutex
 	env         *environment
+	cellEnv     *cellEnvironment
 	id          string
 	behavior    Behavior
 	subscribers *cluster
+	emitters    *cluster
 	queue       EventQueue
 	loop        loop.Loop
 	measuringID string
+	busy        int32
+	recovery    recoveryPolicy
+	current     Event
+	metrics     *cellCounters
+	swapping    sync.Mutex
+	stopped     bool
+	processing  sync.Mutex
 }
 
 // newCell create a new cell around a behavior.
-func newCell(env *environment, id string, behavior Behavior) (*cell, error) {
+func newCell(env *environment, id string, behavior Behavior, options ...CellOption) (*cell, error) {
 	// Init cell runtime.
 	c := &cell{
 		env:         env,
 		id:          id,
 		behavior:    behavior,
 		subscribers: newCluster(),
+		emitters:    newCluster(),
+		metrics:     newCellCounters(env.metricsTopics, env.normalizeTopic),
 		measuringID: identifier.Identifier("cells", env.id, "cell", identifier.TypeAsIdentifierPart(behavior)),
+		recovery: recoveryPolicy{
+			maxRecoveries: 12,
+			window:        time.Minute,
+		},
+	}
+	c.cellEnv = &cellEnvironment{env, c}
+	for _, option := range options {
+		option(c)
 	}
 	// Create queue.
-	queue, err := env.queueFactory(env)
+	queue, err := env.queueFactory(env, id)
 	if err != nil {
 		return nil, errors.Annotate(err, ErrCellInit, errorMessages, id)
 	}
 	c.queue = queue
 	// Init behavior.
 	if err := behavior.Init(c); err != nil {
+		c.stopQueue()
 		return nil, errors.Annotate(err, ErrCellInit, errorMessages, id)
 	}
+	if err := c.restore(behavior); err != nil {
+		c.abort(behavior)
+		return nil, err
+	}
 	c.loop = loop.GoRecoverable(c.backendLoop, c.checkRecovering)
 
-	logger.Infof("cell %q started", id)
+	c.logger().Info("cell started")
 
 	return c, nil
 }
 
 // Environment is specified on the Context interface.
 func (c *cell) Environment() Environment {
-	return c.env
+	return c.cellEnv
 }
 
 // ID is specified on the Context interface.
@@ -81,7 +117,18 @@ func (c *cell) Subscribers() []string {
 
 // Emit is specified on the Context interface.
 func (c *cell) Emit(event Event) error {
-	return c.subscribers.emit(event)
+	event, ok := c.emitted("", event)
+	if !ok {
+		return nil
+	}
+	err := c.subscribers.emit(event)
+	c.countEmitError(err)
+	if cerrs, ok := err.(CellErrors); ok {
+		for id, cerr := range cerrs {
+			c.env.deadLetter(id, event, cerr)
+		}
+	}
+	return err
 }
 
 // EmitNew is specified on the Context interface.
@@ -93,30 +140,293 @@ func (c *cell) EmitNew(topic string, payload interface{}, scene scene.Scene) err
 	return c.Emit(event)
 }
 
+// emitted returns the event as emitted by the cell with updated
+// metadata. If the event exceeds the maximum hop count it is
+// dropped and passed to the dead-letter cell. The emit is no
+// error, so that the emitting cell keeps working. Requests get
+// the error as response, so that they don't wait for a timeout.
+func (c *cell) emitted(targetID string, event Event) (Event, bool) {
+	event = emittedEvent(c.id, c.currentEvent(), event)
+	if c.env.maxHops > 0 && event.Metadata().Hops > c.env.maxHops {
+		err := errors.New(ErrMaxHops, errorMessages, event.Topic(), c.env.maxHops)
+		c.logger().Warn("cell drops event exceeding maximum hops", LogTopicKey, event.Topic(), "hops", c.env.maxHops)
+		c.env.deadLetter(targetID, event, err)
+		if _, ok := event.Payload().Get(ResponseChanPayload); ok {
+			event.Respond(err)
+		}
+		return event, false
+	}
+	return event, true
+}
+
+// currentEvent returns the event the cell is processing.
+func (c *cell) currentEvent() Event {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+	return c.current
+}
+
+// setCurrentEvent sets the event the cell is processing.
+func (c *cell) setCurrentEvent(event Event) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.current = event
+}
+
 // processEvent tells the cell to process an event.
 func (c *cell) processEvent(event Event) error {
+	event, err := c.interceptEmit(event)
+	if err != nil {
+		return err
+	}
+	c.recordInternal(event)
 	return c.queue.Push(event)
 }
 
-// subscribe adds the passed cells to the subscriptions.
+// processEventContext tells the cell to process an event. A
+// waiting push ends when the context is done, as long as the
+// queue supports it.
+func (c *cell) processEventContext(ctx context.Context, event Event) error {
+	event, err := c.interceptEmit(event)
+	if err != nil {
+		return err
+	}
+	c.recordInternal(event)
+	if queue, ok := c.queue.(ContextEventQueue); ok {
+		return queue.PushContext(ctx, event)
+	}
+	return c.queue.Push(event)
+}
+
+// subscribe adds the passed cells to the subscribers and
+// the cell to their emitters.
 func (c *cell) subscribe(sc *cluster) {
 	c.subscribers.subscribe(sc)
+	for _, subscriber := range sc.all() {
+		subscriber.emitters.add(c)
+	}
+}
+
+// subscribeFiltered adds the passed cell to the subscribers
+// with a filter and the cell to its emitters.
+func (c *cell) subscribeFiltered(subscriber *cell, filter SubscriptionFilter) {
+	c.subscribers.subscribeFiltered(subscriber, filter)
+	subscriber.emitters.add(c)
 }
 
-// unsubscribe removes the passed cells from the subscriptions.
+// unsubscribe removes the passed cells from the subscribers
+// and the cell from their emitters.
 func (c *cell) unsubscribe(uc *cluster) {
 	c.subscribers.unsubscribe(uc)
+	for _, subscriber := range uc.all() {
+		subscriber.emitters.remove(c.id)
+	}
+}
+
+// detach removes the cell from the subscribers of its emitters
+// and from the emitters of its subscribers.
+func (c *cell) detach() {
+	for _, emitter := range c.emitters.all() {
+		emitter.subscribers.remove(c.id)
+	}
+	for _, subscriber := range c.subscribers.all() {
+		subscriber.emitters.remove(c.id)
+	}
+}
+
+// pending returns the number of events waiting in the queue or
+// being processed. Queues not reporting their length are
+// seen as empty.
+func (c *cell) pending() int {
+	pending := int(atomic.LoadInt32(&c.busy))
+	if queue, ok := c.queue.(MeasurableEventQueue); ok {
+		pending += queue.Len()
+	}
+	return pending
 }
 
-// stop terminates the cell.
+// currentBehavior returns the behavior of the cell.
+func (c *cell) currentBehavior() Behavior {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+	return c.behavior
+}
+
+// logger returns the logger of the environment with
+// the attributes of the cell.
+func (c *cell) logger() *slog.Logger {
+	return c.env.log.With(LogCellKey, c.id, LogBehaviorKey, behaviorType(c.currentBehavior()))
+}
+
+// Logger is specified on the Context interface.
+func (c *cell) Logger() *slog.Logger {
+	return c.logger()
+}
+
+// currentLoop returns the backend loop of the cell.
+func (c *cell) currentLoop() loop.Loop {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+	return c.loop
+}
+
+// restart stops the backend loop of the cell if it's still
+// running and starts a new one with the passed behavior. The
+// queue and the subscriptions are kept, the behavior is
+// restored out of the latest snapshot. If this fails the cell
+// is aborted, stopping it later only removes it.
+func (c *cell) restart(behavior Behavior) error {
+	c.swapping.Lock()
+	defer c.swapping.Unlock()
+	if c.stopped {
+		return errors.New(ErrInactive, errorMessages, c.id)
+	}
+	if err := c.currentLoop().Stop(); err != nil {
+		c.logger().Warn("cell ended with error before restart", LogErrorKey, err)
+	}
+	if err := behavior.Init(c); err != nil {
+		return errors.Annotate(err, ErrCellInit, errorMessages, c.id)
+	}
+	if err := c.restore(behavior); err != nil {
+		c.stopped = true
+		c.abort(behavior)
+		return err
+	}
+	c.mux.Lock()
+	c.behavior = behavior
+	c.loop = loop.GoRecoverable(c.backendLoop, c.checkRecovering)
+	c.mux.Unlock()
+	c.logger().Info("cell restarted")
+	return nil
+}
+
+// replace stops the backend loop, so that the current behavior is
+// terminated, and starts a new one with the passed behavior. It
+// may migrate the state of the old one. If the new behavior fails
+// the old one is initialized and used again. The queue and the
+// subscriptions are kept.
+func (c *cell) replace(behavior Behavior) error {
+	c.swapping.Lock()
+	defer c.swapping.Unlock()
+	if c.stopped {
+		return errors.New(ErrInactive, errorMessages, c.id)
+	}
+	old := c.currentBehavior()
+	if err := c.currentLoop().Stop(); err != nil {
+		c.logger().Warn("replaced behavior ended with error", LogErrorKey, err)
+	}
+	err := c.initReplacement(behavior, old)
+	if err != nil {
+		c.logger().Error("cannot replace behavior", LogErrorKey, err)
+		if ierr := old.Init(c); ierr != nil {
+			ierr = errors.Annotate(ierr, ErrCellInit, errorMessages, c.id)
+			c.failed(ierr, nil)
+			return ierr
+		}
+		behavior = old
+	}
+	c.mux.Lock()
+	c.behavior = behavior
+	c.loop = loop.GoRecoverable(c.backendLoop, c.checkRecovering)
+	c.mux.Unlock()
+	if err == nil {
+		c.logger().Info("cell behavior replaced", "replaced", behaviorType(old))
+	}
+	return err
+}
+
+// initReplacement initializes the new behavior of the cell
+// and lets it migrate the old one.
+func (c *cell) initReplacement(behavior, old Behavior) error {
+	if err := behavior.Init(c); err != nil {
+		return errors.Annotate(err, ErrCellInit, errorMessages, c.id)
+	}
+	migrator, ok := behavior.(BehaviorMigrator)
+	if !ok {
+		return nil
+	}
+	if err := migrator.Migrate(old); err != nil {
+		if terr := behavior.Terminate(); terr != nil {
+			c.logger().Warn("cannot terminate failed replacement", LogErrorKey, terr)
+		}
+		return errors.Annotate(err, ErrMigration, errorMessages, c.id)
+	}
+	return nil
+}
+
+// failed is called when the backend loop ends with an error. The
+// stack is only passed for panics, returned errors have none.
+func (c *cell) failed(err error, stack []byte) {
+	c.logger().Error("cell failed", LogErrorKey, err)
+	c.publishFailure(FailedTopic, err, stack)
+	go c.env.cellFailed(c.id, err)
+}
+
+// publishFailure emits an event about a recovering or failure
+// to the error cell of the environment, if there's one. The
+// stack is only added if there's one.
+func (c *cell) publishFailure(topic string, reason interface{}, stack []byte) {
+	if c.env.errorCellID == "" || c.env.errorCellID == c.id {
+		return
+	}
+	values := PayloadValues{
+		CellIDPayload:     c.id,
+		CellReasonPayload: reason,
+	}
+	if stack != nil {
+		values[CellStackPayload] = string(stack)
+	}
+	event, err := NewEvent(topic, values, nil)
+	if err != nil {
+		c.logger().Error("cannot create failure event", LogErrorKey, err)
+		return
+	}
+	if err := c.env.cells.emitDirect(c.env.errorCellID, event); err != nil {
+		c.logger().Error("cannot emit failure event", LogErrorKey, err)
+	}
+}
+
+// stop terminates the cell. Afterwards a last snapshot
+// is taken if it terminated without error. Running
+// replacements or restarts are finished before, later
+// ones fail.
 func (c *cell) stop() error {
+	c.swapping.Lock()
+	defer c.swapping.Unlock()
+	if c.stopped {
+		// Aborted during a restart.
+		return nil
+	}
+	c.stopped = true
 	defer func() {
-		if err := c.queue.Stop(); err != nil {
-			logger.Errorf("cannot stop queue of cell %q: %v", c.id, err)
-		}
-		logger.Infof("cell %q terminated", c.id)
+		c.stopQueue()
+		c.logger().Info("cell terminated")
 	}()
-	return c.loop.Stop()
+	if err := c.currentLoop().Stop(); err != nil {
+		return err
+	}
+	// The loop is stopped, so no event is processed anymore.
+	if err := c.snapshot(false); err != nil {
+		c.logger().Error("cannot take last snapshot", LogErrorKey, err)
+	}
+	return nil
+}
+
+// abort terminates a behavior which has been initialized but
+// cannot be used and stops the queue, so that a new cell with
+// the same ID can take it over.
+func (c *cell) abort(behavior Behavior) {
+	if err := behavior.Terminate(); err != nil {
+		c.logger().Warn("cannot terminate aborted behavior", LogErrorKey, err)
+	}
+	c.stopQueue()
+}
+
+// stopQueue stops the queue of the cell.
+func (c *cell) stopQueue() {
+	if err := c.queue.Stop(); err != nil {
+		c.logger().Error("cannot stop queue", LogErrorKey, err)
+	}
 }
 
 // backendLoop is the backend for the processing of messages.
@@ -125,19 +435,33 @@ func (c *cell) backendLoop(l loop.Loop) error {
 	monitoring.IncrVariable(identifier.Identifier("cells", c.env.ID(), "total-cells"))
 	defer monitoring.DecrVariable(identifier.Identifier("cells", c.env.ID(), "total-cells"))
 	defer monitoring.DecrVariable(c.measuringID)
+	atomic.StoreInt32(&c.busy, 0)
+	behavior := c.currentBehavior()
 
 	for {
 		select {
-		case <-c.loop.ShallStop():
-			return c.behavior.Terminate()
+		case <-l.ShallStop():
+			return behavior.Terminate()
 		case event := <-c.queue.Events():
 			if event == nil {
 				panic("ooooooouch")
 			}
+			event, ok := c.interceptDelivery(event)
+			if !ok {
+				continue
+			}
+			atomic.StoreInt32(&c.busy, 1)
+			c.setCurrentEvent(event)
 			measuring := monitoring.BeginMeasuring(c.measuringID)
-			err := c.behavior.ProcessEvent(event)
+			begin := time.Now()
+			err := c.process(behavior, event)
+			c.metrics.processed(event.Topic(), time.Since(begin))
+			c.setCurrentEvent(nil)
+			atomic.StoreInt32(&c.busy, 0)
 			if err != nil {
-				c.loop.Kill(err)
+				c.env.deadLetter(c.id, event, err)
+				l.Kill(err)
+				c.failed(err, nil)
 				continue
 			}
 			measuring.EndMeasuring()
@@ -146,20 +470,34 @@ func (c *cell) backendLoop(l loop.Loop) error {
 }
 
 // checkRecovering checks if the cell may recover after a panic. It will
-// signal an error and let the cell stop working if there have been 12 recoverings
-// during the last minute or the behaviors Recover() signals, that it cannot
-// handle the error.
+// signal an error and let the cell stop working if there have been too
+// many recoverings inside the window of the recovery policy, per default
+// 12 recoverings during the last minute, or the behaviors Recover()
+// signals, that it cannot handle the error.
 func (c *cell) checkRecovering(rs loop.Recoverings) (loop.Recoverings, error) {
-	logger.Errorf("recovering cell %q after error: %v", c.id, rs.Last().Reason)
+	reason := rs.Last().Reason
+	// Called while still panicking, so the stack
+	// contains the location of the panic.
+	stack := debug.Stack()
+	c.logger().Error("recovering cell after error", LogErrorKey, reason)
 	// Check frequency.
-	if rs.Frequency(12, time.Minute) {
-		return nil, errors.New(ErrRecoveredTooOften, errorMessages, rs.Last().Reason)
+	if rs.Frequency(c.recovery.maxRecoveries, c.recovery.window) {
+		err := errors.New(ErrRecoveredTooOften, errorMessages, reason)
+		c.failed(err, stack)
+		return nil, err
 	}
 	// Try to recover.
-	if err := c.behavior.Recover(rs.Last().Reason); err != nil {
-		return nil, errors.Annotate(err, ErrEventRecovering, errorMessages, rs.Last().Reason)
+	if err := c.currentBehavior().Recover(reason); err != nil {
+		err = errors.Annotate(err, ErrEventRecovering, errorMessages, reason)
+		c.failed(err, stack)
+		return nil, err
+	}
+	c.metrics.recovered()
+	c.publishFailure(RecoveringTopic, reason, stack)
+	if c.recovery.backoff > 0 {
+		time.Sleep(c.recovery.backoff)
 	}
-	return rs.Trim(12), nil
+	return rs.Trim(c.recovery.maxRecoveries), nil
 }
 
 // EOF
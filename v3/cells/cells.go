@@ -12,6 +12,8 @@ package cells
 //--------------------
 
 import (
+	"context"
+	"log/slog"
 	"time"
 
 	"github.com/tideland/goas/v1/scene"
@@ -28,27 +30,90 @@ type Environment interface {
 	ID() string
 
 	// StartCell starts a new cell with a given ID and its behavior.
-	StartCell(id string, behavior Behavior) error
+	// Options like the recovery policy can be set per cell.
+	StartCell(id string, behavior Behavior, options ...CellOption) error
 
-	// StopCell stops and removes the cell with the given ID.
+	// StopCell stops and removes the cell with the given ID. It's
+	// also unsubscribed from its emitters.
 	StopCell(id string) error
 
+	// ReplaceBehavior replaces the behavior of a running cell. The
+	// processing is paused, the old behavior is terminated, and the new
+	// one is initialized. If it implements the BehaviorMigrator its
+	// Migrate() method gets the old one to take over the state. Queued
+	// events and subscriptions are kept. If the new behavior fails the
+	// old one is initialized again. Behaviors cannot replace the
+	// behavior of their own cell. Behaviors replacing those of cells
+	// which replace theirs in turn, directly or via other cells, get
+	// an error signaled by IsReplacementCycleError() instead of
+	// waiting for each other.
+	ReplaceBehavior(id string, behavior Behavior) error
+
+	// StartSupervisor starts the cells of a supervision tree. When
+	// a supervised cell fails the supervisor restarts it and possibly
+	// other cells with fresh behaviors, keeping their subscriptions.
+	StartSupervisor(spec SupervisorSpec) error
+
 	// HasCell returns true if the cell with the given ID exists.
 	HasCell(id string) bool
 
+	// Cells returns the sorted IDs of all cells.
+	Cells() []string
+
+	// Topology returns a snapshot of the cells, their behavior
+	// types, subscriptions, and queue lengths.
+	Topology() Topology
+
+	// Metrics returns a snapshot of the metrics of the cells. They
+	// can be exported with NewMetricsHandler() and PublishMetrics().
+	Metrics() Metrics
+
+	// Snapshot stores the snapshots of the behaviors of the cells
+	// with the given IDs, or of all cells, into the snapshot store of
+	// the environment. Only behaviors implementing the Snapshotter
+	// are snapshotted. The behaviors are restored out of them when
+	// cells with the same IDs are started again. Called by a behavior
+	// its own cell is snapshotted at once, the other cells
+	// asynchronously and failures are logged.
+	Snapshot(ids ...string) error
+
+	// Listen accepts links of other environments at the network
+	// address, e.g. "tcp" and "localhost:7000" or "unix" and the
+	// path of a socket. Without authorizers every environment able
+	// to connect may emit to, request, and subscribe all cells.
+	Listen(network, address string, authorizers ...LinkAuthorizer) (Listener, error)
+
+	// Connect links the environment to the one listening
+	// at the network address.
+	Connect(network, address string) (Link, error)
+
 	// Subscribe assigns cells as receivers of the emitted
 	// events of the first cell.
 	Subscribe(emitterId string, subscriberIds ...string) error
 
+	// SubscribeFiltered assigns a cell as receiver of those events
+	// emitted by the emitter cell which pass the filter. Subscribing
+	// the same cell again replaces the filter.
+	SubscribeFiltered(emitterId, subscriberId string, filter SubscriptionFilter) error
+
 	// Subscribers returns the subscribers of the passed ID.
 	Subscribers(id string) ([]string, error)
 
+	// Subscriptions returns the IDs of the cells the cell with
+	// the passed ID is subscribed to.
+	Subscriptions(id string) ([]string, error)
+
 	// Unsubscribe removes the assignment of emitting und subscribed cells.
 	Unsubscribe(emitterId string, unsubscriberIds ...string) error
 
 	// Emit emits an event to the cell with a given ID.
 	Emit(id string, event Event) error
 
+	// EmitContext emits an event to the cell with a given ID. If
+	// the context is done while waiting for a full queue an error
+	// is returned.
+	EmitContext(ctx context.Context, id string, event Event) error
+
 	// EmitNew creates an event and emits it to the cell with a given ID.
 	EmitNew(id, topic string, payload interface{}, scn scene.Scene) error
 
@@ -57,6 +122,38 @@ type Environment interface {
 	// event.Respond().
 	Request(id, topic string, payload interface{}, scn scene.Scene, timeout time.Duration) (interface{}, error)
 
+	// RequestContext works like Request() but ends waiting for the
+	// response when the context is done. The context is passed with
+	// the event, so the processing behavior can see if the requester
+	// has given up.
+	RequestContext(ctx context.Context, id, topic string, payload interface{}, scn scene.Scene) (interface{}, error)
+
+	// RequestAsync emits a request like Request() but doesn't wait
+	// for the response. Instead it returns a future. Requests of
+	// behaviors additionally get the response delivered as event
+	// with the ResponseTopic, so they don't block their cell. Its
+	// payload contains the request ID, the request topic, and the
+	// response or the error.
+	RequestAsync(id, topic string, payload interface{}, scn scene.Scene, timeout time.Duration) (Future, error)
+
+	// ScatterGather emits a request to each of the cells with the given
+	// IDs, e.g. the subscribers of a cell, and collects the responses
+	// until all cells responded, the quorum of responses is reached, or
+	// the timeout expires. A quorum of 0 or less means all cells. The
+	// result contains the responses, the errors, the IDs of the cells
+	// which didn't respond in time, and the IDs of the cells which
+	// haven't been waited for after reaching the quorum. If less than
+	// needed responded an error is returned together with the partial
+	// result.
+	ScatterGather(ids []string, topic string, payload interface{}, scn scene.Scene, quorum int, timeout time.Duration) (*ScatterResult, error)
+
+	// StopGracefully stops accepting events emitted from the outside
+	// and waits at most timeout until the cells processed their queued
+	// events. Here emitting cells are drained before their subscribers.
+	// Afterwards all cells are stopped. The returned error tells which
+	// cells failed to terminate or still had pending events.
+	StopGracefully(timeout time.Duration) error
+
 	// Stop manages the proper finalization of an env.
 	Stop() error
 }
@@ -89,6 +186,28 @@ type Behavior interface {
 	Recover(r interface{}) error
 }
 
+// Snapshotter can be implemented by behaviors with a state which
+// shall survive restarts. With a snapshot store set for the environment
+// the snapshots are taken on demand, periodically, and when the cell
+// is stopped. Restore() is called after Init() when a cell with the
+// same ID is started again.
+type Snapshotter interface {
+	// Snapshot returns the encoded state of the behavior.
+	Snapshot() ([]byte, error)
+
+	// Restore sets the state of the behavior out of a snapshot.
+	Restore(snapshot []byte) error
+}
+
+// BehaviorMigrator can be implemented by behaviors replacing
+// others with Environment.ReplaceBehavior().
+type BehaviorMigrator interface {
+	// Migrate is called after Init() with the replaced and already
+	// terminated behavior. So the state can be taken over. If an
+	// error is returned the replacement is aborted.
+	Migrate(old Behavior) error
+}
+
 //--------------------
 // CONTEXT
 //--------------------
@@ -110,6 +229,10 @@ type Context interface {
 
 	// EmitNew creates an event and emits it to all subscribers of a cell.
 	EmitNew(topic string, payload interface{}, scene scene.Scene) error
+
+	// Logger returns the structured logger of the environment with
+	// the ID and the behavior type of the cell as attributes.
+	Logger() *slog.Logger
 }
 
 // EOF
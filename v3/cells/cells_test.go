@@ -12,10 +12,25 @@ package cells_test
 //--------------------
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"expvar"
 	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/tideland/goas/v1/scene"
 	"github.com/tideland/goas/v3/errors"
 	"github.com/tideland/gocn/v3/cells"
 	"github.com/tideland/gocn/v3/testsupport"
@@ -46,6 +61,201 @@ func TestEvent(t *testing.T) {
 	assert.Nil(err)
 }
 
+// TestPayloadAccessors tests the typed access to payload values.
+func TestPayloadAccessors(t *testing.T) {
+	assert := asserts.NewTestingAssertion(t, true)
+
+	now := time.Now()
+	p := cells.NewPayload(cells.PayloadValues{
+		"string":          "foo",
+		"int":             42,
+		"int64":           int64(4711),
+		"float":           4.2,
+		"integral-float":  12.0,
+		"bool":            true,
+		"time":            now,
+		"time-string":     "2015-03-13T12:00:00Z",
+		"duration":        5 * time.Second,
+		"duration-string": "1m30s",
+	})
+
+	s, err := p.GetString("string", "bar")
+	assert.Nil(err)
+	assert.Equal(s, "foo")
+	s, err = p.GetString("missing", "bar")
+	assert.Nil(err)
+	assert.Equal(s, "bar")
+	s, err = p.GetString("int", "bar")
+	assert.True(cells.IsPayloadTypeError(err))
+	assert.Equal(s, "bar")
+
+	i, err := p.GetInt("int", 0)
+	assert.Nil(err)
+	assert.Equal(i, 42)
+	i, err = p.GetInt("int64", 0)
+	assert.Nil(err)
+	assert.Equal(i, 4711)
+	i, err = p.GetInt("integral-float", 0)
+	assert.Nil(err)
+	assert.Equal(i, 12)
+	i, err = p.GetInt("float", 1)
+	assert.True(cells.IsPayloadTypeError(err))
+	assert.Equal(i, 1)
+
+	f, err := p.GetFloat64("int", 0)
+	assert.Nil(err)
+	assert.Equal(f, 42.0)
+	f, err = p.GetFloat64("float", 0)
+	assert.Nil(err)
+	assert.Equal(f, 4.2)
+	_, err = p.GetFloat64("string", 0)
+	assert.True(cells.IsPayloadTypeError(err))
+
+	b, err := p.GetBool("bool", false)
+	assert.Nil(err)
+	assert.True(b)
+	b, err = p.GetBool("missing", true)
+	assert.Nil(err)
+	assert.True(b)
+
+	tm, err := p.GetTime("time", time.Time{})
+	assert.Nil(err)
+	assert.Equal(tm, now)
+	tm, err = p.GetTime("time-string", time.Time{})
+	assert.Nil(err)
+	assert.Equal(tm.Year(), 2015)
+	_, err = p.GetTime("bool", time.Time{})
+	assert.True(cells.IsPayloadTypeError(err))
+
+	d, err := p.GetDuration("duration", 0)
+	assert.Nil(err)
+	assert.Equal(d, 5*time.Second)
+	d, err = p.GetDuration("duration-string", 0)
+	assert.Nil(err)
+	assert.Equal(d, 90*time.Second)
+	d, err = p.GetDuration("int", 0)
+	assert.Nil(err)
+	assert.Equal(d, time.Duration(42))
+}
+
+// TestPayloadStructs tests creating payloads out of structs
+// and unmarshalling them into structs.
+func TestPayloadStructs(t *testing.T) {
+	assert := asserts.NewTestingAssertion(t, true)
+
+	type order struct {
+		ID       string        `cells:"id"`
+		Quantity int           `cells:"quantity"`
+		Price    float64       `cells:"price"`
+		Express  bool          `cells:"express"`
+		Timeout  time.Duration `cells:"timeout"`
+		Note     string
+		Ignored  string `cells:"-"`
+		internal string
+	}
+
+	in := order{"o-1", 3, 9.99, true, time.Minute, "fragile", "ignored", "internal"}
+	p, err := cells.NewPayloadFromStruct(&in)
+	assert.Nil(err)
+	assert.Equal(p.Len(), 6)
+	id, err := p.GetString("id", "")
+	assert.Nil(err)
+	assert.Equal(id, "o-1")
+	_, ok := p.Get("Ignored")
+	assert.False(ok)
+	_, err = cells.NewPayloadFromStruct(42)
+	assert.True(cells.IsNoStructError(err))
+
+	var out order
+	err = p.Unmarshal(&out)
+	assert.Nil(err)
+	in.Ignored = ""
+	in.internal = ""
+	assert.Equal(out, in)
+
+	// Numbers are converted, e.g. after JSON decoding.
+	p = cells.NewPayload(cells.PayloadValues{
+		"quantity": 5.0,
+		"timeout":  "2s",
+	})
+	err = p.Unmarshal(&out)
+	assert.Nil(err)
+	assert.Equal(out.Quantity, 5)
+	assert.Equal(out.Timeout, 2*time.Second)
+
+	p = cells.NewPayload(cells.PayloadValues{"quantity": "many"})
+	err = p.Unmarshal(&out)
+	assert.True(cells.IsPayloadTypeError(err))
+	err = p.Unmarshal(out)
+	assert.True(cells.IsNoStructError(err))
+}
+
+// TestEventMetadata tests the metadata of emitted events.
+func TestEventMetadata(t *testing.T) {
+	assert := asserts.NewTestingAssertion(t, true)
+
+	event, err := cells.NewEvent("foo", "bar", nil)
+	assert.Nil(err)
+	md := event.Metadata()
+	assert.NotEmpty(md.ID)
+	assert.Equal(md.CorrelationID, md.ID)
+	assert.Empty(md.SourceID)
+	assert.Empty(md.CausationID)
+	assert.Equal(md.Hops, 0)
+
+	env := cells.NewEnvironment(cells.MaxHops(5))
+	defer env.Stop()
+
+	var counter int64
+	eventc := make(chan cells.Event, 10)
+	err = env.StartCell("forwarder", newCountingBehavior(&counter, nil))
+	assert.Nil(err)
+	err = env.StartCell("recorder", newRecordingBehavior(eventc))
+	assert.Nil(err)
+	err = env.Subscribe("forwarder", "recorder")
+	assert.Nil(err)
+
+	err = env.Emit("forwarder", event)
+	assert.Nil(err)
+	recorded := <-eventc
+	rmd := recorded.Metadata()
+	assert.Equal(rmd.ID, md.ID)
+	assert.Equal(rmd.Created, md.Created)
+	assert.Equal(rmd.CorrelationID, md.ID)
+	assert.Equal(rmd.SourceID, "forwarder")
+	assert.Equal(rmd.Hops, 1)
+
+	// Loops are stopped by the maximum hop count.
+	var ping, pong int64
+	err = env.StartCell("ping", newCountingBehavior(&ping, nil))
+	assert.Nil(err)
+	err = env.StartCell("pong", newCountingBehavior(&pong, nil))
+	assert.Nil(err)
+	err = env.Subscribe("ping", "pong")
+	assert.Nil(err)
+	err = env.Subscribe("pong", "ping")
+	assert.Nil(err)
+
+	err = env.EmitNew("ping", "loop", nil, nil)
+	assert.Nil(err)
+	testsupport.LetItWork()
+	assert.Equal(atomic.LoadInt64(&ping), int64(3))
+	assert.Equal(atomic.LoadInt64(&pong), int64(3))
+
+	// Both cells are still working.
+	for _, id := range []string{"ping", "pong"} {
+		response, err := env.Request(id, cells.PingTopic, nil, nil, time.Second)
+		assert.Nil(err)
+		assert.Equal(response, cells.PongResponse)
+	}
+
+	// Requests exceeding the maximum fail at once.
+	start := time.Now()
+	_, err = env.Request("ping", "loop?", nil, nil, 5*time.Second)
+	assert.True(cells.IsMaxHopsError(err))
+	assert.True(time.Since(start) < time.Second)
+}
+
 // TestRingBuffer tests the buffer used by the local event queue.
 func TestRingBuffer(t *testing.T) {
 	assert := asserts.NewTestingAssertion(t, true)
@@ -127,7 +337,7 @@ func TestLocalEventQueue(t *testing.T) {
 	count := 10000
 	assert := asserts.NewTestingAssertion(t, true)
 	factory := cells.MakeLocalEventQueueFactory(10)
-	queue, err := factory(nil)
+	queue, err := factory(nil, "queue-test")
 	assert.Nil(err)
 
 	for i := 0; i < count; i++ {
@@ -152,10 +362,310 @@ func TestLocalEventQueue(t *testing.T) {
 	assert.Nil(queue.Stop())
 }
 
+// TestBoundedLocalEventQueue tests the overflow policies
+// of the bounded local event queue.
+func TestBoundedLocalEventQueue(t *testing.T) {
+	assert := asserts.NewTestingAssertion(t, true)
+	newEvent := func(i int) cells.Event {
+		event, err := cells.NewEvent("queue-test", i, nil)
+		assert.Nil(err)
+		return event
+	}
+	payload := func(event cells.Event) interface{} {
+		value, ok := event.Payload().Get(cells.DefaultPayload)
+		assert.True(ok)
+		return value
+	}
+
+	// Drop newest.
+	factory := cells.MakeBoundedLocalEventQueueFactory(5, 5, cells.OverflowDropNewest, 0)
+	queue, err := factory(nil, "queue-test")
+	assert.Nil(err)
+	for i := 0; i < 8; i++ {
+		assert.Nil(queue.Push(newEvent(i)))
+	}
+	mqueue := queue.(cells.MeasurableEventQueue)
+	assert.Equal(mqueue.Len(), 5)
+	assert.Equal(mqueue.Dropped(), int64(3))
+	assert.Equal(payload(<-queue.Events()), 0)
+	assert.Nil(queue.Stop())
+
+	// Drops are reported rate limited.
+	buf := &syncBuffer{}
+	env := cells.NewEnvironment(cells.ID("drops"), cells.Logger(slog.NewJSONHandler(buf, nil)))
+	defer env.Stop()
+	queue, err = factory(env, "queue-test")
+	assert.Nil(err)
+	for i := 0; i < 100; i++ {
+		assert.Nil(queue.Push(newEvent(i)))
+	}
+	assert.Equal(queue.(cells.MeasurableEventQueue).Dropped(), int64(95))
+	reports := 0
+	for _, record := range buf.records(assert) {
+		if strings.HasPrefix(record["msg"].(string), "event queue overflow") {
+			reports++
+		}
+	}
+	assert.Equal(reports, 1)
+	assert.Nil(queue.Stop())
+
+	// Drop oldest.
+	factory = cells.MakeBoundedLocalEventQueueFactory(5, 5, cells.OverflowDropOldest, 0)
+	queue, err = factory(nil, "queue-test")
+	assert.Nil(err)
+	for i := 0; i < 8; i++ {
+		assert.Nil(queue.Push(newEvent(i)))
+	}
+	mqueue = queue.(cells.MeasurableEventQueue)
+	assert.Equal(mqueue.Len(), 5)
+	assert.Equal(mqueue.Dropped(), int64(3))
+	assert.Equal(payload(<-queue.Events()), 3)
+	assert.Nil(queue.Stop())
+
+	// Error.
+	factory = cells.MakeBoundedLocalEventQueueFactory(5, 5, cells.OverflowError, 0)
+	queue, err = factory(nil, "queue-test")
+	assert.Nil(err)
+	for i := 0; i < 5; i++ {
+		assert.Nil(queue.Push(newEvent(i)))
+	}
+	err = queue.Push(newEvent(5))
+	assert.True(cells.IsQueueOverflowError(err))
+	assert.Equal(payload(<-queue.Events()), 0)
+	assert.Nil(queue.Push(newEvent(6)))
+	assert.Nil(queue.Stop())
+
+	// Block with timeout.
+	factory = cells.MakeBoundedLocalEventQueueFactory(5, 5, cells.OverflowBlockTimeout, 50*time.Millisecond)
+	queue, err = factory(nil, "queue-test")
+	assert.Nil(err)
+	for i := 0; i < 5; i++ {
+		assert.Nil(queue.Push(newEvent(i)))
+	}
+	err = queue.Push(newEvent(5))
+	assert.True(cells.IsTimeoutError(err))
+	assert.Nil(queue.Stop())
+
+	// Block.
+	factory = cells.MakeBoundedLocalEventQueueFactory(5, 5, cells.OverflowBlock, 0)
+	queue, err = factory(nil, "queue-test")
+	assert.Nil(err)
+	for i := 0; i < 5; i++ {
+		assert.Nil(queue.Push(newEvent(i)))
+	}
+	pushed := make(chan struct{})
+	go func() {
+		queue.Push(newEvent(5))
+		close(pushed)
+	}()
+	select {
+	case <-pushed:
+		assert.Fail("push into full queue didn't block")
+	case <-time.After(50 * time.Millisecond):
+	}
+	assert.Equal(payload(<-queue.Events()), 0)
+	<-pushed
+	assert.Equal(queue.(cells.MeasurableEventQueue).Len(), 5)
+	assert.Nil(queue.Stop())
+}
+
+// testPoint is a custom payload type for the codec tests.
+type testPoint struct {
+	X int
+	Y int
+}
+
+// TestPayloadCodecs tests the round trip of events through
+// the registered payload codecs.
+func TestPayloadCodecs(t *testing.T) {
+	assert := asserts.NewTestingAssertion(t, true)
+
+	err := cells.RegisterPayloadType("cells_test.testPoint", testPoint{})
+	assert.Nil(err)
+	err = cells.RegisterPayloadType("cells_test.testPoint", testPoint{})
+	assert.Nil(err)
+	err = cells.RegisterPayloadType("cells_test.testPoint", time.Time{})
+	assert.True(cells.IsTypeRegistrationError(err))
+	err = cells.RegisterPayloadType("cells_test.otherPoint", testPoint{})
+	assert.True(cells.IsTypeRegistrationError(err))
+	names := cells.PayloadCodecNames()
+	assert.Equal(names, []string{"gob", "json", "msgpack"})
+	_, err = cells.LookupPayloadCodec("humpf")
+	assert.True(cells.IsUnknownCodecError(err))
+
+	scn := scene.Start()
+	defer scn.Stop()
+	now := time.Now()
+	event, err := cells.NewEvent("foo", cells.PayloadValues{
+		"string":   "bar",
+		"bool":     true,
+		"int":      42,
+		"float":    4.2,
+		"list":     []interface{}{"a", "b"},
+		"map":      map[string]interface{}{"point": testPoint{1, 2}},
+		"time":     now,
+		"duration": 5 * time.Second,
+		"point":    testPoint{3, 4},
+	}, scn)
+	assert.Nil(err)
+
+	for _, name := range names {
+		codec, err := cells.LookupPayloadCodec(name)
+		assert.Nil(err)
+		data, err := codec.Encode(event)
+		assert.Nil(err, name)
+		decoded, err := codec.Decode(data)
+		assert.Nil(err, name)
+
+		assert.Equal(decoded.Topic(), "foo", name)
+		md := decoded.Metadata()
+		assert.Equal(md.ID, event.Metadata().ID, name)
+		assert.True(md.Created.Equal(event.Metadata().Created), name)
+		assert.Equal(md.SceneID, scn.ID().String(), name)
+
+		p := decoded.Payload()
+		assertValue := func(key string, expected interface{}) {
+			value, ok := p.Get(key)
+			assert.True(ok, name, key)
+			assert.Equal(value, expected, name, key)
+		}
+		assertValue("string", "bar")
+		assertValue("bool", true)
+		assertValue("list", []interface{}{"a", "b"})
+		assertValue("map", map[string]interface{}{"point": testPoint{1, 2}})
+		assertValue("duration", 5*time.Second)
+		assertValue("point", testPoint{3, 4})
+		value, ok := p.Get("time")
+		assert.True(ok, name)
+		assert.True(value.(time.Time).Equal(now), name)
+		value, ok = p.Get("int")
+		assert.True(ok, name)
+		assert.Equal(fmt.Sprintf("%v", value), "42", name)
+		value, ok = p.Get("float")
+		assert.True(ok, name)
+		assert.Equal(fmt.Sprintf("%v", value), "4.2", name)
+	}
+
+	// Announced lengths exceeding the data are rejected.
+	codec, err := cells.LookupPayloadCodec("msgpack")
+	assert.Nil(err)
+	for _, data := range [][]byte{
+		{0xdd, 0xff, 0xff, 0xff, 0xff},
+		{0xdf, 0xff, 0xff, 0xff, 0xff},
+		{0x81, 0xa1, 'a'},
+	} {
+		_, err = codec.Decode(data)
+		assert.True(cells.IsDecodingError(err))
+	}
+
+	// Deeply nested data is rejected before exhausting the stack.
+	nested := append(bytes.Repeat([]byte{0x91}, 100000), 0xc0)
+	_, err = codec.Decode(nested)
+	assert.True(cells.IsDecodingError(err))
+	assert.ErrorMatch(err, ".*nested deeper than 10000.*")
+}
+
+// TestDiskEventQueue tests the durable disk event queue.
+func TestDiskEventQueue(t *testing.T) {
+	assert := asserts.NewTestingAssertion(t, true)
+	dir, err := os.MkdirTemp("", "gocn-disk-queue")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+	segments := func() int {
+		matches, err := filepath.Glob(filepath.Join(dir, "disk-test", "*.log"))
+		assert.Nil(err)
+		return len(matches)
+	}
+	factory := cells.MakeDiskEventQueueFactory(dir, cells.NewJSONPayloadCodec(), cells.SyncAlways, 128)
+
+	// Push events and process some of them.
+	queue, err := factory(nil, "disk-test")
+	assert.Nil(err)
+	for i := 0; i < 10; i++ {
+		event, err := cells.NewEvent(fmt.Sprintf("disk-test-%d", i), i, nil)
+		assert.Nil(err)
+		assert.Nil(queue.Push(event))
+	}
+	assert.Equal(queue.(cells.MeasurableEventQueue).Len(), 10)
+	written := segments()
+	assert.True(written > 1)
+	for i := 0; i < 4; i++ {
+		event := <-queue.Events()
+		assert.Equal(event.Topic(), fmt.Sprintf("disk-test-%d", i))
+	}
+	assert.Nil(queue.Stop())
+
+	// Restart and receive the remaining ones.
+	queue, err = factory(nil, "disk-test")
+	assert.Nil(err)
+	assert.Equal(queue.(cells.MeasurableEventQueue).Len(), 6)
+	for i := 4; i < 10; i++ {
+		event := <-queue.Events()
+		assert.Equal(event.Topic(), fmt.Sprintf("disk-test-%d", i))
+		value, ok := event.Payload().Get(cells.DefaultPayload)
+		assert.True(ok)
+		assert.Equal(value, float64(i))
+	}
+	assert.Nil(queue.Stop())
+	assert.True(segments() < written)
+
+	// Restart again, now empty.
+	queue, err = factory(nil, "disk-test")
+	assert.Nil(err)
+	assert.Equal(queue.(cells.MeasurableEventQueue).Len(), 0)
+	assert.Nil(queue.Stop())
+}
+
+// TestPriorityEventQueue tests the priority event queue.
+func TestPriorityEventQueue(t *testing.T) {
+	assert := asserts.NewTestingAssertion(t, true)
+	push := func(queue cells.EventQueue, topic string, payload interface{}) {
+		event, err := cells.NewEvent(topic, payload, nil)
+		assert.Nil(err)
+		assert.Nil(queue.Push(event))
+	}
+	receive := func(queue cells.EventQueue) string {
+		event := <-queue.Events()
+		return event.Topic()
+	}
+	priorities := map[string]int{
+		cells.StatusTopic: 10,
+	}
+
+	// Priorities by topic and payload, FIFO inside one priority.
+	factory := cells.MakePriorityEventQueueFactory(priorities, 0)
+	queue, err := factory(nil, "priority-test")
+	assert.Nil(err)
+	push(queue, "data-1", nil)
+	push(queue, "data-2", nil)
+	push(queue, "important-1", cells.PayloadValues{cells.PriorityPayload: 5})
+	push(queue, cells.StatusTopic, nil)
+	push(queue, "important-2", cells.PayloadValues{cells.PriorityPayload: 5})
+	push(queue, "data-3", nil)
+	assert.Equal(receive(queue), cells.StatusTopic)
+	assert.Equal(receive(queue), "important-1")
+	assert.Equal(receive(queue), "important-2")
+	assert.Equal(receive(queue), "data-1")
+	assert.Equal(receive(queue), "data-2")
+	assert.Equal(receive(queue), "data-3")
+	assert.Nil(queue.Stop())
+
+	// Aging lets waiting events overtake.
+	factory = cells.MakePriorityEventQueueFactory(priorities, 10*time.Millisecond)
+	queue, err = factory(nil, "priority-test")
+	assert.Nil(err)
+	push(queue, "data-1", nil)
+	time.Sleep(50 * time.Millisecond)
+	push(queue, "important-1", cells.PayloadValues{cells.PriorityPayload: 2})
+	assert.Equal(receive(queue), "data-1")
+	assert.Equal(receive(queue), "important-1")
+	assert.Nil(queue.Stop())
+}
+
 // BenchmarkLocalEventQueue tests the performance of the local event queue.
 func BenchmarkLocalEventQueue(b *testing.B) {
 	factory := cells.MakeLocalEventQueueFactory(10)
-	queue, err := factory(nil)
+	queue, err := factory(nil, "queue-test")
 	if err != nil {
 		b.Fatalf("cannot create queue: %v", err)
 	}
@@ -239,6 +749,118 @@ func TestEnvironmentSubscribeUnsubscribe(t *testing.T) {
 	assert.Empty(subs)
 }
 
+// TestEnvironmentStopCellUnsubscribes tests the removal of
+// the subscriptions of a stopped cell.
+func TestEnvironmentStopCellUnsubscribes(t *testing.T) {
+	assert := asserts.NewTestingAssertion(t, true)
+
+	env := cells.NewEnvironment()
+	defer env.Stop()
+
+	for _, id := range []string{"foo", "bar", "baz", "yadda"} {
+		err := env.StartCell(id, testsupport.NewTestBehavior())
+		assert.Nil(err)
+	}
+	err := env.Subscribe("foo", "bar")
+	assert.Nil(err)
+	err = env.Subscribe("baz", "bar")
+	assert.Nil(err)
+	err = env.Subscribe("bar", "yadda")
+	assert.Nil(err)
+
+	_, err = env.Subscriptions("humpf")
+	assert.True(errors.IsError(err, cells.ErrInvalidID))
+	subs, err := env.Subscriptions("bar")
+	assert.Nil(err)
+	assert.Length(subs, 2)
+	assert.Contents("foo", subs)
+	assert.Contents("baz", subs)
+	subs, err = env.Subscriptions("yadda")
+	assert.Nil(err)
+	assert.Equal(subs, []string{"bar"})
+
+	err = env.Unsubscribe("baz", "bar")
+	assert.Nil(err)
+	subs, err = env.Subscriptions("bar")
+	assert.Nil(err)
+	assert.Equal(subs, []string{"foo"})
+
+	err = env.StopCell("bar")
+	assert.Nil(err)
+	subs, err = env.Subscribers("foo")
+	assert.Nil(err)
+	assert.Empty(subs)
+	subs, err = env.Subscriptions("yadda")
+	assert.Nil(err)
+	assert.Empty(subs)
+
+	err = env.EmitNew("foo", "foo", nil, nil)
+	assert.Nil(err)
+}
+
+// TestEnvironmentSubscribeFiltered tests subscribing with
+// topic filters.
+func TestEnvironmentSubscribeFiltered(t *testing.T) {
+	assert := asserts.NewTestingAssertion(t, true)
+
+	env := cells.NewEnvironment()
+	defer env.Stop()
+
+	var in, exact, prefix, pattern, predicate int64
+	counters := map[string]*int64{
+		"in":        &in,
+		"exact":     &exact,
+		"prefix":    &prefix,
+		"pattern":   &pattern,
+		"predicate": &predicate,
+	}
+	for id, counter := range counters {
+		err := env.StartCell(id, newCountingBehavior(counter, nil))
+		assert.Nil(err)
+	}
+	err := env.SubscribeFiltered("in", "humpf", cells.TopicFilter("foo"))
+	assert.True(errors.IsError(err, cells.ErrInvalidID))
+	err = env.SubscribeFiltered("in", "exact", cells.TopicFilter("invoice.created"))
+	assert.Nil(err)
+	err = env.SubscribeFiltered("in", "prefix", cells.TopicPrefixFilter("order."))
+	assert.Nil(err)
+	err = env.SubscribeFiltered("in", "pattern", cells.TopicPatternFilter("order.*.created"))
+	assert.Nil(err)
+	err = env.SubscribeFiltered("in", "predicate", func(event cells.Event) bool {
+		return strings.HasSuffix(event.Topic(), ".created")
+	})
+	assert.Nil(err)
+	subs, err := env.Subscribers("in")
+	assert.Nil(err)
+	assert.Length(subs, 4)
+
+	topics := []string{
+		"order.book.created",
+		"order.book.paper.created",
+		"order.book.deleted",
+		"invoice.created",
+	}
+	for _, topic := range topics {
+		err = env.EmitNew("in", topic, nil, nil)
+		assert.Nil(err)
+	}
+	testsupport.LetItWork()
+	assert.Equal(atomic.LoadInt64(&in), int64(4))
+	assert.Equal(atomic.LoadInt64(&exact), int64(1))
+	assert.Equal(atomic.LoadInt64(&prefix), int64(3))
+	assert.Equal(atomic.LoadInt64(&pattern), int64(1))
+	assert.Equal(atomic.LoadInt64(&predicate), int64(3))
+
+	// Subscribing again without filter removes it.
+	err = env.Subscribe("in", "exact")
+	assert.Nil(err)
+	err = env.EmitNew("in", "order.book.created", nil, nil)
+	assert.Nil(err)
+	testsupport.LetItWork()
+	assert.Equal(atomic.LoadInt64(&exact), int64(2))
+	assert.Equal(atomic.LoadInt64(&pattern), int64(2))
+}
+
 // TestEnvironmentScenario tests creating and using the
 // environment in a simple way.
 func TestEnvironmentScenario(t *testing.T) {
@@ -275,4 +897,1685 @@ func TestEnvironmentScenario(t *testing.T) {
 	assert.Contents(`<event: "ipsum" / payload: <"default": 1234>>`, collected)
 }
 
+// TestEnvironmentContext tests emitting and requesting
+// with a context.
+func TestEnvironmentContext(t *testing.T) {
+	assert := asserts.NewTestingAssertion(t, true)
+	env := cells.NewEnvironment(cells.ID("context"), cells.BoundedLocalQueueFactory(1, cells.OverflowBlock, 0))
+	defer env.Stop()
+
+	err := env.StartCell("waiter", newWaitingBehavior())
+	assert.Nil(err)
+
+	// Canceled request.
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+	_, err = env.RequestContext(ctx, "waiter", "wait?", nil, nil)
+	assert.True(cells.IsCanceledError(err))
+	canceled, err := env.Request("waiter", "canceled?", nil, nil, cells.DefaultTimeout)
+	assert.Nil(err)
+	assert.Equal(canceled, 1)
+
+	// Request with deadline.
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = env.RequestContext(ctx, "waiter", "wait?", nil, nil)
+	assert.True(cells.IsTimeoutError(err))
+
+	// Emit waiting for a full queue.
+	blockc := make(chan struct{})
+	err = env.EmitNew("waiter", "block!", blockc, nil)
+	assert.Nil(err)
+	err = env.EmitNew("waiter", "queued", nil, nil)
+	assert.Nil(err)
+	event, err := cells.NewEvent("waiting", nil, nil)
+	assert.Nil(err)
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err = env.EmitContext(ctx, "waiter", event)
+	assert.True(cells.IsTimeoutError(err))
+	close(blockc)
+	err = env.EmitContext(context.Background(), "waiter", event)
+	assert.Nil(err)
+}
+
+// TestEnvironmentStopGracefully tests the draining of the
+// queues when stopping an environment.
+func TestEnvironmentStopGracefully(t *testing.T) {
+	assert := asserts.NewTestingAssertion(t, true)
+
+	// Drain all events.
+	env := cells.NewEnvironment(cells.ID("stop-gracefully"))
+	counter := int64(0)
+	err := env.StartCell("foo", newCountingBehavior(&counter, nil))
+	assert.Nil(err)
+	err = env.StartCell("bar", newCountingBehavior(&counter, nil))
+	assert.Nil(err)
+	err = env.Subscribe("foo", "bar")
+	assert.Nil(err)
+	for i := 0; i < 1000; i++ {
+		err = env.EmitNew("foo", "count", i, nil)
+		assert.Nil(err)
+	}
+	err = env.StopGracefully(cells.DefaultTimeout)
+	assert.Nil(err)
+	assert.Equal(atomic.LoadInt64(&counter), int64(2000))
+	err = env.EmitNew("foo", "count", 0, nil)
+	assert.True(cells.IsStoppingError(err))
+
+	// Report failing and not drained cells.
+	env = cells.NewEnvironment(cells.ID("stop-gracefully-errors"))
+	err = env.StartCell("failing", newCountingBehavior(&counter, fmt.Errorf("cannot terminate")))
+	assert.Nil(err)
+	err = env.StartCell("waiter", newWaitingBehavior())
+	assert.Nil(err)
+	blockc := make(chan struct{})
+	err = env.EmitNew("waiter", "block!", blockc, nil)
+	assert.Nil(err)
+	err = env.EmitNew("waiter", "queued", nil, nil)
+	assert.Nil(err)
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		close(blockc)
+	}()
+	err = env.StopGracefully(50 * time.Millisecond)
+	assert.True(cells.IsStoppedWithErrorsError(err))
+	assert.True(strings.Contains(err.Error(), `cell "failing"`))
+	assert.True(strings.Contains(err.Error(), `cell "waiter": cell still had 2 pending events`))
+	cerrs, ok := errors.Annotated(err).(cells.CellErrors)
+	assert.True(ok)
+	assert.Length(cerrs, 2)
+	assert.ErrorMatch(cerrs["failing"], "cannot terminate")
+	assert.True(cells.IsPendingEventsError(cerrs["waiter"]))
+
+	// Plain stop reports failing cells too.
+	env = cells.NewEnvironment(cells.ID("stop-errors"))
+	err = env.StartCell("failing", newCountingBehavior(&counter, fmt.Errorf("cannot terminate")))
+	assert.Nil(err)
+	err = env.Stop()
+	assert.True(cells.IsStoppedWithErrorsError(err))
+	cerrs, ok = errors.Annotated(err).(cells.CellErrors)
+	assert.True(ok)
+	assert.Equal(cerrs.Error(), `cell "failing": cannot terminate`)
+}
+
+// TestEnvironmentTopology tests the introspection
+// of the environment.
+func TestEnvironmentTopology(t *testing.T) {
+	assert := asserts.NewTestingAssertion(t, true)
+	env := cells.NewEnvironment(cells.ID("topology"))
+	defer env.Stop()
+
+	assert.Empty(env.Cells())
+	for _, id := range []string{"foo", "bar", "baz"} {
+		err := env.StartCell(id, testsupport.NewTestBehavior())
+		assert.Nil(err)
+	}
+	err := env.StartCell("waiter", newWaitingBehavior())
+	assert.Nil(err)
+	err = env.Subscribe("foo", "bar", "baz")
+	assert.Nil(err)
+	err = env.Subscribe("bar", "waiter")
+	assert.Nil(err)
+	assert.Equal(env.Cells(), []string{"bar", "baz", "foo", "waiter"})
+
+	topology := env.Topology()
+	assert.Equal(topology.EnvironmentID, "topology")
+	assert.Length(topology.Cells, 4)
+	assert.Equal(topology.Cells[2].ID, "foo")
+	assert.Equal(topology.Cells[2].Behavior, "*testsupport.testBehavior")
+	assert.Equal(topology.Cells[2].Subscribers, []string{"bar", "baz"})
+	assert.Equal(topology.Cells[2].QueueLen, 0)
+	assert.Equal(topology.Cells[3].Behavior, "*cells_test.waitingBehavior")
+
+	dot := topology.DOT()
+	assert.True(strings.HasPrefix(dot, `digraph "topology" {`))
+	assert.True(strings.Contains(dot, `"foo" -> "bar";`))
+	assert.True(strings.Contains(dot, `"bar" -> "waiter";`))
+
+	mermaid := topology.Mermaid()
+	assert.True(strings.HasPrefix(mermaid, "graph LR\n"))
+	assert.True(strings.Contains(mermaid, "cell2 --> cell0"))
+	assert.True(strings.Contains(mermaid, "cell0 --> cell3"))
+	assert.True(strings.Contains(mermaid, "*testsupport.testBehavior"))
+}
+
+// TestEnvironmentSupervisor tests the restarting of
+// supervised cells.
+func TestEnvironmentSupervisor(t *testing.T) {
+	assert := asserts.NewTestingAssertion(t, true)
+	env := cells.NewEnvironment(cells.ID("supervisor"))
+	defer env.Stop()
+
+	instances := map[string]*int64{"a": new(int64), "b": new(int64), "c": new(int64), "x": new(int64), "y": new(int64)}
+	factory := func(id string) cells.BehaviorFactory {
+		return func() cells.Behavior {
+			return newFailingBehavior(atomic.AddInt64(instances[id], 1))
+		}
+	}
+	instance := func(id string) int64 {
+		response, err := env.Request(id, cells.PingTopic, nil, nil, cells.DefaultTimeout)
+		assert.Nil(err)
+		return response.(int64)
+	}
+	fail := func(id string) {
+		err := env.EmitNew(id, "fail!", nil, nil)
+		assert.Nil(err)
+		testsupport.LetItWork()
+	}
+
+	err := env.StartSupervisor(cells.SupervisorSpec{
+		ID:       "root",
+		Strategy: cells.RestForOne,
+		Children: []cells.ChildSpec{
+			cells.CellSpec("a", factory("a")),
+			cells.CellSpec("b", factory("b")),
+			cells.CellSpec("c", factory("c")),
+			cells.SupervisorChildSpec(cells.SupervisorSpec{
+				ID:          "nested",
+				Strategy:    cells.OneForOne,
+				MaxRestarts: 1,
+				Children: []cells.ChildSpec{
+					cells.CellSpec("x", factory("x")),
+					cells.CellSpec("y", factory("y")),
+				},
+			}),
+		},
+	})
+	assert.Nil(err)
+	err = env.Subscribe("a", "b")
+	assert.Nil(err)
+	err = env.Subscribe("b", "c")
+	assert.Nil(err)
+
+	// Rest for one, also restarting the nested supervisor.
+	fail("b")
+	assert.Equal(instance("a"), int64(1))
+	assert.Equal(instance("b"), int64(2))
+	assert.Equal(instance("c"), int64(2))
+	assert.Equal(instance("x"), int64(2))
+	assert.Equal(instance("y"), int64(2))
+	subs, err := env.Subscribers("a")
+	assert.Nil(err)
+	assert.Equal(subs, []string{"b"})
+
+	// Nested one for one.
+	fail("x")
+	assert.Equal(instance("x"), int64(3))
+	assert.Equal(instance("y"), int64(2))
+
+	// Nested supervisor gives up and will be restarted.
+	fail("y")
+	assert.Equal(instance("x"), int64(4))
+	assert.Equal(instance("y"), int64(3))
+	fail("y")
+	assert.Equal(instance("x"), int64(4))
+	assert.Equal(instance("y"), int64(4))
+	assert.Equal(instance("a"), int64(1))
+
+	// Root supervisor gives up.
+	fail("c")
+	assert.Equal(instance("c"), int64(3))
+	assert.Equal(instance("x"), int64(5))
+	fail("c")
+	assert.False(env.HasCell("a"))
+	assert.False(env.HasCell("x"))
+
+	// Invalid specs.
+	err = env.StartSupervisor(cells.SupervisorSpec{
+		ID:       "invalid",
+		Children: []cells.ChildSpec{cells.CellSpec("z", nil)},
+	})
+	assert.True(cells.IsInvalidSupervisorSpecError(err))
+	err = env.StartSupervisor(cells.SupervisorSpec{
+		ID: "duplicate",
+		Children: []cells.ChildSpec{
+			cells.CellSpec("z", factory("x")),
+			cells.CellSpec("z", factory("x")),
+		},
+	})
+	assert.True(cells.IsDuplicateIdError(err))
+}
+
+// TestEnvironmentSupervisorBackoff tests the delay of restarts.
+func TestEnvironmentSupervisorBackoff(t *testing.T) {
+	assert := asserts.NewTestingAssertion(t, true)
+
+	// Doubled up to the maximum without overflow.
+	spec := cells.SupervisorSpec{Backoff: time.Second, MaxBackoff: time.Minute}
+	assert.Equal(cells.SupervisorBackoff(spec, 1), time.Second)
+	assert.Equal(cells.SupervisorBackoff(spec, 2), 2*time.Second)
+	assert.Equal(cells.SupervisorBackoff(spec, 6), 32*time.Second)
+	assert.Equal(cells.SupervisorBackoff(spec, 7), time.Minute)
+	assert.Equal(cells.SupervisorBackoff(spec, 100), time.Minute)
+	spec = cells.SupervisorSpec{Backoff: time.Duration(math.MaxInt64 / 3), MaxBackoff: time.Duration(math.MaxInt64)}
+	assert.Equal(cells.SupervisorBackoff(spec, 100), time.Duration(math.MaxInt64))
+
+	// Children failing at the same time wait concurrently.
+	env := cells.NewEnvironment(cells.ID("supervisor-backoff"))
+	defer env.Stop()
+	var p, q int64
+	err := env.StartSupervisor(cells.SupervisorSpec{
+		ID:          "root",
+		Strategy:    cells.OneForOne,
+		MaxRestarts: 10,
+		Backoff:     300 * time.Millisecond,
+		MaxBackoff:  300 * time.Millisecond,
+		Children: []cells.ChildSpec{
+			cells.CellSpec("p", func() cells.Behavior { return newFailingBehavior(atomic.AddInt64(&p, 1)) }),
+			cells.CellSpec("q", func() cells.Behavior { return newFailingBehavior(atomic.AddInt64(&q, 1)) }),
+		},
+	})
+	assert.Nil(err)
+	start := time.Now()
+	for _, id := range []string{"p", "q"} {
+		err = env.EmitNew(id, "fail!", nil, nil)
+		assert.Nil(err)
+	}
+	testsupport.LetItWork()
+	for _, id := range []string{"p", "q"} {
+		response, err := env.Request(id, cells.PingTopic, nil, nil, cells.DefaultTimeout)
+		assert.Nil(err)
+		assert.Equal(response, int64(2))
+	}
+	elapsed := time.Since(start)
+	assert.True(elapsed >= 300*time.Millisecond)
+	assert.True(elapsed < 550*time.Millisecond)
+}
+
+// TestEnvironmentRecoveryPolicy tests the recovery policy
+// of cells and the publishing of failures.
+func TestEnvironmentRecoveryPolicy(t *testing.T) {
+	assert := asserts.NewTestingAssertion(t, true)
+	env := cells.NewEnvironment(cells.ID("recovery-policy"), cells.ErrorCell("errors"))
+	defer env.Stop()
+
+	err := env.StartCell("errors", testsupport.NewTestBehavior())
+	assert.Nil(err)
+	err = env.StartCell("panicker", testsupport.NewTestBehavior(), cells.RecoveryPolicy(3, time.Minute, 10*time.Millisecond))
+	assert.Nil(err)
+
+	for i := 0; i < 3; i++ {
+		err = env.EmitNew("panicker", testsupport.PanicTopic, nil, nil)
+		assert.Nil(err)
+	}
+	testsupport.LetItWork()
+
+	processed, err := env.Request("errors", cells.ProcessedTopic, nil, nil, cells.DefaultTimeout)
+	assert.Nil(err)
+	events := processed.([]string)
+	assert.Length(events, 3)
+	assert.True(strings.Contains(events[0], `"recovering!"`))
+	assert.True(strings.Contains(events[0], `<"cell:id": panicker>`))
+	assert.True(strings.Contains(events[0], `<"cell:reason": Ouch!>`))
+	assert.True(strings.Contains(events[0], "testBehavior).ProcessEvent"))
+	assert.True(strings.Contains(events[1], `"recovering!"`))
+	assert.True(strings.Contains(events[2], `"failed!"`))
+	assert.True(strings.Contains(events[2], "too much recoverings"))
+
+	// Returned errors have no stack.
+	err = env.StartCell("failer", newFailingBehavior(1))
+	assert.Nil(err)
+	err = env.EmitNew("failer", "fail!", nil, nil)
+	assert.Nil(err)
+	testsupport.LetItWork()
+	processed, err = env.Request("errors", cells.ProcessedTopic, nil, nil, cells.DefaultTimeout)
+	assert.Nil(err)
+	events = processed.([]string)
+	assert.Length(events, 4)
+	assert.True(strings.Contains(events[3], `"failed!"`))
+	assert.True(strings.Contains(events[3], `<"cell:reason": failing instance 1>`))
+	assert.False(strings.Contains(events[3], cells.CellStackPayload))
+
+	// Invalid window falls back to the default.
+	err = env.StartCell("zero-window", testsupport.NewTestBehavior(), cells.RecoveryPolicy(2, 0, -time.Second))
+	assert.Nil(err)
+	for i := 0; i < 2; i++ {
+		err = env.EmitNew("zero-window", testsupport.PanicTopic, nil, nil)
+		assert.Nil(err)
+	}
+	testsupport.LetItWork()
+	processed, err = env.Request("errors", cells.ProcessedTopic, nil, nil, cells.DefaultTimeout)
+	assert.Nil(err)
+	events = processed.([]string)
+	assert.Length(events, 6)
+	assert.True(strings.Contains(events[5], `"failed!"`))
+}
+
+// TestRequestAs tests the typed requests.
+func TestRequestAs(t *testing.T) {
+	assert := asserts.NewTestingAssertion(t, true)
+
+	env := cells.NewEnvironment()
+	defer env.Stop()
+
+	err := env.StartCell("test", testsupport.NewTestBehavior())
+	assert.Nil(err)
+
+	pong, err := cells.RequestAs[string](env, "test", cells.PingTopic, nil, nil, time.Second)
+	assert.Nil(err)
+	assert.Equal(pong, cells.PongResponse)
+	_, err = cells.RequestAs[int](env, "test", cells.PingTopic, nil, nil, time.Second)
+	assert.True(cells.IsInvalidResponseError(err))
+	_, err = cells.RequestAs[string](env, "humpf", cells.PingTopic, nil, nil, time.Second)
+	assert.True(errors.IsError(err, cells.ErrInvalidID))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	processed, err := cells.RequestContextAs[[]string](ctx, env, "test", cells.ProcessedTopic, nil, nil)
+	assert.Nil(err)
+	assert.Empty(processed)
+}
+
+// TestEnvironmentScatterGather tests requesting multiple cells.
+func TestEnvironmentScatterGather(t *testing.T) {
+	assert := asserts.NewTestingAssertion(t, true)
+
+	env := cells.NewEnvironment()
+	defer env.Stop()
+
+	for _, id := range []string{"hub", "w1", "w2", "w3"} {
+		err := env.StartCell(id, testsupport.NewTestBehavior())
+		assert.Nil(err)
+	}
+	err := env.StartCell("silent", newWaitingBehavior())
+	assert.Nil(err)
+
+	// All cells, one silent and one not existing.
+	ids := []string{"w1", "w2", "w3", "silent", "humpf"}
+	result, err := env.ScatterGather(ids, cells.PingTopic, nil, nil, 0, 100*time.Millisecond)
+	assert.True(cells.IsIncompleteResponsesError(err))
+	assert.Length(result.Responses, 3)
+	assert.Equal(result.Responses["w2"], cells.PongResponse)
+	assert.Length(result.Errors, 1)
+	assert.True(errors.IsError(result.Errors["humpf"], cells.ErrInvalidID))
+	assert.Equal(result.Missing, []string{"silent"})
+
+	// Quorum.
+	result, err = env.ScatterGather(ids, cells.PingTopic, nil, nil, 2, time.Second)
+	assert.Nil(err)
+	assert.Length(result.Responses, 2)
+	assert.Empty(result.Missing)
+	assert.Length(result.Skipped, 2)
+	assert.Contents("silent", result.Skipped)
+
+	// Subscribers of a cell.
+	err = env.Subscribe("hub", "w1", "w2", "w3")
+	assert.Nil(err)
+	subs, err := env.Subscribers("hub")
+	assert.Nil(err)
+	result, err = env.ScatterGather(subs, cells.PingTopic, nil, nil, 0, time.Second)
+	assert.Nil(err)
+	assert.Length(result.Responses, 3)
+	assert.Empty(result.Missing)
+	assert.Empty(result.Skipped)
+}
+
+// TestEnvironmentRequestAsync tests asynchronous requests from
+// the outside and from inside of cells.
+func TestEnvironmentRequestAsync(t *testing.T) {
+	assert := asserts.NewTestingAssertion(t, true)
+
+	env := cells.NewEnvironment()
+	defer env.Stop()
+
+	err := env.StartCell("failer", newFailingBehavior(42))
+	assert.Nil(err)
+	err = env.StartCell("waiter", newWaitingBehavior())
+	assert.Nil(err)
+
+	// Outside requests.
+	f, err := env.RequestAsync("failer", cells.PingTopic, nil, nil, time.Second)
+	assert.Nil(err)
+	assert.NotEmpty(f.ID())
+	<-f.Done()
+	response, err := f.Response()
+	assert.Nil(err)
+	assert.Equal(response, int64(42))
+
+	f, err = env.RequestAsync("waiter", "wait?", nil, nil, 50*time.Millisecond)
+	assert.Nil(err)
+	_, err = f.Response()
+	assert.True(cells.IsTimeoutError(err))
+
+	_, err = env.RequestAsync("humpf", cells.PingTopic, nil, nil, time.Second)
+	assert.True(errors.IsError(err, cells.ErrInvalidID))
+
+	// Cells asking each other get the responses as events.
+	eventc := make(chan cells.Event, 2)
+	err = env.StartCell("a", newAskingBehavior("b", eventc))
+	assert.Nil(err)
+	err = env.StartCell("b", newAskingBehavior("a", eventc))
+	assert.Nil(err)
+	err = env.EmitNew("a", "ask!", nil, nil)
+	assert.Nil(err)
+	err = env.EmitNew("b", "ask!", nil, nil)
+	assert.Nil(err)
+
+	sources := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		event := waitForEvent(assert, eventc)
+		assert.Equal(event.Topic(), cells.ResponseTopic)
+		requestID, err := event.Payload().GetString(cells.RequestIDPayload, "")
+		assert.Nil(err)
+		assert.Equal(event.Metadata().CausationID, requestID)
+		topic, err := event.Payload().GetString(cells.RequestTopicPayload, "")
+		assert.Nil(err)
+		assert.Equal(topic, "ask?")
+		response, err := event.Payload().GetString(cells.ResponsePayload, "")
+		assert.Nil(err)
+		sources[event.Metadata().SourceID] = true
+		assert.Equal(response, "answer from "+map[string]string{"a": "b", "b": "a"}[event.Metadata().SourceID])
+	}
+	assert.Length(sources, 2)
+}
+
+// TestEnvironmentInterceptors tests observing, modifying, and
+// rejecting events and responses with interceptors.
+func TestEnvironmentInterceptors(t *testing.T) {
+	assert := asserts.NewTestingAssertion(t, true)
+	tracec := make(chan string, 100)
+	tracer := func(point cells.InterceptionPoint, sourceID, targetID string, event cells.Event) (cells.Event, error) {
+		tracec <- fmt.Sprintf("%v %s->%s %s", point, sourceID, targetID, event.Topic())
+		return event, nil
+	}
+	scrubber := func(point cells.InterceptionPoint, sourceID, targetID string, event cells.Event) (cells.Event, error) {
+		switch {
+		case point == cells.EmitPoint && event.Topic() == "forbidden!":
+			return nil, errors.New(1, map[int]string{1: "forbidden"})
+		case point == cells.DeliveryPoint && event.Topic() == "denied?":
+			return nil, errors.New(1, map[int]string{1: "denied"})
+		case point == cells.EmitPoint && event.Topic() == "secret!":
+			p := event.Payload().Apply(cells.PayloadValues{"password": "***"})
+			return cells.NewEvent(event.Topic(), p, event.Scene())
+		case point == cells.ResponsePoint:
+			response, err := event.Payload().GetInt(cells.ResponsePayload, 0)
+			if err == nil && response == 42 {
+				p := event.Payload().Apply(cells.PayloadValues{cells.ResponsePayload: 4711})
+				return cells.NewEvent(event.Topic(), p, event.Scene())
+			}
+		}
+		return nil, nil
+	}
+
+	env := cells.NewEnvironment(cells.Interceptors(tracer, scrubber))
+	defer env.Stop()
+
+	var counter int64
+	eventc := make(chan cells.Event, 10)
+	err := env.StartCell("counter", newCountingBehavior(&counter, nil))
+	assert.Nil(err)
+	err = env.StartCell("recorder", newRecordingBehavior(eventc))
+	assert.Nil(err)
+	err = env.StartCell("failer", newFailingBehavior(42))
+	assert.Nil(err)
+	err = env.Subscribe("counter", "recorder")
+	assert.Nil(err)
+
+	// Observing.
+	err = env.EmitNew("counter", "hello!", nil, nil)
+	assert.Nil(err)
+	event := waitForEvent(assert, eventc)
+	assert.Equal(event.Topic(), "hello!")
+	assert.Equal(<-tracec, "emit ->counter hello!")
+	assert.Equal(<-tracec, "delivery ->counter hello!")
+	assert.Equal(<-tracec, "emit counter->recorder hello!")
+	assert.Equal(<-tracec, "delivery counter->recorder hello!")
+
+	// Modifying.
+	err = env.EmitNew("recorder", "secret!", cells.PayloadValues{"password": "foo"}, nil)
+	assert.Nil(err)
+	event = waitForEvent(assert, eventc)
+	password, err := event.Payload().GetString("password", "")
+	assert.Nil(err)
+	assert.Equal(password, "***")
+
+	response, err := env.Request("failer", cells.PingTopic, nil, nil, time.Second)
+	assert.Nil(err)
+	assert.Equal(response, 4711)
+
+	// Rejecting.
+	err = env.EmitNew("counter", "forbidden!", nil, nil)
+	assert.True(cells.IsRejectedError(err))
+	_, err = env.Request("failer", "denied?", nil, nil, time.Second)
+	assert.True(cells.IsRejectedError(err))
+	assert.Equal(atomic.LoadInt64(&counter), int64(1))
+}
+
+// TestEnvironmentDeadLetterCell tests the emitting of
+// undeliverable events to the dead-letter cell.
+func TestEnvironmentDeadLetterCell(t *testing.T) {
+	assert := asserts.NewTestingAssertion(t, true)
+	rejecter := func(point cells.InterceptionPoint, sourceID, targetID string, event cells.Event) (cells.Event, error) {
+		if point == cells.EmitPoint && targetID == "rejecter" {
+			return nil, errors.New(1, map[int]string{1: "rejected"})
+		}
+		return nil, nil
+	}
+	env := cells.NewEnvironment(cells.DeadLetterCell("dead"), cells.Interceptors(rejecter))
+	defer env.Stop()
+
+	var counter int64
+	deadc := make(chan cells.Event, 10)
+	okc := make(chan cells.Event, 10)
+	err := env.StartCell("dead", newRecordingBehavior(deadc))
+	assert.Nil(err)
+	err = env.StartCell("hub", newCountingBehavior(&counter, nil))
+	assert.Nil(err)
+	err = env.StartCell("ok", newRecordingBehavior(okc))
+	assert.Nil(err)
+	err = env.StartCell("rejecter", newRecordingBehavior(okc))
+	assert.Nil(err)
+	err = env.StartCell("failer", newFailingBehavior(1))
+	assert.Nil(err)
+	err = env.Subscribe("hub", "ok", "rejecter")
+	assert.Nil(err)
+
+	letter := func() (cells.Event, string, string, error) {
+		dl := waitForEvent(assert, deadc)
+		assert.Equal(dl.Topic(), cells.DeadLetterTopic)
+		event, ok := dl.Payload().Get(cells.DeadLetterEventPayload)
+		assert.True(ok)
+		target, err := dl.Payload().GetString(cells.DeadLetterTargetPayload, "")
+		assert.Nil(err)
+		source, err := dl.Payload().GetString(cells.DeadLetterSourcePayload, "")
+		assert.Nil(err)
+		reason, ok := dl.Payload().Get(cells.DeadLetterReasonPayload)
+		assert.True(ok)
+		return event.(cells.Event), target, source, reason.(error)
+	}
+
+	// Invalid ID.
+	err = env.EmitNew("humpf", "foo!", nil, nil)
+	assert.True(errors.IsError(err, cells.ErrInvalidID))
+	event, target, source, reason := letter()
+	assert.Equal(event.Topic(), "foo!")
+	assert.Equal(target, "humpf")
+	assert.Equal(source, "")
+	assert.True(errors.IsError(reason, cells.ErrInvalidID))
+
+	// Failing subscriber doesn't stop the delivery, the emitting
+	// behavior returns the error and fails too.
+	err = env.EmitNew("hub", "bar!", nil, nil)
+	assert.Nil(err)
+	event = waitForEvent(assert, okc)
+	assert.Equal(event.Topic(), "bar!")
+	letters := map[string]string{}
+	for i := 0; i < 2; i++ {
+		event, target, source, reason = letter()
+		assert.Equal(event.Topic(), "bar!")
+		assert.NotNil(reason)
+		letters[target] = source
+	}
+	assert.Equal(letters, map[string]string{"rejecter": "hub", "hub": ""})
+
+	// The errors of the subscribers are checked by their codes.
+	cerrs := cells.CellErrors{
+		"ok":       errors.New(cells.ErrStopping, map[int]string{cells.ErrStopping: "stopping"}),
+		"rejecter": errors.New(cells.ErrRejected, map[int]string{cells.ErrRejected: "rejected"}),
+	}
+	assert.True(cells.IsStoppingError(cerrs))
+	assert.True(cells.IsRejectedError(cerrs))
+	assert.False(cells.IsInvalidIdError(cerrs))
+
+	// Failing behavior.
+	err = env.EmitNew("failer", "fail!", nil, nil)
+	assert.Nil(err)
+	event, target, _, reason = letter()
+	assert.Equal(event.Topic(), "fail!")
+	assert.Equal(target, "failer")
+	assert.ErrorMatch(reason, "failing instance 1")
+
+	// Letters contain requests without their local response channel.
+	_, err = env.Request("humpf", "foo?", "bar", nil, time.Second)
+	assert.True(cells.IsInvalidIdError(err))
+	event, _, _, _ = letter()
+	assert.Equal(event.Topic(), "foo?")
+	assert.Equal(event.Payload().Keys(), []string{cells.DefaultPayload})
+}
+
+// TestEnvironmentDiskDeadLetterCell tests dead-letter
+// cells using a disk event queue.
+func TestEnvironmentDiskDeadLetterCell(t *testing.T) {
+	assert := asserts.NewTestingAssertion(t, true)
+	for _, name := range cells.PayloadCodecNames() {
+		codec, err := cells.LookupPayloadCodec(name)
+		assert.Nil(err)
+		env := cells.NewEnvironment(
+			cells.ID("disk-dead-letters-"+name),
+			cells.DeadLetterCell("dead"),
+			cells.DiskQueueFactory(t.TempDir(), codec, cells.SyncNever, 1024),
+		)
+		deadc := make(chan cells.Event, 10)
+		err = env.StartCell("dead", newRecordingBehavior(deadc))
+		assert.Nil(err, name)
+
+		_, err = env.Request("humpf", "foo?", cells.PayloadValues{"bar": "baz"}, nil, time.Second)
+		assert.True(cells.IsInvalidIdError(err), name)
+		dl := waitForEvent(assert, deadc)
+		assert.Equal(dl.Topic(), cells.DeadLetterTopic, name)
+		value, ok := dl.Payload().Get(cells.DeadLetterEventPayload)
+		assert.True(ok, name)
+		event, ok := value.(cells.Event)
+		assert.True(ok, name)
+		assert.Equal(event.Topic(), "foo?", name)
+		assert.Equal(event.Payload().Keys(), []string{"bar"}, name)
+		bar, err := event.Payload().GetString("bar", "")
+		assert.Nil(err, name)
+		assert.Equal(bar, "baz", name)
+		assert.Equal(event.Metadata().CorrelationID, dl.Metadata().CorrelationID, name)
+		value, ok = dl.Payload().Get(cells.DeadLetterReasonPayload)
+		assert.True(ok, name)
+		reason, ok := value.(error)
+		assert.True(ok, name)
+		assert.ErrorMatch(reason, `.*cell with ID "humpf" does not exist.*`, name)
+		target, err := dl.Payload().GetString(cells.DeadLetterTargetPayload, "")
+		assert.Nil(err, name)
+		assert.Equal(target, "humpf", name)
+
+		err = env.Stop()
+		assert.Nil(err, name)
+	}
+}
+
+// TestEnvironmentMetrics tests the metrics of the cells and
+// their export.
+func TestEnvironmentMetrics(t *testing.T) {
+	assert := asserts.NewTestingAssertion(t, true)
+	rejecter := func(point cells.InterceptionPoint, sourceID, targetID string, event cells.Event) (cells.Event, error) {
+		if point == cells.EmitPoint && targetID == "rejecter" {
+			return nil, errors.New(1, map[int]string{1: "rejected"})
+		}
+		return nil, nil
+	}
+	env := cells.NewEnvironment(cells.ID("metrics"), cells.Interceptors(rejecter))
+	defer env.Stop()
+
+	err := env.StartCell("tb", testsupport.NewTestBehavior())
+	assert.Nil(err)
+	err = env.StartCell("rejecter", testsupport.NewTestBehavior())
+	assert.Nil(err)
+	err = env.Subscribe("tb", "rejecter")
+	assert.Nil(err)
+
+	for i := 0; i < 3; i++ {
+		err = env.EmitNew("tb", "foo!", nil, nil)
+		assert.Nil(err)
+	}
+	err = env.EmitNew("tb", testsupport.PanicTopic, nil, nil)
+	assert.Nil(err)
+	waitFor(assert, func() bool {
+		m := env.Metrics()
+		return len(m.Cells) == 2 && m.Cells[1].Topics["foo!"].Processed == 3 && m.Cells[1].Recoveries == 1
+	})
+	m := env.Metrics()
+	assert.Equal(m.EnvironmentID, "metrics")
+	assert.Equal(m.Cells[1].ID, "tb")
+	assert.Equal(m.Cells[1].Behavior, "*testsupport.testBehavior")
+	assert.Equal(m.Cells[1].Topics["foo!"].EmitErrors, int64(3))
+	assert.Equal(m.Cells[1].Topics["foo!"].Latency.Count, int64(3))
+
+	// Prometheus.
+	rec := httptest.NewRecorder()
+	cells.NewMetricsHandler(env).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+	labels := `environment="metrics",cell="tb",behavior="*testsupport.testBehavior"`
+	assert.True(strings.Contains(body, "# TYPE cells_event_processing_seconds histogram\n"))
+	assert.True(strings.Contains(body, `cells_events_processed_total{`+labels+`,topic="foo!"} 3`))
+	assert.True(strings.Contains(body, `cells_emit_errors_total{`+labels+`,topic="foo!"} 3`))
+	assert.True(strings.Contains(body, `cells_event_processing_seconds_bucket{`+labels+`,topic="foo!",le="+Inf"} 3`))
+	assert.True(strings.Contains(body, `cells_event_processing_seconds_count{`+labels+`,topic="foo!"} 3`))
+	assert.True(strings.Contains(body, `cells_recoveries_total{`+labels+`} 1`))
+	assert.True(strings.Contains(body, `cells_queue_length{`+labels+`} 0`))
+
+	// Expvar.
+	cells.PublishMetrics(env)
+	cells.PublishMetrics(env)
+	v := expvar.Get("cells.metrics")
+	assert.NotNil(v)
+	assert.True(strings.Contains(v.String(), `"EnvironmentID":"metrics"`))
+
+	// Limited and normalized topics.
+	normalize := func(topic string) string {
+		return strings.SplitN(topic, ":", 2)[0]
+	}
+	limitedEnv := cells.NewEnvironment(cells.MetricsTopics(2, normalize))
+	defer limitedEnv.Stop()
+	err = limitedEnv.StartCell("tb", testsupport.NewTestBehavior())
+	assert.Nil(err)
+	for _, topic := range []string{"order:1", "order:2", "stock:1", "foo", "bar", "order:3"} {
+		err = limitedEnv.EmitNew("tb", topic, nil, nil)
+		assert.Nil(err)
+	}
+	waitFor(assert, func() bool {
+		topics := limitedEnv.Metrics().Cells[0].Topics
+		return topics["order"].Processed == 3 && topics[cells.OtherMetricsTopic].Processed == 2
+	})
+	topics := limitedEnv.Metrics().Cells[0].Topics
+	assert.Length(topics, 3)
+	assert.Equal(topics["stock"].Processed, int64(1))
+}
+
+// TestEnvironmentLogger tests the structured logging
+// with a custom handler and level.
+func TestEnvironmentLogger(t *testing.T) {
+	assert := asserts.NewTestingAssertion(t, true)
+	buf := &syncBuffer{}
+	level := &slog.LevelVar{}
+	level.Set(slog.LevelError)
+	env := cells.NewEnvironment(cells.ID("logger"), cells.Logger(slog.NewJSONHandler(buf, nil)), cells.LogLevel(level))
+	defer env.Stop()
+
+	err := env.StartCell("failer", newFailingBehavior(1))
+	assert.Nil(err)
+	err = env.EmitNew("failer", "fail!", nil, nil)
+	assert.Nil(err)
+	waitFor(assert, func() bool {
+		return strings.Contains(buf.String(), "cell failed")
+	})
+	records := buf.records(assert)
+	assert.Length(records, 1)
+	assert.Equal(records[0]["level"], "ERROR")
+	assert.Equal(records[0][cells.LogEnvironmentKey], "logger")
+	assert.Equal(records[0][cells.LogCellKey], "failer")
+	assert.Equal(records[0][cells.LogBehaviorKey], "*cells_test.failingBehavior")
+	assert.Equal(records[0][cells.LogErrorKey], "failing instance 1")
+
+	// Change level at runtime.
+	level.Set(slog.LevelInfo)
+	err = env.StartCell("waiter", newWaitingBehavior())
+	assert.Nil(err)
+	records = buf.records(assert)
+	assert.Length(records, 2)
+	assert.Equal(records[1]["msg"], "cell started")
+	assert.Equal(records[1][cells.LogCellKey], "waiter")
+}
+
+// TestEnvironmentReplaceBehavior tests replacing the behavior
+// of a running cell.
+func TestEnvironmentReplaceBehavior(t *testing.T) {
+	assert := asserts.NewTestingAssertion(t, true)
+	env := cells.NewEnvironment(cells.ID("replace"))
+	defer env.Stop()
+
+	err := env.StartCell("emitter", testsupport.NewTestBehavior())
+	assert.Nil(err)
+	err = env.StartCell("versioned", newVersionedBehavior(1, nil))
+	assert.Nil(err)
+	err = env.StartCell("collector", testsupport.NewTestBehavior())
+	assert.Nil(err)
+	err = env.Subscribe("emitter", "versioned")
+	assert.Nil(err)
+	err = env.Subscribe("versioned", "collector")
+	assert.Nil(err)
+
+	// Replace while events are queued.
+	for i := 0; i < 5; i++ {
+		err = env.EmitNew("emitter", "before", i, nil)
+		assert.Nil(err)
+	}
+	err = env.ReplaceBehavior("versioned", newVersionedBehavior(2, nil))
+	assert.Nil(err)
+	for i := 0; i < 5; i++ {
+		err = env.EmitNew("emitter", "after", i, nil)
+		assert.Nil(err)
+	}
+	testsupport.LetItWork()
+
+	state, err := env.Request("versioned", "state?", nil, nil, time.Second)
+	assert.Nil(err)
+	assert.Equal(state, []int{2, 10})
+	processed, err := env.Request("collector", cells.ProcessedTopic, nil, nil, time.Second)
+	assert.Nil(err)
+	assert.Length(processed, 10)
+	subscribers, err := env.Subscribers("versioned")
+	assert.Nil(err)
+	assert.Equal(subscribers, []string{"collector"})
+	subscriptions, err := env.Subscriptions("versioned")
+	assert.Nil(err)
+	assert.Equal(subscriptions, []string{"emitter"})
+
+	// Failing migration keeps the old behavior.
+	err = env.ReplaceBehavior("versioned", newVersionedBehavior(3, errors.New(1, map[int]string{1: "ouch"})))
+	assert.True(cells.IsMigrationError(err))
+	state, err = env.Request("versioned", "state?", nil, nil, time.Second)
+	assert.Nil(err)
+	assert.Equal(state, []int{2, 10})
+
+	// Illegal replacements.
+	err = env.ReplaceBehavior("humpf", newVersionedBehavior(4, nil))
+	assert.True(cells.IsInvalidIdError(err))
+	_, err = env.Request("versioned", "replace?", nil, nil, time.Second)
+	assert.True(cells.IsSelfReplacementError(err))
+
+	// Cells replacing each other at the same time don't
+	// deadlock, one of them fails.
+	err = env.StartCell("peer", newVersionedBehavior(1, nil))
+	assert.Nil(err)
+	var wg, barrier sync.WaitGroup
+	var cycles int64
+	barrier.Add(2)
+	for id, other := range map[string]string{"versioned": "peer", "peer": "versioned"} {
+		wg.Add(1)
+		go func(id, other string) {
+			defer wg.Done()
+			payload := cells.PayloadValues{"id": other, "barrier": &barrier}
+			_, err := env.Request(id, "replace-other?", payload, nil, time.Second)
+			if err != nil {
+				assert.True(cells.IsReplacementCycleError(err), err.Error())
+				atomic.AddInt64(&cycles, 1)
+			}
+		}(id, other)
+	}
+	wg.Wait()
+	assert.Equal(atomic.LoadInt64(&cycles), int64(1))
+	for _, id := range []string{"versioned", "peer"} {
+		_, err = env.Request(id, "state?", nil, nil, time.Second)
+		assert.Nil(err)
+	}
+}
+
+// TestEnvironmentSnapshots tests taking snapshots of behaviors
+// and restoring them.
+func TestEnvironmentSnapshots(t *testing.T) {
+	assert := asserts.NewTestingAssertion(t, true)
+	dir := t.TempDir()
+	env := cells.NewEnvironment(cells.ID("snapshots"), cells.SnapshotDirectory(dir, 0))
+
+	err := env.StartCell("snapshotting", newSnapshottingBehavior())
+	assert.Nil(err)
+	err = env.StartCell("other", testsupport.NewTestBehavior())
+	assert.Nil(err)
+	for i := 0; i < 3; i++ {
+		err = env.EmitNew("snapshotting", "count", nil, nil)
+		assert.Nil(err)
+	}
+	count, err := env.Request("snapshotting", "count?", nil, nil, time.Second)
+	assert.Nil(err)
+	assert.Equal(count, 3)
+
+	// On demand.
+	err = env.Snapshot()
+	assert.Nil(err)
+	data, err := os.ReadFile(filepath.Join(dir, "snapshotting.snapshot"))
+	assert.Nil(err)
+	assert.Equal(string(data), "3")
+	err = env.Snapshot("humpf")
+	assert.True(cells.IsInvalidIdError(err))
+
+	// Own cell from inside the behavior.
+	err = env.EmitNew("snapshotting", "count", nil, nil)
+	assert.Nil(err)
+	_, err = env.Request("snapshotting", "snapshot?", nil, nil, time.Second)
+	assert.Nil(err)
+	data, err = os.ReadFile(filepath.Join(dir, "snapshotting.snapshot"))
+	assert.Nil(err)
+	assert.Equal(string(data), "4")
+
+	// Restore in new environment after a last snapshot when stopping.
+	err = env.EmitNew("snapshotting", "count", nil, nil)
+	assert.Nil(err)
+	count, err = env.Request("snapshotting", "count?", nil, nil, time.Second)
+	assert.Nil(err)
+	assert.Equal(count, 5)
+	err = env.StopGracefully(time.Second)
+	assert.Nil(err)
+	env = cells.NewEnvironment(cells.ID("snapshots"), cells.SnapshotDirectory(dir, 0))
+	defer env.Stop()
+	err = env.StartCell("snapshotting", newSnapshottingBehavior())
+	assert.Nil(err)
+	count, err = env.Request("snapshotting", "count?", nil, nil, time.Second)
+	assert.Nil(err)
+	assert.Equal(count, 5)
+
+	// Invalid snapshot terminates the behavior and releases
+	// the disk queue for a new start.
+	qdir := t.TempDir()
+	qenv := cells.NewEnvironment(
+		cells.ID("broken-snapshots"),
+		cells.SnapshotDirectory(dir, 0),
+		cells.DiskQueueFactory(qdir, cells.NewJSONPayloadCodec(), cells.SyncAlways, 1024),
+	)
+	defer qenv.Stop()
+	err = os.WriteFile(filepath.Join(dir, "broken.snapshot"), []byte("humpf"), 0644)
+	assert.Nil(err)
+	var terminations int64
+	err = qenv.StartCell("broken", &snapshottingBehavior{terminations: &terminations})
+	assert.True(cells.IsRestoreError(err))
+	assert.Equal(atomic.LoadInt64(&terminations), int64(1))
+	assert.False(qenv.HasCell("broken"))
+	err = os.WriteFile(filepath.Join(dir, "broken.snapshot"), []byte("2"), 0644)
+	assert.Nil(err)
+	err = qenv.StartCell("broken", newSnapshottingBehavior())
+	assert.Nil(err)
+	err = qenv.EmitNew("broken", "count", nil, nil)
+	assert.Nil(err)
+	count, err = qenv.Request("broken", "count?", nil, nil, time.Second)
+	assert.Nil(err)
+	assert.Equal(count, 3)
+
+	// Periodic snapshots into own store.
+	store := &memorySnapshotStore{snapshots: make(map[string][]byte)}
+	penv := cells.NewEnvironment(cells.ID("periodic-snapshots"), cells.Snapshots(store, 20*time.Millisecond))
+	defer penv.Stop()
+	err = penv.StartCell("snapshotting", newSnapshottingBehavior())
+	assert.Nil(err)
+	err = penv.EmitNew("snapshotting", "count", nil, nil)
+	assert.Nil(err)
+	waitFor(assert, func() bool {
+		snapshot, _ := store.Load("snapshotting")
+		return string(snapshot) == "1"
+	})
+
+	// Cells snapshotting each other don't deadlock.
+	mstore := &memorySnapshotStore{snapshots: make(map[string][]byte)}
+	menv := cells.NewEnvironment(cells.ID("mutual-snapshots"), cells.Snapshots(mstore, 0))
+	defer menv.Stop()
+	var wg sync.WaitGroup
+	for _, id := range []string{"a", "b"} {
+		err = menv.StartCell(id, newSnapshottingBehavior())
+		assert.Nil(err)
+		err = menv.EmitNew(id, "count", nil, nil)
+		assert.Nil(err)
+	}
+	for _, id := range []string{"a", "b"} {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			_, err := menv.Request(id, "snapshot-all?", nil, nil, time.Second)
+			assert.Nil(err)
+		}(id)
+	}
+	wg.Wait()
+	waitFor(assert, func() bool {
+		a, _ := mstore.Load("a")
+		b, _ := mstore.Load("b")
+		return string(a) == "1" && string(b) == "1"
+	})
+
+	// No store.
+	nenv := cells.NewEnvironment(cells.ID("no-snapshots"))
+	defer nenv.Stop()
+	err = nenv.Snapshot()
+	assert.True(cells.IsNoSnapshotStoreError(err))
+}
+
+// TestEnvironmentRecordReplay tests recording events and
+// replaying them into another environment.
+func TestEnvironmentRecordReplay(t *testing.T) {
+	assert := asserts.NewTestingAssertion(t, true)
+	start := func(id string, buf *syncBuffer, subscribe bool) cells.Environment {
+		env := cells.NewEnvironment(cells.ID(id), cells.Recording(cells.NewRecorder(buf, true)))
+		err := env.StartCell("forwarder", testsupport.NewTestBehavior())
+		assert.Nil(err)
+		err = env.StartCell("collector", testsupport.NewTestBehavior())
+		assert.Nil(err)
+		if subscribe {
+			err = env.Subscribe("forwarder", "collector")
+			assert.Nil(err)
+		}
+		return env
+	}
+
+	// Record.
+	recorded := &syncBuffer{}
+	env := start("recording", recorded, true)
+	for i := 0; i < 3; i++ {
+		err := env.EmitNew("forwarder", "forward", i, nil)
+		assert.Nil(err)
+		time.Sleep(20 * time.Millisecond)
+	}
+	pong, err := env.Request("collector", cells.PingTopic, nil, nil, time.Second)
+	assert.Nil(err)
+	assert.Equal(pong, cells.PongResponse)
+	testsupport.LetItWork()
+	env.Stop()
+
+	expected, err := cells.ReadRecording(strings.NewReader(recorded.String()))
+	assert.Nil(err)
+	assert.Length(expected, 7)
+	external := []cells.RecordedEvent{}
+	for _, re := range expected {
+		if re.SourceID == "" {
+			external = append(external, re)
+		} else {
+			assert.Equal(re.SourceID, "forwarder")
+			assert.Equal(re.TargetID, "collector")
+		}
+	}
+	assert.Length(external, 4)
+	assert.Equal(external[0].Offset, time.Duration(0))
+	assert.True(external[2].Offset >= 40*time.Millisecond)
+	assert.False(external[2].Request)
+	assert.True(external[3].Request)
+	assert.Equal(external[3].Event.Topic(), cells.PingTopic)
+
+	// Replay stepwise and with original speed.
+	replayed := &syncBuffer{}
+	env = start("replaying", replayed, true)
+	replayer := cells.NewReplayer(env, expected)
+	assert.Equal(replayer.Len(), 4)
+	re, err := replayer.Step()
+	assert.Nil(err)
+	assert.Equal(re.Event.Metadata().ID, external[0].Event.Metadata().ID)
+	begin := time.Now()
+	err = replayer.Run(context.Background(), 1)
+	assert.Nil(err)
+	assert.True(time.Since(begin) >= external[2].Offset-external[0].Offset)
+	_, err = replayer.Step()
+	assert.Equal(err, io.EOF)
+	testsupport.LetItWork()
+	env.Stop()
+
+	actual, err := cells.ReadRecording(strings.NewReader(replayed.String()))
+	assert.Nil(err)
+	assert.Empty(cells.DiffRecordings(expected, actual))
+
+	// Replay fast into a different topology.
+	replayed = &syncBuffer{}
+	env = start("differing", replayed, false)
+	err = cells.NewReplayer(env, expected).Run(context.Background(), 0)
+	assert.Nil(err)
+	testsupport.LetItWork()
+	env.Stop()
+
+	actual, err = cells.ReadRecording(strings.NewReader(replayed.String()))
+	assert.Nil(err)
+	diffs := cells.DiffRecordings(expected, actual)
+	assert.Length(diffs, 3)
+	assert.Nil(diffs[0].Actual)
+	assert.Equal(diffs[0].String(), `"forwarder" -> "collector" #0: expected forward map[default:0], got nothing`)
+
+	// Events which cannot be recorded are skipped.
+	skipping := &syncBuffer{}
+	recorder := cells.NewRecorder(skipping, false)
+	env = cells.NewEnvironment(cells.ID("skipping"), cells.Recording(recorder))
+	err = env.StartCell("collector", testsupport.NewTestBehavior())
+	assert.Nil(err)
+	err = env.EmitNew("collector", "unencodable", cells.PayloadValues{"done": make(chan struct{})}, nil)
+	assert.Nil(err)
+	err = env.EmitNew("collector", "encodable", 1, nil)
+	assert.Nil(err)
+	env.Stop()
+	assert.Equal(recorder.Skipped(), 1)
+	assert.True(cells.IsEncodingError(recorder.Err()))
+	recording, err := cells.ReadRecording(strings.NewReader(skipping.String()))
+	assert.Nil(err)
+	assert.Length(recording, 1)
+	assert.Equal(recording[0].Event.Topic(), "encodable")
+
+	// Invalid recording.
+	_, err = cells.ReadRecording(strings.NewReader("humpf"))
+	assert.True(cells.IsInvalidRecordingError(err))
+}
+
+// TestTypedBehavior tests the behavior with typed state and handlers.
+func TestTypedBehavior(t *testing.T) {
+	assert := asserts.NewTestingAssertion(t, true)
+
+	env := cells.NewEnvironment()
+	defer env.Stop()
+
+	type sums struct {
+		total    int
+		unknowns int
+	}
+	behavior := cells.NewTypedBehavior(sums{}).
+		Handle("add", func(ctx cells.Context, state *sums, event cells.Event) error {
+			value, err := event.Payload().GetInt(cells.DefaultPayload, 0)
+			if err != nil {
+				return err
+			}
+			state.total += value
+			return nil
+		}).
+		HandleRequest("total?", func(ctx cells.Context, state *sums, event cells.Event) (interface{}, error) {
+			return state.total, nil
+		}).
+		HandleRequest("fail?", func(ctx cells.Context, state *sums, event cells.Event) (interface{}, error) {
+			return nil, fmt.Errorf("failing on purpose")
+		}).
+		HandleDefault(func(ctx cells.Context, state *sums, event cells.Event) error {
+			state.unknowns++
+			return ctx.Emit(event)
+		})
+	var counter int64
+	err := env.StartCell("typed", behavior)
+	assert.Nil(err)
+	err = env.StartCell("counter", newCountingBehavior(&counter, nil))
+	assert.Nil(err)
+	err = env.Subscribe("typed", "counter")
+	assert.Nil(err)
+
+	for i := 1; i <= 4; i++ {
+		err = env.EmitNew("typed", "add", i, nil)
+		assert.Nil(err)
+	}
+	err = env.EmitNew("typed", "unknown", nil, nil)
+	assert.Nil(err)
+	total, err := cells.RequestAs[int](env, "typed", "total?", nil, nil, time.Second)
+	assert.Nil(err)
+	assert.Equal(total, 10)
+	_, err = env.Request("typed", "fail?", nil, nil, time.Second)
+	assert.ErrorMatch(err, "failing on purpose")
+	testsupport.LetItWork()
+	assert.Equal(atomic.LoadInt64(&counter), int64(1))
+}
+
+// TestEnvironmentLink tests emitting, requesting, and subscribing
+// across linked environments.
+func TestEnvironmentLink(t *testing.T) {
+	assert := asserts.NewTestingAssertion(t, true)
+
+	dir, err := os.MkdirTemp("", "cells-link")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+	networks := map[string]string{
+		"tcp":  "127.0.0.1:0",
+		"unix": filepath.Join(dir, "link.sock"),
+	}
+	for network, address := range networks {
+		envA := cells.NewEnvironment(cells.ID("link-a-"+network), cells.Heartbeat(50*time.Millisecond))
+		envB := cells.NewEnvironment(cells.ID("link-b-"+network), cells.Heartbeat(50*time.Millisecond))
+
+		err = envA.StartCell("test", testsupport.NewTestBehavior())
+		assert.Nil(err)
+		listener, err := envA.Listen(network, address)
+		assert.Nil(err)
+		link, err := envB.Connect(network, listener.Addr().String())
+		assert.Nil(err)
+		assert.Equal(link.RemoteID(), "link-a-"+network)
+		assert.True(link.Connected())
+
+		// Emit and request.
+		err = link.EmitNew("test", "foo", "bar")
+		assert.Nil(err)
+		err = link.EmitNew("humpf", "foo", "bar")
+		assert.True(cells.IsRemoteError(err))
+		response, err := link.Request("test", cells.PingTopic, nil, time.Second)
+		assert.Nil(err)
+		assert.Equal(response, cells.PongResponse)
+		processed, err := link.Request("test", cells.ProcessedTopic, nil, time.Second)
+		assert.Nil(err)
+		assert.Length(processed, 1)
+
+		// Proxy.
+		err = link.StartProxy("proxy", "test")
+		assert.Nil(err)
+		response, err = envB.Request("proxy", cells.PingTopic, nil, nil, time.Second)
+		assert.Nil(err)
+		assert.Equal(response, cells.PongResponse)
+
+		// Subscription.
+		eventc := make(chan cells.Event, 10)
+		err = envB.StartCell("recorder", newRecordingBehavior(eventc))
+		assert.Nil(err)
+		err = link.Subscribe("test", "humpf")
+		assert.True(errors.IsError(err, cells.ErrInvalidID))
+		err = link.Subscribe("humpf", "recorder")
+		assert.True(cells.IsRemoteError(err))
+		err = link.Subscribe("test", "recorder")
+		assert.Nil(err)
+		err = envA.EmitNew("test", "baz", "yadda", nil)
+		assert.Nil(err)
+		event := waitForEvent(assert, eventc)
+		assert.Equal(event.Topic(), "baz")
+		yadda, ok := event.Payload().Get(cells.DefaultPayload)
+		assert.True(ok)
+		assert.Equal(yadda, "yadda")
+
+		// Reconnection restores the subscription.
+		err = listener.Close()
+		assert.Nil(err)
+		waitFor(assert, func() bool { return !link.Connected() })
+		err = link.EmitNew("test", "foo", "bar")
+		assert.True(cells.IsLinkNotConnectedError(err))
+		listener, err = envA.Listen(network, listener.Addr().String())
+		assert.Nil(err)
+		waitFor(assert, link.Connected)
+		waitFor(assert, func() bool {
+			subs, err := envA.Subscribers("test")
+			return err == nil && len(subs) == 1
+		})
+		err = envA.EmitNew("test", "baz", "yadda", nil)
+		assert.Nil(err)
+		event = waitForEvent(assert, eventc)
+		assert.Equal(event.Topic(), "baz")
+
+		err = link.Unsubscribe("test", "recorder")
+		assert.Nil(err)
+		subs, err := envA.Subscribers("test")
+		assert.Nil(err)
+		assert.Empty(subs)
+
+		err = envB.Stop()
+		assert.Nil(err)
+		err = envA.Stop()
+		assert.Nil(err)
+	}
+}
+
+// TestEnvironmentLinkAuthorization tests the rejection of links
+// and of operations by link authorizers.
+func TestEnvironmentLinkAuthorization(t *testing.T) {
+	assert := asserts.NewTestingAssertion(t, true)
+
+	envA := cells.NewEnvironment(cells.ID("auth-a"), cells.Heartbeat(50*time.Millisecond))
+	defer envA.Stop()
+	envB := cells.NewEnvironment(cells.ID("auth-b"), cells.Heartbeat(50*time.Millisecond))
+	defer envB.Stop()
+	envC := cells.NewEnvironment(cells.ID("auth-c"), cells.Heartbeat(50*time.Millisecond))
+	defer envC.Stop()
+
+	err := envA.StartCell("public", testsupport.NewTestBehavior())
+	assert.Nil(err)
+	err = envA.StartCell("private", testsupport.NewTestBehavior())
+	assert.Nil(err)
+	listener, err := envA.Listen("tcp", "127.0.0.1:0",
+		cells.AllowEnvironments("auth-b"),
+		cells.AllowCells("public"))
+	assert.Nil(err)
+	defer listener.Close()
+
+	// Unknown environments cannot connect.
+	_, err = envC.Connect("tcp", listener.Addr().String())
+	assert.True(cells.IsRemoteError(err))
+	assert.Contents("forbidden", err.Error())
+
+	// Only allowed cells can be used.
+	link, err := envB.Connect("tcp", listener.Addr().String())
+	assert.Nil(err)
+	err = link.EmitNew("public", "foo", "bar")
+	assert.Nil(err)
+	err = link.EmitNew("private", "foo", "bar")
+	assert.True(cells.IsRemoteError(err))
+	assert.Contents("forbidden", err.Error())
+	response, err := link.Request("public", cells.PingTopic, nil, time.Second)
+	assert.Nil(err)
+	assert.Equal(response, cells.PongResponse)
+	_, err = link.Request("private", cells.PingTopic, nil, time.Second)
+	assert.True(cells.IsRemoteError(err))
+	err = envB.StartCell("recorder", newRecordingBehavior(make(chan cells.Event, 10)))
+	assert.Nil(err)
+	err = link.Subscribe("private", "recorder")
+	assert.True(cells.IsRemoteError(err))
+	subs, err := envA.Subscribers("private")
+	assert.Nil(err)
+	assert.Empty(subs)
+	err = link.Subscribe("public", "recorder")
+	assert.Nil(err)
+	waitFor(assert, func() bool {
+		subs, err := envA.Subscribers("public")
+		return err == nil && len(subs) == 1
+	})
+	processed, err := link.Request("public", cells.ProcessedTopic, nil, time.Second)
+	assert.Nil(err)
+	assert.Length(processed, 1)
+}
+
+//--------------------
+// HELPERS
+//--------------------
+
+// waitFor waits until the condition is true or fails
+// after a timeout.
+func waitFor(assert *asserts.Assertion, condition func() bool) {
+	timeout := time.After(5 * time.Second)
+	for !condition() {
+		select {
+		case <-timeout:
+			assert.Fail("condition not met in time")
+			return
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+// waitForEvent waits for an event sent to the channel
+// or fails after a timeout.
+func waitForEvent(assert *asserts.Assertion, eventc chan cells.Event) cells.Event {
+	select {
+	case event := <-eventc:
+		return event
+	case <-time.After(5 * time.Second):
+		assert.Fail("no event received in time")
+		return nil
+	}
+}
+
+// waitingBehavior waits for the requester giving up or
+// for a passed channel to be closed.
+type waitingBehavior struct {
+	canceled int
+}
+
+func newWaitingBehavior() cells.Behavior {
+	return &waitingBehavior{}
+}
+
+func (b *waitingBehavior) Init(ctx cells.Context) error {
+	return nil
+}
+
+func (b *waitingBehavior) Terminate() error {
+	return nil
+}
+
+func (b *waitingBehavior) ProcessEvent(event cells.Event) error {
+	switch event.Topic() {
+	case "wait?":
+		<-event.Context().Done()
+		b.canceled++
+		return event.Respond(b.canceled)
+	case "canceled?":
+		return event.Respond(b.canceled)
+	case "block!":
+		blockc, _ := event.Payload().Get(cells.DefaultPayload)
+		<-blockc.(chan struct{})
+	}
+	return nil
+}
+
+func (b *waitingBehavior) Recover(r interface{}) error {
+	return nil
+}
+
+// countingBehavior counts and re-emits all events. Terminating
+// returns the passed error.
+type countingBehavior struct {
+	ctx          cells.Context
+	counter      *int64
+	terminateErr error
+}
+
+func newCountingBehavior(counter *int64, terminateErr error) cells.Behavior {
+	return &countingBehavior{nil, counter, terminateErr}
+}
+
+func (b *countingBehavior) Init(ctx cells.Context) error {
+	b.ctx = ctx
+	return nil
+}
+
+func (b *countingBehavior) Terminate() error {
+	return b.terminateErr
+}
+
+func (b *countingBehavior) ProcessEvent(event cells.Event) error {
+	if event.Topic() == cells.PingTopic {
+		return event.Respond(cells.PongResponse)
+	}
+	atomic.AddInt64(b.counter, 1)
+	return b.ctx.Emit(event)
+}
+
+func (b *countingBehavior) Recover(r interface{}) error {
+	return nil
+}
+
+// failingBehavior fails with topic "fail!" and responds
+// to pings with its instance number.
+type failingBehavior struct {
+	instance int64
+}
+
+func newFailingBehavior(instance int64) cells.Behavior {
+	return &failingBehavior{instance}
+}
+
+func (b *failingBehavior) Init(ctx cells.Context) error {
+	return nil
+}
+
+func (b *failingBehavior) Terminate() error {
+	return nil
+}
+
+func (b *failingBehavior) ProcessEvent(event cells.Event) error {
+	switch event.Topic() {
+	case "fail!":
+		return fmt.Errorf("failing instance %d", b.instance)
+	case cells.PingTopic:
+		return event.Respond(b.instance)
+	}
+	return nil
+}
+
+func (b *failingBehavior) Recover(r interface{}) error {
+	return nil
+}
+
+// recordingBehavior sends the processed events to a channel.
+type recordingBehavior struct {
+	eventc chan cells.Event
+}
+
+func newRecordingBehavior(eventc chan cells.Event) cells.Behavior {
+	return &recordingBehavior{eventc}
+}
+
+func (b *recordingBehavior) Init(ctx cells.Context) error {
+	return nil
+}
+
+func (b *recordingBehavior) Terminate() error {
+	return nil
+}
+
+func (b *recordingBehavior) ProcessEvent(event cells.Event) error {
+	b.eventc <- event
+	return nil
+}
+
+func (b *recordingBehavior) Recover(r interface{}) error {
+	return nil
+}
+
+// askingBehavior asynchronously asks another cell with topic
+// "ask!" and answers "ask?" itself. The responses are sent to
+// a channel.
+type askingBehavior struct {
+	ctx    cells.Context
+	target string
+	eventc chan cells.Event
+}
+
+func newAskingBehavior(target string, eventc chan cells.Event) cells.Behavior {
+	return &askingBehavior{nil, target, eventc}
+}
+
+func (b *askingBehavior) Init(ctx cells.Context) error {
+	b.ctx = ctx
+	return nil
+}
+
+func (b *askingBehavior) Terminate() error {
+	return nil
+}
+
+func (b *askingBehavior) ProcessEvent(event cells.Event) error {
+	switch event.Topic() {
+	case "ask!":
+		_, err := b.ctx.Environment().RequestAsync(b.target, "ask?", nil, nil, time.Second)
+		return err
+	case "ask?":
+		return event.Respond("answer from " + b.ctx.ID())
+	case cells.ResponseTopic:
+		b.eventc <- event
+	}
+	return nil
+}
+
+func (b *askingBehavior) Recover(r interface{}) error {
+	return nil
+}
+
+// versionedBehavior counts and re-emits events. When replacing
+// another one it takes over its counter.
+type versionedBehavior struct {
+	ctx        cells.Context
+	version    int
+	count      int
+	migrateErr error
+}
+
+func newVersionedBehavior(version int, migrateErr error) cells.Behavior {
+	return &versionedBehavior{version: version, migrateErr: migrateErr}
+}
+
+func (b *versionedBehavior) Init(ctx cells.Context) error {
+	b.ctx = ctx
+	return nil
+}
+
+func (b *versionedBehavior) Migrate(old cells.Behavior) error {
+	if b.migrateErr != nil {
+		return b.migrateErr
+	}
+	if ob, ok := old.(*versionedBehavior); ok {
+		b.count = ob.count
+	}
+	return nil
+}
+
+func (b *versionedBehavior) Terminate() error {
+	return nil
+}
+
+func (b *versionedBehavior) ProcessEvent(event cells.Event) error {
+	switch event.Topic() {
+	case "state?":
+		return event.Respond([]int{b.version, b.count})
+	case "replace?":
+		err := b.ctx.Environment().ReplaceBehavior(b.ctx.ID(), newVersionedBehavior(0, nil))
+		return event.Respond(err)
+	case "replace-other?":
+		id, _ := event.Payload().GetString("id", "")
+		if barrier, ok := event.Payload().Get("barrier"); ok {
+			barrier.(*sync.WaitGroup).Done()
+			barrier.(*sync.WaitGroup).Wait()
+		}
+		err := b.ctx.Environment().ReplaceBehavior(id, newVersionedBehavior(b.version+1, nil))
+		return event.Respond(err)
+	default:
+		b.count++
+		return b.ctx.Emit(event)
+	}
+}
+
+func (b *versionedBehavior) Recover(r interface{}) error {
+	return nil
+}
+
+// snapshottingBehavior counts events and keeps
+// the counter in snapshots.
+type snapshottingBehavior struct {
+	ctx          cells.Context
+	count        int
+	terminations *int64
+}
+
+func newSnapshottingBehavior() cells.Behavior {
+	return &snapshottingBehavior{}
+}
+
+func (b *snapshottingBehavior) Init(ctx cells.Context) error {
+	b.ctx = ctx
+	return nil
+}
+
+func (b *snapshottingBehavior) Terminate() error {
+	if b.terminations != nil {
+		atomic.AddInt64(b.terminations, 1)
+	}
+	return nil
+}
+
+func (b *snapshottingBehavior) ProcessEvent(event cells.Event) error {
+	switch event.Topic() {
+	case "count?":
+		return event.Respond(b.count)
+	case "snapshot?":
+		return event.Respond(b.ctx.Environment().Snapshot(b.ctx.ID()))
+	case "snapshot-all?":
+		return event.Respond(b.ctx.Environment().Snapshot())
+	default:
+		b.count++
+	}
+	return nil
+}
+
+func (b *snapshottingBehavior) Recover(r interface{}) error {
+	return nil
+}
+
+func (b *snapshottingBehavior) Snapshot() ([]byte, error) {
+	return []byte(strconv.Itoa(b.count)), nil
+}
+
+func (b *snapshottingBehavior) Restore(snapshot []byte) error {
+	count, err := strconv.Atoi(string(snapshot))
+	if err != nil {
+		return err
+	}
+	b.count = count
+	return nil
+}
+
+// memorySnapshotStore keeps the snapshots in memory.
+type memorySnapshotStore struct {
+	mux       sync.Mutex
+	snapshots map[string][]byte
+}
+
+func (s *memorySnapshotStore) Save(id string, snapshot []byte) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.snapshots[id] = snapshot
+	return nil
+}
+
+func (s *memorySnapshotStore) Load(id string) ([]byte, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.snapshots[id], nil
+}
+
+// syncBuffer is a buffer for log records which
+// can be written concurrently.
+type syncBuffer struct {
+	mux sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	return b.buf.String()
+}
+
+// records returns the written JSON log records.
+func (b *syncBuffer) records(assert *asserts.Assertion) []map[string]interface{} {
+	records := []map[string]interface{}{}
+	for _, line := range strings.Split(strings.TrimSpace(b.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		record := map[string]interface{}{}
+		err := json.Unmarshal([]byte(line), &record)
+		assert.Nil(err)
+		records = append(records, record)
+	}
+	return records
+}
+
 // EOF
@@ -12,35 +12,48 @@ package cells
 //--------------------
 
 import (
+	"context"
 	"fmt"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/tideland/goas/v3/errors"
 )
 
+//--------------------
+// CONSTANTS
+//--------------------
+
+// drainInterval is the interval for checking if a cell is drained.
+const drainInterval = 10 * time.Millisecond
+
 //--------------------
 // CELL CLUSTER
 //--------------------
 
 // cluster is a map from id to cells for subscriptions
 // and subscribers. It is also responsible for creating and
-// stopping cells or to emit events to them.
+// stopping cells or to emit events to them. Filters of
+// subscribers are checked before emitting.
 type cluster struct {
-	mux   sync.RWMutex
-	cells map[string]*cell
+	mux     sync.RWMutex
+	cells   map[string]*cell
+	filters map[string]SubscriptionFilter
 }
 
 // newCluster creates a new cell cluster.
 func newCluster() *cluster {
 	return &cluster{
-		cells: make(map[string]*cell),
+		cells:   make(map[string]*cell),
+		filters: make(map[string]SubscriptionFilter),
 	}
 }
 
 // startCell starts a new cell in the cluster. It will
 // only be called by the environment.
-func (c *cluster) startCell(env *environment, id string, behavior Behavior) error {
+func (c *cluster) startCell(env *environment, id string, behavior Behavior, options ...CellOption) error {
 	c.mux.Lock()
 	defer c.mux.Unlock()
 	// Check if the id already exists.
@@ -48,7 +61,7 @@ func (c *cluster) startCell(env *environment, id string, behavior Behavior) erro
 		return errors.New(ErrDuplicateId, errorMessages, id)
 	}
 	// Create cell.
-	cell, err := newCell(env, id, behavior)
+	cell, err := newCell(env, id, behavior, options...)
 	if err != nil {
 		return err
 	}
@@ -56,16 +69,20 @@ func (c *cluster) startCell(env *environment, id string, behavior Behavior) erro
 	return nil
 }
 
-// stopCell stops a cell in the cluster. It will only be
-// called by the environment.
+// stopCell stops a cell in the cluster and detaches it from
+// its emitters and subscribers. It will only be called by the
+// environment.
 func (c *cluster) stopCell(id string) error {
 	c.mux.Lock()
-	defer c.mux.Unlock()
-	if cell, ok := c.cells[id]; ok {
-		delete(c.cells, id)
-		return cell.stop()
+	cell, ok := c.cells[id]
+	if !ok {
+		c.mux.Unlock()
+		return errors.New(ErrInvalidID, errorMessages, id)
 	}
-	return errors.New(ErrInvalidID, errorMessages, id)
+	delete(c.cells, id)
+	c.mux.Unlock()
+	cell.detach()
+	return cell.stop()
 }
 
 // cell returns the cell with the given id.
@@ -86,9 +103,19 @@ func (c *cluster) subscribe(scm *cluster) {
 	defer scm.mux.RUnlock()
 	for id, cell := range scm.cells {
 		c.cells[id] = cell
+		delete(c.filters, id)
 	}
 }
 
+// subscribeFiltered adds one cell to the cluster, events
+// are only emitted to it if they pass the filter.
+func (c *cluster) subscribeFiltered(cell *cell, filter SubscriptionFilter) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.cells[cell.id] = cell
+	c.filters[cell.id] = filter
+}
+
 // unsubscribe removes cells from the cluster.
 func (c *cluster) unsubscribe(ccm *cluster) {
 	c.mux.Lock()
@@ -97,9 +124,36 @@ func (c *cluster) unsubscribe(ccm *cluster) {
 	defer ccm.mux.RUnlock()
 	for id := range ccm.cells {
 		delete(c.cells, id)
+		delete(c.filters, id)
 	}
 }
 
+// add adds one cell to the cluster.
+func (c *cluster) add(cell *cell) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.cells[cell.id] = cell
+}
+
+// remove removes the cell with the given id from the cluster.
+func (c *cluster) remove(id string) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	delete(c.cells, id)
+	delete(c.filters, id)
+}
+
+// all returns the cells inside the cluster.
+func (c *cluster) all() []*cell {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+	cells := []*cell{}
+	for _, cell := range c.cells {
+		cells = append(cells, cell)
+	}
+	return cells
+}
+
 // ids returns the cell ids inside the cluster.
 func (c *cluster) ids() []string {
 	c.mux.RLock()
@@ -111,6 +165,17 @@ func (c *cluster) ids() []string {
 	return cmids
 }
 
+// infos returns the information about the cells inside the cluster.
+func (c *cluster) infos() []CellInfo {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+	infos := []CellInfo{}
+	for _, cell := range c.cells {
+		infos = append(infos, newCellInfo(cell))
+	}
+	return infos
+}
+
 // subscribers returns the subscriber ids of a cell.
 func (c *cluster) subscribers(id string) ([]string, error) {
 	c.mux.RLock()
@@ -121,6 +186,17 @@ func (c *cluster) subscribers(id string) ([]string, error) {
 	return nil, errors.New(ErrInvalidID, errorMessages, id)
 }
 
+// subscriptions returns the ids of the cells the cell
+// with the given id is subscribed to.
+func (c *cluster) subscriptions(id string) ([]string, error) {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+	if cell, ok := c.cells[id]; ok {
+		return cell.emitters.ids(), nil
+	}
+	return nil, errors.New(ErrInvalidID, errorMessages, id)
+}
+
 // subset returns a cell cluster containing the cells with the given ids.
 func (c *cluster) subset(ids ...string) (*cluster, error) {
 	c.mux.RLock()
@@ -147,25 +223,155 @@ func (c *cluster) emitDirect(id string, event Event) error {
 	return cell.processEvent(event)
 }
 
-// emit emits an event to all cells of the cluster.
+// emitDirectContext emits an event to one cell of the cluster
+// waiting at most until the context is done.
+func (c *cluster) emitDirectContext(ctx context.Context, id string, event Event) error {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+	cell, ok := c.cells[id]
+	if !ok {
+		return errors.New(ErrInvalidID, errorMessages, id)
+	}
+	return cell.processEventContext(ctx, event)
+}
+
+// emit emits an event to all cells of the cluster passing
+// their filters. Failing cells don't stop the delivery to the
+// others, their errors are returned as CellErrors.
 func (c *cluster) emit(event Event) error {
 	c.mux.RLock()
 	defer c.mux.RUnlock()
-	for _, cell := range c.cells {
+	cerrs := CellErrors{}
+	for id, cell := range c.cells {
+		if filter, ok := c.filters[id]; ok && !filter(event) {
+			continue
+		}
 		if err := cell.processEvent(event); err != nil {
-			return err
+			cerrs[id] = err
 		}
 	}
+	if len(cerrs) > 0 {
+		return cerrs
+	}
 	return nil
 }
 
-// stop stops all cell of the cluster.
-func (c *cluster) stop() {
+// topologicalIDs returns the cell ids sorted so that emitting
+// cells are in front of their subscribers. Cells in cycles are
+// appended sorted by their ids.
+func (c *cluster) topologicalIDs() []string {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+	inDegrees := make(map[string]int)
+	subscribers := make(map[string][]string)
+	for id, cell := range c.cells {
+		if _, ok := inDegrees[id]; !ok {
+			inDegrees[id] = 0
+		}
+		sids := cell.subscribers.ids()
+		sort.Strings(sids)
+		for _, sid := range sids {
+			if _, ok := c.cells[sid]; ok && sid != id {
+				subscribers[id] = append(subscribers[id], sid)
+				inDegrees[sid]++
+			}
+		}
+	}
+	ready := []string{}
+	for id, inDegree := range inDegrees {
+		if inDegree == 0 {
+			ready = append(ready, id)
+		}
+	}
+	sort.Strings(ready)
+	ids := []string{}
+	for len(ready) > 0 {
+		id := ready[0]
+		ready = ready[1:]
+		ids = append(ids, id)
+		delete(inDegrees, id)
+		for _, sid := range subscribers[id] {
+			inDegrees[sid]--
+			if inDegrees[sid] == 0 {
+				ready = append(ready, sid)
+			}
+		}
+	}
+	cycled := []string{}
+	for id := range inDegrees {
+		cycled = append(cycled, id)
+	}
+	sort.Strings(cycled)
+	return append(ids, cycled...)
+}
+
+// drain waits until the cells with the given ids have no pending
+// events anymore. As processing cells may emit new events the ids
+// are checked until one pass finds all cells drained. It returns
+// false if the context is done before.
+func (c *cluster) drain(ctx context.Context, ids []string) bool {
+	for {
+		drained := true
+		for _, id := range ids {
+			cell, err := c.cell(id)
+			if err != nil {
+				continue
+			}
+			for cell.pending() > 0 {
+				drained = false
+				select {
+				case <-ctx.Done():
+					return false
+				case <-time.After(drainInterval):
+				}
+			}
+		}
+		if drained {
+			return true
+		}
+	}
+}
+
+// stop stops the cells with the given ids in this order and removes
+// them from the cluster. Those not passed are stopped afterwards.
+// Errors when terminating and events still pending are returned per
+// cell.
+func (c *cluster) stop(ids []string) CellErrors {
 	c.mux.Lock()
-	defer c.mux.Unlock()
-	for _, cell := range c.cells {
-		cell.stop()
+	stopIDs := []string{}
+	stopCells := []*cell{}
+	for _, id := range ids {
+		if cell, ok := c.cells[id]; ok {
+			stopIDs = append(stopIDs, id)
+			stopCells = append(stopCells, cell)
+			delete(c.cells, id)
+		}
+	}
+	for id, cell := range c.cells {
+		stopIDs = append(stopIDs, id)
+		stopCells = append(stopCells, cell)
+		delete(c.cells, id)
+	}
+	c.mux.Unlock()
+	// Stop outside the lock, behaviors may still emit
+	// while finishing their current event.
+	cerrs := CellErrors{}
+	for i, cell := range stopCells {
+		pending := cell.pending()
+		err := cell.stop()
+		switch {
+		case err != nil && pending > 0:
+			cerrs[stopIDs[i]] = errors.Annotate(err, ErrPendingEvents, errorMessages, pending)
+		case err != nil:
+			cerrs[stopIDs[i]] = err
+		case pending > 0:
+			cerrs[stopIDs[i]] = errors.New(ErrPendingEvents, errorMessages, pending)
+		}
+	}
+	if len(cerrs) == 0 {
+		return nil
 	}
+	return cerrs
 }
 
 // String returns a readable representation of the cell cluster.
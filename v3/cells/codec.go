@@ -0,0 +1,435 @@
+// Tideland Go Cell Network - Cells - Codec
+//
+// Copyright (C) 2010-2015 Frank Mueller / Tideland / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package cells
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/tideland/goas/v3/errors"
+)
+
+//--------------------
+// CONSTANTS
+//--------------------
+
+const (
+	// typeKey and valueKey are the keys of the maps
+	// encoding values of registered payload types.
+	typeKey  = "$type"
+	valueKey = "$value"
+
+	// eventTypeName and errorTypeName are the type names of
+	// encoded events and errors, e.g. those of dead letters.
+	eventTypeName = "cells.Event"
+	errorTypeName = "cells.error"
+)
+
+//--------------------
+// PAYLOAD CODEC
+//--------------------
+
+// PayloadCodec describes the encoding and decoding of events
+// including their payloads and metadata. This way events can be
+// persisted or transported. Scenes and response channels of
+// requests are local and will not be encoded, only the ID of the
+// scene is kept in the metadata. Events and errors being payload
+// values, like those of dead letters, are encoded too, errors only
+// with their messages.
+type PayloadCodec interface {
+	// Encode encodes an event into bytes.
+	Encode(event Event) ([]byte, error)
+
+	// Decode decodes bytes into an event.
+	Decode(data []byte) (Event, error)
+}
+
+// codecs contains the registered payload codecs.
+var codecs = struct {
+	sync.RWMutex
+	byName map[string]PayloadCodec
+}{
+	byName: make(map[string]PayloadCodec),
+}
+
+// RegisterPayloadCodec registers a payload codec with a name.
+// The codecs "json", "gob", and "msgpack" are registered by
+// default.
+func RegisterPayloadCodec(name string, codec PayloadCodec) {
+	codecs.Lock()
+	defer codecs.Unlock()
+	codecs.byName[name] = codec
+}
+
+// LookupPayloadCodec returns the payload codec registered
+// with the name.
+func LookupPayloadCodec(name string) (PayloadCodec, error) {
+	codecs.RLock()
+	defer codecs.RUnlock()
+	codec, ok := codecs.byName[name]
+	if !ok {
+		return nil, errors.New(ErrUnknownCodec, errorMessages, name)
+	}
+	return codec, nil
+}
+
+// PayloadCodecNames returns the sorted names of the
+// registered payload codecs.
+func PayloadCodecNames() []string {
+	codecs.RLock()
+	defer codecs.RUnlock()
+	names := []string{}
+	for name := range codecs.byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+//--------------------
+// PAYLOAD TYPES
+//--------------------
+
+// payloadTypes contains the registered types of payload values.
+var payloadTypes = struct {
+	sync.RWMutex
+	byName map[string]reflect.Type
+	byType map[reflect.Type]string
+}{
+	byName: make(map[string]reflect.Type),
+	byType: make(map[reflect.Type]string),
+}
+
+// RegisterPayloadType registers the type of the passed value with
+// a name. Payload values of registered types are decoded into the
+// same type again, otherwise codecs like JSON return the generic
+// representation, e.g. maps for structs. The types time.Time and
+// time.Duration are registered by default. Registering the same
+// type with the same name again does nothing, while a name used
+// for another type or a type registered with another name, also
+// directly with gob, is an error.
+func RegisterPayloadType(name string, value interface{}) (err error) {
+	payloadTypes.Lock()
+	defer payloadTypes.Unlock()
+	t := reflect.TypeOf(value)
+	if registered, ok := payloadTypes.byName[name]; ok {
+		if registered == t {
+			return nil
+		}
+		return errors.New(ErrTypeRegistration, errorMessages, t, name, "name is used for "+registered.String())
+	}
+	if registered, ok := payloadTypes.byType[t]; ok {
+		return errors.New(ErrTypeRegistration, errorMessages, t, name, "type is registered as "+registered)
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			err = errors.New(ErrTypeRegistration, errorMessages, t, name, r)
+		}
+	}()
+	gob.RegisterName(name, value)
+	payloadTypes.byName[name] = t
+	payloadTypes.byType[t] = name
+	return nil
+}
+
+// payloadTypeName returns the registered name of the
+// type of the value.
+func payloadTypeName(value interface{}) (string, bool) {
+	payloadTypes.RLock()
+	defer payloadTypes.RUnlock()
+	name, ok := payloadTypes.byType[reflect.TypeOf(value)]
+	return name, ok
+}
+
+// payloadType returns the type registered with the name.
+func payloadType(name string) (reflect.Type, bool) {
+	payloadTypes.RLock()
+	defer payloadTypes.RUnlock()
+	t, ok := payloadTypes.byName[name]
+	return t, ok
+}
+
+// init registers the default codecs and payload types.
+func init() {
+	gob.Register(map[string]interface{}{})
+	gob.Register([]interface{}{})
+	_ = RegisterPayloadType("time.Time", time.Time{})
+	_ = RegisterPayloadType("time.Duration", time.Duration(0))
+	RegisterPayloadCodec("json", NewJSONPayloadCodec())
+	RegisterPayloadCodec("gob", NewGobPayloadCodec())
+	RegisterPayloadCodec("msgpack", NewMsgPackPayloadCodec())
+}
+
+//--------------------
+// JSON CODEC
+//--------------------
+
+// jsonEvent is the JSON representation of an event.
+type jsonEvent struct {
+	Topic    string                 `json:"topic"`
+	Payload  map[string]interface{} `json:"payload"`
+	Metadata *Metadata              `json:"metadata,omitempty"`
+}
+
+// jsonPayloadCodec implements the PayloadCodec interface
+// using JSON. So after decoding numbers are float64 values,
+// structs of not registered types are maps, and so on.
+type jsonPayloadCodec struct{}
+
+// NewJSONPayloadCodec creates a payload codec using JSON.
+func NewJSONPayloadCodec() PayloadCodec {
+	return &jsonPayloadCodec{}
+}
+
+// Encode is specified on the PayloadCodec interface.
+func (c *jsonPayloadCodec) Encode(event Event) ([]byte, error) {
+	values, err := encodablePayloadValues(event.Payload(), true)
+	if err != nil {
+		return nil, errors.Annotate(err, ErrEncoding, errorMessages, event)
+	}
+	md := event.Metadata()
+	je := jsonEvent{
+		Topic:    event.Topic(),
+		Payload:  values,
+		Metadata: &md,
+	}
+	data, err := json.Marshal(je)
+	if err != nil {
+		return nil, errors.Annotate(err, ErrEncoding, errorMessages, event)
+	}
+	return data, nil
+}
+
+// Decode is specified on the PayloadCodec interface.
+func (c *jsonPayloadCodec) Decode(data []byte) (Event, error) {
+	var je jsonEvent
+	if err := json.Unmarshal(data, &je); err != nil {
+		return nil, errors.Annotate(err, ErrDecoding, errorMessages, err)
+	}
+	return decodedEvent(je.Topic, je.Payload, je.Metadata)
+}
+
+//--------------------
+// HELPERS
+//--------------------
+
+// decodedEvent creates an event out of decoded parts. Values of
+// registered types are restored and the metadata is kept if it
+// has been encoded.
+func decodedEvent(topic string, values map[string]interface{}, md *Metadata) (Event, error) {
+	for key, value := range values {
+		restored, err := decodeTypedValue(value)
+		if err != nil {
+			return nil, errors.Annotate(err, ErrDecoding, errorMessages, err)
+		}
+		values[key] = restored
+	}
+	decoded, err := NewEvent(topic, PayloadValues(values), nil)
+	if err != nil {
+		return nil, err
+	}
+	if md != nil {
+		decoded.(*event).metadata = *md
+	}
+	return decoded, nil
+}
+
+// encodablePayloadValues returns the values of a payload without
+// the local only ones. Events and errors, e.g. those of dead letters,
+// are encoded as maps. If wanted the values of registered types are
+// wrapped, so that they can be restored when decoding.
+func encodablePayloadValues(p Payload, wrap bool) (map[string]interface{}, error) {
+	values := map[string]interface{}{}
+	if p == nil {
+		return values, nil
+	}
+	err := p.Do(func(key string, value interface{}) error {
+		if key == ResponseChanPayload {
+			return nil
+		}
+		switch v := value.(type) {
+		case Event:
+			encoded, err := encodeEventValue(v, wrap)
+			if err != nil {
+				return err
+			}
+			value = encoded
+		case error:
+			value = map[string]interface{}{
+				typeKey:  errorTypeName,
+				valueKey: v.Error(),
+			}
+		default:
+			if wrap {
+				wrapped, err := encodeTypedValue(value)
+				if err != nil {
+					return err
+				}
+				value = wrapped
+			}
+		}
+		values[key] = value
+		return nil
+	})
+	return values, err
+}
+
+// encodeEventValue encodes an event being a payload value as map
+// containing its topic, payload, and metadata.
+func encodeEventValue(e Event, wrap bool) (interface{}, error) {
+	values, err := encodablePayloadValues(e.Payload(), wrap)
+	if err != nil {
+		return nil, err
+	}
+	md, err := genericValue(e.Metadata())
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		typeKey: eventTypeName,
+		valueKey: map[string]interface{}{
+			"topic":    e.Topic(),
+			"payload":  values,
+			"metadata": md,
+		},
+	}, nil
+}
+
+// decodeEventValue restores an event encoded by encodeEventValue().
+func decodeEventValue(value interface{}) (interface{}, error) {
+	v, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, errors.New(ErrDecoding, errorMessages, "invalid event value")
+	}
+	topic, _ := v["topic"].(string)
+	values, ok := v["payload"].(map[string]interface{})
+	if !ok {
+		values = map[string]interface{}{}
+	}
+	md, err := typedValue(reflect.TypeOf(Metadata{}), v["metadata"])
+	if err != nil {
+		return nil, err
+	}
+	metadata := md.(Metadata)
+	return decodedEvent(topic, values, &metadata)
+}
+
+// encodeTypedValue wraps values of registered types in a map
+// containing the type name and the generic value. Maps and
+// slices are walked recursively.
+func encodeTypedValue(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		encoded := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			e, err := encodeTypedValue(item)
+			if err != nil {
+				return nil, err
+			}
+			encoded[key] = e
+		}
+		return encoded, nil
+	case PayloadValues:
+		return encodeTypedValue(map[string]interface{}(v))
+	case []interface{}:
+		encoded := make([]interface{}, len(v))
+		for i, item := range v {
+			e, err := encodeTypedValue(item)
+			if err != nil {
+				return nil, err
+			}
+			encoded[i] = e
+		}
+		return encoded, nil
+	}
+	name, ok := payloadTypeName(value)
+	if !ok {
+		return value, nil
+	}
+	generic, err := genericValue(value)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		typeKey:  name,
+		valueKey: generic,
+	}, nil
+}
+
+// decodeTypedValue restores the values wrapped by encodeTypedValue().
+func decodeTypedValue(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if name, ok := v[typeKey].(string); ok && len(v) == 2 {
+			switch name {
+			case eventTypeName:
+				return decodeEventValue(v[valueKey])
+			case errorTypeName:
+				return fmt.Errorf("%v", v[valueKey]), nil
+			}
+			if t, ok := payloadType(name); ok {
+				return typedValue(t, v[valueKey])
+			}
+		}
+		for key, item := range v {
+			d, err := decodeTypedValue(item)
+			if err != nil {
+				return nil, err
+			}
+			v[key] = d
+		}
+		return v, nil
+	case []interface{}:
+		for i, item := range v {
+			d, err := decodeTypedValue(item)
+			if err != nil {
+				return nil, err
+			}
+			v[i] = d
+		}
+		return v, nil
+	}
+	return value, nil
+}
+
+// genericValue returns the generic JSON representation of a value.
+func genericValue(value interface{}) (interface{}, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	var generic interface{}
+	if err := json.Unmarshal(data, &generic); err != nil {
+		return nil, err
+	}
+	return generic, nil
+}
+
+// typedValue converts a generic value into a value of the type.
+func typedValue(t reflect.Type, generic interface{}) (interface{}, error) {
+	data, err := json.Marshal(generic)
+	if err != nil {
+		return nil, err
+	}
+	value := reflect.New(t)
+	if err := json.Unmarshal(data, value.Interface()); err != nil {
+		return nil, err
+	}
+	return value.Elem().Interface(), nil
+}
+
+// EOF
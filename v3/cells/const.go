@@ -13,19 +13,35 @@ package cells
 
 const (
 	// Often used standard topics.
-	CollectedTopic = "collected?"
-	CountersTopic  = "counters?"
-	PingTopic      = "ping?"
-	ProcessedTopic = "processed?"
-	ResetTopic     = "reset!"
-	StatusTopic    = "status?"
-	TickTopic      = "tick!"
+	CollectedTopic  = "collected?"
+	CountersTopic   = "counters?"
+	DeadLetterTopic = "dead-letter!"
+	FailedTopic     = "failed!"
+	PingTopic       = "ping?"
+	ProcessedTopic  = "processed?"
+	RecoveringTopic = "recovering!"
+	ResetTopic      = "reset!"
+	ResponseTopic   = "response!"
+	StatusTopic     = "status?"
+	TickTopic       = "tick!"
 
 	// Standard payload keys.
-	DefaultPayload      = "default"
-	ResponseChanPayload = "responseChan"
-	TickerIDPayload     = "ticker:id"
-	TickerTimePayload   = "ticker:time"
+	CellIDPayload           = "cell:id"
+	CellReasonPayload       = "cell:reason"
+	CellStackPayload        = "cell:stack"
+	DeadLetterEventPayload  = "dead-letter:event"
+	DeadLetterReasonPayload = "dead-letter:reason"
+	DeadLetterSourcePayload = "dead-letter:source"
+	DeadLetterTargetPayload = "dead-letter:target"
+	DefaultPayload          = "default"
+	PriorityPayload         = "priority"
+	RequestIDPayload        = "request:id"
+	RequestTopicPayload     = "request:topic"
+	ResponsePayload         = "response"
+	ResponseChanPayload     = "responseChan"
+	ResponseErrorPayload    = "response:error"
+	TickerIDPayload         = "ticker:id"
+	TickerTimePayload       = "ticker:time"
 
 	// Special responses.
 	PongResponse = "pong!"
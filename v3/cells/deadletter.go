@@ -0,0 +1,96 @@
+// Tideland Go Cell Network - Cells - Dead Letters
+//
+// Copyright (C) 2010-2015 Frank Mueller / Tideland / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package cells
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"context"
+)
+
+//--------------------
+// DEAD LETTERS
+//--------------------
+
+// emitDirect emits the event to the cell with the ID. Undeliverable
+// events are sent to the dead-letter cell.
+func (env *environment) emitDirect(id string, event Event) error {
+	if err := env.cells.emitDirect(id, event); err != nil {
+		env.deadLetter(id, event, err)
+		return err
+	}
+	return nil
+}
+
+// emitDirectContext emits the event to the cell with the ID waiting at
+// most until the context is done. Undeliverable events are sent to the
+// dead-letter cell.
+func (env *environment) emitDirectContext(ctx context.Context, id string, event Event) error {
+	if err := env.cells.emitDirectContext(ctx, id, event); err != nil {
+		env.deadLetter(id, event, err)
+		return err
+	}
+	return nil
+}
+
+// deadLetter emits an event about the undeliverable event to the
+// dead-letter cell of the environment, if there's one. The response
+// channel of a request is local and not part of the letter.
+func (env *environment) deadLetter(targetID string, undeliverable Event, reason error) {
+	if env.deadLetterCellID == "" {
+		return
+	}
+	if env.deadLetterCellID == targetID {
+		env.log.Error("dead-letter cell cannot receive event", LogCellKey, targetID, LogTopicKey, undeliverable.Topic(), LogErrorKey, reason)
+		return
+	}
+	md := undeliverable.Metadata()
+	letter, err := NewEvent(DeadLetterTopic, PayloadValues{
+		DeadLetterEventPayload:  withoutResponseChan(undeliverable),
+		DeadLetterReasonPayload: reason,
+		DeadLetterTargetPayload: targetID,
+		DeadLetterSourcePayload: md.SourceID,
+	}, undeliverable.Scene())
+	if err != nil {
+		env.log.Error("cannot create dead letter", LogTopicKey, undeliverable.Topic(), LogErrorKey, err)
+		return
+	}
+	dmd := &letter.(*event).metadata
+	dmd.CausationID = md.ID
+	dmd.CorrelationID = md.CorrelationID
+	dmd.Hops = md.Hops
+	if err := env.cells.emitDirect(env.deadLetterCellID, letter); err != nil {
+		env.log.Error("cannot emit dead letter", LogTopicKey, undeliverable.Topic(), LogErrorKey, err)
+	}
+}
+
+// withoutResponseChan returns a copy of the event without the
+// response channel of a request.
+func withoutResponseChan(e Event) Event {
+	ev, ok := e.(*event)
+	if !ok {
+		return e
+	}
+	if _, ok := ev.Payload().Get(ResponseChanPayload); !ok {
+		return e
+	}
+	values := PayloadValues{}
+	ev.Payload().Do(func(key string, value interface{}) error {
+		if key != ResponseChanPayload {
+			values[key] = value
+		}
+		return nil
+	})
+	stripped := *ev
+	stripped.payload = NewPayload(values)
+	return &stripped
+}
+
+// EOF
@@ -0,0 +1,450 @@
+// Tideland Go Cell Network - Cells - Disk Queue
+//
+// Copyright (C) 2010-2015 Frank Mueller / Tideland / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package cells
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/tideland/goas/v2/loop"
+	"github.com/tideland/goas/v3/errors"
+)
+
+//--------------------
+// CONSTANTS
+//--------------------
+
+// SyncPolicy defines when a disk event queue flushes the
+// written events to the disk.
+type SyncPolicy int
+
+const (
+	// SyncNever leaves the flushing to the operating system.
+	SyncNever SyncPolicy = iota
+
+	// SyncAlways flushes after each pushed and delivered event.
+	SyncAlways
+
+	// SyncPeriodically flushes once per SyncInterval.
+	SyncPeriodically
+)
+
+const (
+	// SyncInterval is the flush interval of SyncPeriodically.
+	SyncInterval = time.Second
+
+	// DefaultSegmentSize is the size in bytes after which the
+	// segment log of a disk event queue starts a new segment.
+	DefaultSegmentSize = 4 * 1024 * 1024
+
+	segmentExt     = ".log"
+	offsetFilename = "offset"
+	recordHeader   = 8
+)
+
+//--------------------
+// DISK EVENT QUEUE
+//--------------------
+
+// diskPosition addresses the end of a record in the segment log.
+type diskPosition struct {
+	segment int64
+	offset  int64
+}
+
+// diskRecord is a pushed event together with the
+// position behind its record.
+type diskRecord struct {
+	event    Event
+	position diskPosition
+}
+
+// diskEventQueue implements a durable event queue. Each cell has
+// its own directory containing an append-only log split into
+// segments and the offset of the last processed event. Fully
+// processed segments are removed.
+type diskEventQueue struct {
+	id           string
+	dir          string
+	codec        PayloadCodec
+	syncPolicy   SyncPolicy
+	segmentSize  int64
+	segment      *os.File
+	segmentID    int64
+	segmentLen   int64
+	firstSegment int64
+	offsetFile   *os.File
+	pending      []diskRecord
+	delivered    *diskPosition
+	length       int64
+	pushc        chan Event
+	resultc      chan error
+	eventc       chan Event
+	loop         loop.Loop
+	log          *slog.Logger
+}
+
+// makeDiskEventQueueFactory creates a factory for disk event
+// queues storing their segment logs below the directory.
+func makeDiskEventQueueFactory(dir string, codec PayloadCodec, syncPolicy SyncPolicy, segmentSize int64) EventQueueFactory {
+	return func(env Environment, id string) (EventQueue, error) {
+		queue := &diskEventQueue{
+			id:          id,
+			dir:         filepath.Join(dir, url.PathEscape(id)),
+			codec:       codec,
+			syncPolicy:  syncPolicy,
+			segmentSize: segmentSize,
+			pushc:       make(chan Event),
+			resultc:     make(chan error),
+			eventc:      make(chan Event),
+			log:         loggerOf(env).With(LogCellKey, id),
+		}
+		if err := queue.open(); err != nil {
+			return nil, errors.Annotate(err, ErrQueuePersistence, errorMessages, id)
+		}
+		queue.loop = loop.Go(queue.backendLoop)
+		return queue, nil
+	}
+}
+
+// Push appends an event to the end of the queue. It
+// returns after the event has been written.
+func (q *diskEventQueue) Push(event Event) error {
+	return q.PushContext(context.Background(), event)
+}
+
+// PushContext appends an event to the end of the queue. It
+// returns an error if the context is done while waiting.
+func (q *diskEventQueue) PushContext(ctx context.Context, event Event) error {
+	select {
+	case q.pushc <- event:
+	case <-ctx.Done():
+		return newContextError(ctx, "push to event queue")
+	case <-q.loop.IsStopping():
+		return errors.New(ErrStopping, errorMessages, "event queue")
+	}
+	return <-q.resultc
+}
+
+// Events returns a channel delivering the event
+// fromt the beginning of the queue.
+func (q *diskEventQueue) Events() <-chan Event {
+	return q.eventc
+}
+
+// Len returns the number of currently queued events.
+func (q *diskEventQueue) Len() int {
+	return int(atomic.LoadInt64(&q.length))
+}
+
+// Dropped returns the number of dropped events. Disk
+// event queues never drop events.
+func (q *diskEventQueue) Dropped() int64 {
+	return 0
+}
+
+// Stop tells the queue to end working.
+func (q *diskEventQueue) Stop() error {
+	return q.loop.Stop()
+}
+
+// open prepares the directory, removes the processed segments
+// and reads the unprocessed events.
+func (q *diskEventQueue) open() error {
+	if err := os.MkdirAll(q.dir, 0755); err != nil {
+		return err
+	}
+	offsetFile, err := os.OpenFile(filepath.Join(q.dir, offsetFilename), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	q.offsetFile = offsetFile
+	committed, err := q.readOffset()
+	if err != nil {
+		return err
+	}
+	sids, err := q.segmentIDs()
+	if err != nil {
+		return err
+	}
+	for _, sid := range sids {
+		if sid < committed.segment {
+			if err := os.Remove(q.segmentPath(sid)); err != nil {
+				return err
+			}
+			continue
+		}
+		if q.firstSegment == 0 {
+			q.firstSegment = sid
+		}
+		var from int64
+		if sid == committed.segment {
+			from = committed.offset
+		}
+		if err := q.readSegment(sid, from); err != nil {
+			return err
+		}
+		q.segmentID = sid
+	}
+	if q.segmentID == 0 {
+		q.segmentID = 1
+		q.firstSegment = 1
+	}
+	atomic.StoreInt64(&q.length, int64(len(q.pending)))
+	return q.openSegment()
+}
+
+// segmentIDs returns the sorted IDs of the existing segments.
+func (q *diskEventQueue) segmentIDs() ([]int64, error) {
+	entries, err := os.ReadDir(q.dir)
+	if err != nil {
+		return nil, err
+	}
+	sids := []int64{}
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasSuffix(name, segmentExt) {
+			continue
+		}
+		sid, err := strconv.ParseInt(strings.TrimSuffix(name, segmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		sids = append(sids, sid)
+	}
+	sort.Slice(sids, func(i, j int) bool { return sids[i] < sids[j] })
+	return sids, nil
+}
+
+// segmentPath returns the path of the segment with the given ID.
+func (q *diskEventQueue) segmentPath(sid int64) string {
+	return filepath.Join(q.dir, fmt.Sprintf("%016d%s", sid, segmentExt))
+}
+
+// readSegment reads the events of a segment starting at the
+// given offset. A torn record at the end of the segment, e.g.
+// after a crash, is cut off.
+func (q *diskEventQueue) readSegment(sid, from int64) error {
+	data, err := os.ReadFile(q.segmentPath(sid))
+	if err != nil {
+		return err
+	}
+	offset := from
+	for offset < int64(len(data)) {
+		if offset+recordHeader > int64(len(data)) {
+			break
+		}
+		size := int64(binary.BigEndian.Uint32(data[offset : offset+4]))
+		sum := binary.BigEndian.Uint32(data[offset+4 : offset+recordHeader])
+		end := offset + recordHeader + size
+		if end > int64(len(data)) || crc32.ChecksumIEEE(data[offset+recordHeader:end]) != sum {
+			break
+		}
+		event, err := q.codec.Decode(data[offset+recordHeader : end])
+		if err != nil {
+			return err
+		}
+		q.pending = append(q.pending, diskRecord{event, diskPosition{sid, end}})
+		offset = end
+	}
+	if offset < int64(len(data)) {
+		q.log.Warn("cutting off torn record", "segment", sid)
+		return os.Truncate(q.segmentPath(sid), offset)
+	}
+	return nil
+}
+
+// openSegment opens the current segment for appending.
+func (q *diskEventQueue) openSegment() error {
+	segment, err := os.OpenFile(q.segmentPath(q.segmentID), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := segment.Stat()
+	if err != nil {
+		segment.Close()
+		return err
+	}
+	q.segment = segment
+	q.segmentLen = info.Size()
+	return nil
+}
+
+// rollSegment closes the current segment and starts a new one.
+func (q *diskEventQueue) rollSegment() error {
+	if err := q.segment.Sync(); err != nil {
+		return err
+	}
+	if err := q.segment.Close(); err != nil {
+		return err
+	}
+	q.segmentID++
+	return q.openSegment()
+}
+
+// readOffset reads the position behind the last processed event.
+func (q *diskEventQueue) readOffset() (diskPosition, error) {
+	buf := make([]byte, 16)
+	n, err := q.offsetFile.ReadAt(buf, 0)
+	if n < len(buf) {
+		// No offset written so far.
+		return diskPosition{}, nil
+	}
+	if err != nil {
+		return diskPosition{}, err
+	}
+	return diskPosition{
+		segment: int64(binary.BigEndian.Uint64(buf[0:8])),
+		offset:  int64(binary.BigEndian.Uint64(buf[8:16])),
+	}, nil
+}
+
+// commit writes the position behind the last delivered event
+// as offset and removes the segments processed completely.
+func (q *diskEventQueue) commit() error {
+	if q.delivered == nil {
+		return nil
+	}
+	position := *q.delivered
+	q.delivered = nil
+	buf := make([]byte, 16)
+	binary.BigEndian.PutUint64(buf[0:8], uint64(position.segment))
+	binary.BigEndian.PutUint64(buf[8:16], uint64(position.offset))
+	if _, err := q.offsetFile.WriteAt(buf, 0); err != nil {
+		return err
+	}
+	if q.syncPolicy == SyncAlways {
+		if err := q.offsetFile.Sync(); err != nil {
+			return err
+		}
+	}
+	for ; q.firstSegment < position.segment; q.firstSegment++ {
+		if err := os.Remove(q.segmentPath(q.firstSegment)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// push writes an event to the segment log and adds
+// it to the pending events.
+func (q *diskEventQueue) push(event Event) error {
+	data, err := q.codec.Encode(event)
+	if err != nil {
+		return err
+	}
+	if q.segmentLen >= q.segmentSize {
+		if err := q.rollSegment(); err != nil {
+			return errors.Annotate(err, ErrQueuePersistence, errorMessages, q.id)
+		}
+	}
+	record := make([]byte, recordHeader+len(data))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(data)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(data))
+	copy(record[recordHeader:], data)
+	if _, err := q.segment.Write(record); err != nil {
+		return errors.Annotate(err, ErrQueuePersistence, errorMessages, q.id)
+	}
+	if q.syncPolicy == SyncAlways {
+		if err := q.segment.Sync(); err != nil {
+			return errors.Annotate(err, ErrQueuePersistence, errorMessages, q.id)
+		}
+	}
+	q.segmentLen += int64(len(record))
+	q.pending = append(q.pending, diskRecord{event, diskPosition{q.segmentID, q.segmentLen}})
+	atomic.AddInt64(&q.length, 1)
+	return nil
+}
+
+// deliver marks the first pending event as delivered. The cell
+// receives the next event only after processing the previous
+// one, so the position of that one can be committed.
+func (q *diskEventQueue) deliver() {
+	if err := q.commit(); err != nil {
+		q.log.Error("cannot commit event queue", LogErrorKey, err)
+	}
+	position := q.pending[0].position
+	q.delivered = &position
+	q.pending[0] = diskRecord{}
+	q.pending = q.pending[1:]
+	atomic.AddInt64(&q.length, -1)
+}
+
+// sync flushes segment and offset to the disk.
+func (q *diskEventQueue) sync() error {
+	if err := q.segment.Sync(); err != nil {
+		return err
+	}
+	return q.offsetFile.Sync()
+}
+
+// close commits the last delivered event and closes the files.
+func (q *diskEventQueue) close() error {
+	if err := q.commit(); err != nil {
+		return errors.Annotate(err, ErrQueuePersistence, errorMessages, q.id)
+	}
+	if err := q.sync(); err != nil {
+		return errors.Annotate(err, ErrQueuePersistence, errorMessages, q.id)
+	}
+	if err := q.segment.Close(); err != nil {
+		return errors.Annotate(err, ErrQueuePersistence, errorMessages, q.id)
+	}
+	if err := q.offsetFile.Close(); err != nil {
+		return errors.Annotate(err, ErrQueuePersistence, errorMessages, q.id)
+	}
+	return nil
+}
+
+// backendLoop realizes the backend of the queue.
+func (q *diskEventQueue) backendLoop(l loop.Loop) error {
+	var syncc <-chan time.Time
+	if q.syncPolicy == SyncPeriodically {
+		ticker := time.NewTicker(SyncInterval)
+		defer ticker.Stop()
+		syncc = ticker.C
+	}
+	for {
+		// A nil channel disables delivering while
+		// there's no pending event.
+		var eventc chan Event
+		var event Event
+		if len(q.pending) > 0 {
+			eventc = q.eventc
+			event = q.pending[0].event
+		}
+		select {
+		case <-l.ShallStop():
+			return q.close()
+		case pushed := <-q.pushc:
+			q.resultc <- q.push(pushed)
+		case eventc <- event:
+			q.deliver()
+		case <-syncc:
+			if err := q.sync(); err != nil {
+				q.log.Error("cannot sync event queue", LogErrorKey, err)
+			}
+		}
+	}
+}
+
+// EOF
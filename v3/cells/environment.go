@@ -12,13 +12,19 @@ package cells
 //--------------------
 
 import (
+	"context"
 	"fmt"
+	"io"
+	"log/slog"
 	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/tideland/goas/v1/scene"
 	"github.com/tideland/goas/v2/identifier"
-	"github.com/tideland/goas/v2/logger"
+	"github.com/tideland/goas/v2/loop"
 	"github.com/tideland/goas/v3/errors"
 )
 
@@ -34,23 +40,53 @@ const DefaultTimeout = 5 * time.Second
 
 // Environment implements the Environment interface.
 type environment struct {
-	id           string
-	queueFactory EventQueueFactory
-	cells        *cluster
+	mux              sync.RWMutex
+	id               string
+	queueFactory     EventQueueFactory
+	cells            *cluster
+	stopping         int32
+	supervisors      []*supervisor
+	supervised       map[string]*supervisor
+	errorCellID      string
+	deadLetterCellID string
+	maxHops          int
+	heartbeat        time.Duration
+	transportCodec   PayloadCodec
+	transports       []io.Closer
+	interceptors     []Interceptor
+	logHandler       slog.Handler
+	logLevel         slog.Leveler
+	log              *slog.Logger
+	snapshotStore    SnapshotStore
+	snapshotInterval time.Duration
+	snapshotLoop     loop.Loop
+	recorder         *Recorder
+	metricsTopics    int
+	normalizeTopic   func(topic string) string
+	replacing        map[string]string
 }
 
 // NewEnvironment creates a new environment.
 func NewEnvironment(options ...Option) Environment {
 	env := &environment{
-		id:           identifier.NewUUID().String(),
-		queueFactory: makeLocalEventQueueFactory(10),
-		cells:        newCluster(),
+		id:             identifier.NewUUID().String(),
+		queueFactory:   makeLocalEventQueueFactory(10),
+		cells:          newCluster(),
+		supervised:     make(map[string]*supervisor),
+		replacing:      make(map[string]string),
+		heartbeat:      DefaultHeartbeat,
+		transportCodec: NewJSONPayloadCodec(),
+		metricsTopics:  DefaultMetricsTopics,
 	}
 	for _, option := range options {
 		option(env)
 	}
+	env.log = newLogger(env)
+	if env.snapshotStore != nil && env.snapshotInterval > 0 {
+		env.snapshotLoop = loop.Go(env.periodicSnapshots)
+	}
 	runtime.SetFinalizer(env, (*environment).Stop)
-	logger.Infof("cells environment %q started", env.ID())
+	env.log.Info("cells environment started")
 	return env
 }
 
@@ -60,21 +96,83 @@ func (env *environment) ID() string {
 }
 
 // StartCell is specified on the Environment interface.
-func (env *environment) StartCell(id string, behavior Behavior) error {
-	return env.cells.startCell(env, id, behavior)
+func (env *environment) StartCell(id string, behavior Behavior, options ...CellOption) error {
+	return env.cells.startCell(env, id, behavior, options...)
 }
 
 // StopCell is specified on the Environment interface.
 func (env *environment) StopCell(id string) error {
+	env.unsupervise(id)
 	return env.cells.stopCell(id)
 }
 
+// ReplaceBehavior is specified on the Environment interface.
+func (env *environment) ReplaceBehavior(id string, behavior Behavior) error {
+	c, err := env.cells.cell(id)
+	if err != nil {
+		return err
+	}
+	return c.replace(behavior)
+}
+
+// StartSupervisor is specified on the Environment interface.
+func (env *environment) StartSupervisor(spec SupervisorSpec) error {
+	if err := spec.validate(map[string]bool{}); err != nil {
+		return err
+	}
+	s := newSupervisor(env, nil, spec)
+	if err := s.start(); err != nil {
+		return err
+	}
+	env.mux.Lock()
+	defer env.mux.Unlock()
+	env.supervisors = append(env.supervisors, s)
+	return nil
+}
+
 // HasCell is specified on the Environment interface.
 func (env *environment) HasCell(id string) bool {
 	_, err := env.cells.cell(id)
 	return err == nil
 }
 
+// Cells is specified on the Environment interface.
+func (env *environment) Cells() []string {
+	ids := env.cells.ids()
+	sort.Strings(ids)
+	return ids
+}
+
+// Topology is specified on the Environment interface.
+func (env *environment) Topology() Topology {
+	return newTopology(env)
+}
+
+// Metrics is specified on the Environment interface.
+func (env *environment) Metrics() Metrics {
+	return newMetrics(env)
+}
+
+// Listen is specified on the Environment interface.
+func (env *environment) Listen(network, address string, authorizers ...LinkAuthorizer) (Listener, error) {
+	l, err := newListener(env, network, address, authorizers)
+	if err != nil {
+		return nil, err
+	}
+	env.addTransport(l)
+	return l, nil
+}
+
+// Connect is specified on the Environment interface.
+func (env *environment) Connect(network, address string) (Link, error) {
+	l, err := newLink(env, network, address)
+	if err != nil {
+		return nil, err
+	}
+	env.addTransport(l)
+	return l, nil
+}
+
 // Subscribe is specified on the Environment interface.
 func (env *environment) Subscribe(emitterId string, subscriberIds ...string) error {
 	cell, err := env.cells.cell(emitterId)
@@ -85,7 +183,24 @@ func (env *environment) Subscribe(emitterId string, subscriberIds ...string) err
 	if err != nil {
 		return err
 	}
-	cell.subscribers.subscribe(scm)
+	cell.subscribe(scm)
+	return nil
+}
+
+// SubscribeFiltered is specified on the Environment interface.
+func (env *environment) SubscribeFiltered(emitterId, subscriberId string, filter SubscriptionFilter) error {
+	if filter == nil {
+		return env.Subscribe(emitterId, subscriberId)
+	}
+	cell, err := env.cells.cell(emitterId)
+	if err != nil {
+		return err
+	}
+	subscriber, err := env.cells.cell(subscriberId)
+	if err != nil {
+		return err
+	}
+	cell.subscribeFiltered(subscriber, filter)
 	return nil
 }
 
@@ -94,6 +209,11 @@ func (env *environment) Subscribers(id string) ([]string, error) {
 	return env.cells.subscribers(id)
 }
 
+// Subscriptions is specified on the Environment interface.
+func (env *environment) Subscriptions(id string) ([]string, error) {
+	return env.cells.subscriptions(id)
+}
+
 // Unsubscribe is specified on the Environment interface.
 func (env *environment) Unsubscribe(emitterId string, unsubscriberIds ...string) error {
 	cell, err := env.cells.cell(emitterId)
@@ -104,13 +224,26 @@ func (env *environment) Unsubscribe(emitterId string, unsubscriberIds ...string)
 	if err != nil {
 		return err
 	}
-	cell.subscribers.unsubscribe(uscm)
+	cell.unsubscribe(uscm)
 	return nil
 }
 
 // Emit is specified on the Environment interface.
 func (env *environment) Emit(id string, event Event) error {
-	return env.cells.emitDirect(id, event)
+	if env.isStopping() {
+		return errors.New(ErrStopping, errorMessages, "environment")
+	}
+	env.recordExternal(id, event)
+	return env.emitDirect(id, event)
+}
+
+// EmitContext is specified on the Environment interface.
+func (env *environment) EmitContext(ctx context.Context, id string, event Event) error {
+	if env.isStopping() {
+		return errors.New(ErrStopping, errorMessages, "environment")
+	}
+	env.recordExternal(id, event)
+	return env.emitDirectContext(ctx, id, event)
 }
 
 // EmitNew is specified on the Environment interface.
@@ -128,10 +261,38 @@ func (env *environment) Request(
 	payload interface{},
 	scn scene.Scene,
 	timeout time.Duration,
+) (interface{}, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return env.RequestContext(ctx, id, topic, payload, scn)
+}
+
+// RequestContext is specified on the Environment interface.
+func (env *environment) RequestContext(
+	ctx context.Context,
+	id, topic string,
+	payload interface{},
+	scn scene.Scene,
+) (interface{}, error) {
+	return env.request(ctx, id, topic, payload, scn, env.EmitContext)
+}
+
+// request emits a request event using the passed emit
+// function and waits for the response.
+func (env *environment) request(
+	ctx context.Context,
+	id, topic string,
+	payload interface{},
+	scn scene.Scene,
+	emit func(ctx context.Context, id string, event Event) error,
 ) (interface{}, error) {
 	responseChan := make(chan interface{}, 1)
 	p := NewPayload(payload).Apply(PayloadValues{ResponseChanPayload: responseChan})
-	err := env.EmitNew(id, topic, p, scn)
+	event, err := newEventContext(ctx, topic, p, scn)
+	if err != nil {
+		return nil, err
+	}
+	err = emit(ctx, id, event)
 	if err != nil {
 		return nil, err
 	}
@@ -141,18 +302,309 @@ func (env *environment) Request(
 			return nil, err
 		}
 		return response, nil
-	case <-time.After(timeout):
+	case <-ctx.Done():
 		op := fmt.Sprintf("request %q to %q", topic, id)
-		return nil, errors.New(ErrTimeout, errorMessages, op)
+		return nil, newContextError(ctx, op)
 	}
 }
 
+// RequestAsync is specified on the Environment interface.
+func (env *environment) RequestAsync(
+	id, topic string,
+	payload interface{},
+	scn scene.Scene,
+	timeout time.Duration,
+) (Future, error) {
+	return env.requestAsync(id, topic, payload, scn, timeout, env.EmitContext, nil)
+}
+
+// ScatterGather is specified on the Environment interface.
+func (env *environment) ScatterGather(
+	ids []string,
+	topic string,
+	payload interface{},
+	scn scene.Scene,
+	quorum int,
+	timeout time.Duration,
+) (*ScatterResult, error) {
+	return env.scatterGather(ids, topic, payload, scn, quorum, timeout, env.EmitContext)
+}
+
+// StopGracefully is specified on the Environment interface.
+func (env *environment) StopGracefully(timeout time.Duration) error {
+	atomic.StoreInt32(&env.stopping, 1)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	ids := env.cells.topologicalIDs()
+	if !env.cells.drain(ctx, ids) {
+		env.log.Warn("cells environment not drained", "timeout", timeout)
+	}
+	return env.stop(ids)
+}
+
 // Stop manages the proper finalization of an env.
 func (env *environment) Stop() error {
-	env.cells.stop()
+	atomic.StoreInt32(&env.stopping, 1)
+	return env.stop(env.cells.ids())
+}
+
+// stop closes the listeners and links and stops the
+// cells in the given order.
+func (env *environment) stop(ids []string) error {
+	env.mux.Lock()
+	transports := env.transports
+	env.transports = nil
+	env.mux.Unlock()
+	for _, transport := range transports {
+		if err := transport.Close(); err != nil {
+			env.log.Warn("cells environment cannot close transport", LogErrorKey, err)
+		}
+	}
+	if env.snapshotLoop != nil {
+		env.snapshotLoop.Stop()
+	}
+	cerrs := env.cells.stop(ids)
 	runtime.SetFinalizer(env, nil)
-	logger.Infof("cells environment %q terminated", env.ID())
+	env.log.Info("cells environment terminated")
+	if cerrs != nil {
+		return errors.Annotate(cerrs, ErrStoppedWithErrors, errorMessages, env.ID())
+	}
+	return nil
+}
+
+// addTransport adds a listener or link closed when stopping.
+func (env *environment) addTransport(transport io.Closer) {
+	env.mux.Lock()
+	defer env.mux.Unlock()
+	env.transports = append(env.transports, transport)
+}
+
+// removeTransport removes a closed listener or link.
+func (env *environment) removeTransport(transport io.Closer) {
+	env.mux.Lock()
+	defer env.mux.Unlock()
+	for i, t := range env.transports {
+		if t == transport {
+			env.transports = append(env.transports[:i], env.transports[i+1:]...)
+			return
+		}
+	}
+}
+
+// supervise lets the supervisor watch the cell.
+func (env *environment) supervise(id string, s *supervisor) {
+	env.mux.Lock()
+	defer env.mux.Unlock()
+	env.supervised[id] = s
+}
+
+// unsupervise removes the cell from its supervisor.
+func (env *environment) unsupervise(id string) {
+	env.mux.Lock()
+	defer env.mux.Unlock()
+	delete(env.supervised, id)
+}
+
+// beginReplacement registers that the behavior of a cell replaces
+// the one of the target cell. Replacing stops the target, which then
+// waits for the replacing cell if the target replaces it in turn,
+// directly or via other cells. So such a cycle is an error.
+func (env *environment) beginReplacement(id, targetID string) error {
+	env.mux.Lock()
+	defer env.mux.Unlock()
+	for next := targetID; next != ""; next = env.replacing[next] {
+		if next == id {
+			return errors.New(ErrReplacementCycle, errorMessages, id, targetID)
+		}
+	}
+	env.replacing[id] = targetID
+	return nil
+}
+
+// endReplacement removes the registered replacement of the cell.
+func (env *environment) endReplacement(id string) {
+	env.mux.Lock()
+	defer env.mux.Unlock()
+	delete(env.replacing, id)
+}
+
+// removeSupervisor removes a supervisor which gave up.
+func (env *environment) removeSupervisor(s *supervisor) {
+	env.mux.Lock()
+	defer env.mux.Unlock()
+	for i, rs := range env.supervisors {
+		if rs == s {
+			env.supervisors = append(env.supervisors[:i], env.supervisors[i+1:]...)
+			return
+		}
+	}
+}
+
+// cellFailed is called when the backend loop of a cell ended
+// with an error. A supervisor of the cell will handle it.
+func (env *environment) cellFailed(id string, err error) {
+	env.mux.RLock()
+	s, ok := env.supervised[id]
+	env.mux.RUnlock()
+	if ok {
+		s.childFailed(id, err)
+	}
+}
+
+// isStopping returns true if the environment doesn't
+// accept outside events anymore.
+func (env *environment) isStopping() bool {
+	return atomic.LoadInt32(&env.stopping) == 1
+}
+
+//--------------------
+// CELL ENVIRONMENT
+//--------------------
+
+// cellEnvironment is the environment as seen by the behaviors
+// through their context. Their emits and requests are internal
+// ones, so they are still accepted while the environment is
+// stopping gracefully. The cell is set as source of the events.
+type cellEnvironment struct {
+	*environment
+	cell *cell
+}
+
+// Emit is specified on the Environment interface.
+func (ce *cellEnvironment) Emit(id string, event Event) error {
+	event, ok := ce.cell.emitted(id, event)
+	if !ok {
+		return nil
+	}
+	err := ce.emitDirect(id, event)
+	ce.cell.countEmitError(err)
+	return err
+}
+
+// ReplaceBehavior is specified on the Environment interface. The
+// behavior of the own cell cannot be replaced, as its processing
+// would have to be stopped. Cells replacing each other get an error
+// instead of waiting for each other.
+func (ce *cellEnvironment) ReplaceBehavior(id string, behavior Behavior) error {
+	if id == ce.cell.id {
+		return errors.New(ErrSelfReplacement, errorMessages, id)
+	}
+	c, err := ce.cells.cell(id)
+	if err != nil {
+		return err
+	}
+	if err := ce.beginReplacement(ce.cell.id, id); err != nil {
+		return err
+	}
+	defer ce.endReplacement(ce.cell.id)
+	return c.replace(behavior)
+}
+
+// Snapshot is specified on the Environment interface. The own
+// cell is snapshotted at once, as it's processing the current
+// event. The other cells are snapshotted asynchronously, as they
+// may wait for the own one.
+func (ce *cellEnvironment) Snapshot(ids ...string) error {
+	snapshotCells, err := ce.snapshotCells(ids)
+	if err != nil {
+		return err
+	}
+	others := []*cell{}
+	for _, c := range snapshotCells {
+		if c != ce.cell {
+			others = append(others, c)
+			continue
+		}
+		if err := c.snapshot(false); err != nil {
+			return err
+		}
+	}
+	if len(others) > 0 {
+		go func() {
+			if err := takeSnapshots(others); err != nil {
+				ce.cell.logger().Error("cannot take snapshots", LogErrorKey, err)
+			}
+		}()
+	}
 	return nil
 }
 
+// EmitContext is specified on the Environment interface.
+func (ce *cellEnvironment) EmitContext(ctx context.Context, id string, event Event) error {
+	event, ok := ce.cell.emitted(id, event)
+	if !ok {
+		return nil
+	}
+	err := ce.emitDirectContext(ctx, id, event)
+	ce.cell.countEmitError(err)
+	return err
+}
+
+// EmitNew is specified on the Environment interface.
+func (ce *cellEnvironment) EmitNew(id, topic string, payload interface{}, scene scene.Scene) error {
+	event, err := NewEvent(topic, payload, scene)
+	if err != nil {
+		return err
+	}
+	return ce.Emit(id, event)
+}
+
+// Request is specified on the Environment interface.
+func (ce *cellEnvironment) Request(
+	id, topic string,
+	payload interface{},
+	scn scene.Scene,
+	timeout time.Duration,
+) (interface{}, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return ce.RequestContext(ctx, id, topic, payload, scn)
+}
+
+// RequestAsync is specified on the Environment interface. The
+// response is additionally delivered to the requesting cell as
+// event with the ResponseTopic.
+func (ce *cellEnvironment) RequestAsync(
+	id, topic string,
+	payload interface{},
+	scn scene.Scene,
+	timeout time.Duration,
+) (Future, error) {
+	var request Event
+	emit := func(ctx context.Context, id string, event Event) error {
+		event, ok := ce.cell.emitted(id, event)
+		request = event
+		if !ok {
+			return nil
+		}
+		return ce.emitDirectContext(ctx, id, event)
+	}
+	deliver := func(f *future) {
+		ce.cell.deliverResponse(request, f)
+	}
+	return ce.requestAsync(id, topic, payload, scn, timeout, emit, deliver)
+}
+
+// ScatterGather is specified on the Environment interface.
+func (ce *cellEnvironment) ScatterGather(
+	ids []string,
+	topic string,
+	payload interface{},
+	scn scene.Scene,
+	quorum int,
+	timeout time.Duration,
+) (*ScatterResult, error) {
+	return ce.scatterGather(ids, topic, payload, scn, quorum, timeout, ce.EmitContext)
+}
+
+// RequestContext is specified on the Environment interface.
+func (ce *cellEnvironment) RequestContext(
+	ctx context.Context,
+	id, topic string,
+	payload interface{},
+	scn scene.Scene,
+) (interface{}, error) {
+	return ce.request(ctx, id, topic, payload, scn, ce.EmitContext)
+}
+
 // EOF
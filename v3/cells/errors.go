@@ -12,6 +12,11 @@ package cells
 //--------------------
 
 import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
 	"github.com/tideland/goas/v3/errors"
 )
 
@@ -34,23 +39,116 @@ const (
 	ErrMissingScene
 	ErrInvalidResponseEvent
 	ErrInvalidResponse
+	ErrQueueOverflow
+	ErrEncoding
+	ErrDecoding
+	ErrQueuePersistence
+	ErrCanceled
+	ErrPendingEvents
+	ErrStoppedWithErrors
+	ErrSupervisorGaveUp
+	ErrInvalidSupervisorSpec
+	ErrMaxHops
+	ErrLinkNotConnected
+	ErrLinkProtocol
+	ErrRemote
+	ErrUnknownCodec
+	ErrPayloadType
+	ErrNoStruct
+	ErrIncompleteResponses
+	ErrRejected
+	ErrMigration
+	ErrSelfReplacement
+	ErrNoSnapshotStore
+	ErrSnapshot
+	ErrRestore
+	ErrInvalidRecording
+	ErrLinkForbidden
+	ErrTypeRegistration
+	ErrReplacementCycle
 )
 
 var errorMessages = map[int]string{
-	ErrCellInit:             "cell %q cannot initialize",
-	ErrCannotRecover:        "cannot recover cell %q: %v",
-	ErrDuplicateId:          "cell with ID %q already exists",
-	ErrInvalidID:            "cell with ID %q does not exist",
-	ErrEventRecovering:      "cell cannot recover after error %v",
-	ErrRecoveredTooOften:    "cell needs too much recoverings, last error",
-	ErrNoTopic:              "event has no topic",
-	ErrNoRequest:            "cannot respond, event is no request",
-	ErrInactive:             "cell %q is inactive",
-	ErrStopping:             "%s is stopping",
-	ErrTimeout:              "operation needed too long with %v",
-	ErrMissingScene:         "missing scene for request",
-	ErrInvalidResponseEvent: "event not valid for a response: %v",
-	ErrInvalidResponse:      "request returned invalid response: %v",
+	ErrCellInit:              "cell %q cannot initialize",
+	ErrCannotRecover:         "cannot recover cell %q: %v",
+	ErrDuplicateId:           "cell with ID %q already exists",
+	ErrInvalidID:             "cell with ID %q does not exist",
+	ErrEventRecovering:       "cell cannot recover after error %v",
+	ErrRecoveredTooOften:     "cell needs too much recoverings, last error: %v",
+	ErrNoTopic:               "event has no topic",
+	ErrNoRequest:             "cannot respond, event is no request",
+	ErrInactive:              "cell %q is inactive",
+	ErrStopping:              "%s is stopping",
+	ErrTimeout:               "operation needed too long with %v",
+	ErrMissingScene:          "missing scene for request",
+	ErrInvalidResponseEvent:  "event not valid for a response: %v",
+	ErrInvalidResponse:       "request returned invalid response: %v",
+	ErrQueueOverflow:         "event queue reached capacity of %d, cannot push %v",
+	ErrEncoding:              "cannot encode event %v",
+	ErrDecoding:              "cannot decode event: %v",
+	ErrQueuePersistence:      "cannot persist event queue of cell %q",
+	ErrCanceled:              "operation %s has been canceled",
+	ErrPendingEvents:         "cell still had %d pending events",
+	ErrStoppedWithErrors:     "environment %q stopped with errors",
+	ErrSupervisorGaveUp:      "supervisor %q gave up",
+	ErrInvalidSupervisorSpec: "invalid spec of supervisor %q: %s",
+	ErrMaxHops:               "event %q exceeded the maximum of %d hops",
+	ErrLinkNotConnected:      "link to %q is not connected",
+	ErrLinkProtocol:          "link protocol violation: %s",
+	ErrRemote:                "remote environment %q failed: %s",
+	ErrUnknownCodec:          "payload codec %q is not registered",
+	ErrPayloadType:           "payload value %q (%#v) is no %s",
+	ErrNoStruct:              "value %#v is no struct or pointer to a struct",
+	ErrIncompleteResponses:   "%d of %d cells responded, %d needed",
+	ErrRejected:              "%v of event %q to %q rejected",
+	ErrMigration:             "cannot migrate behavior of cell %q",
+	ErrSelfReplacement:       "cell %q cannot replace its own behavior",
+	ErrNoSnapshotStore:       "environment %q has no snapshot store",
+	ErrSnapshot:              "cannot snapshot cell %q",
+	ErrRestore:               "cannot restore cell %q out of snapshot",
+	ErrInvalidRecording:      "invalid recording in line %d",
+	ErrLinkForbidden:         "%v of %q by environment %q forbidden",
+	ErrTypeRegistration:      "payload type %v cannot be registered as %q: %v",
+	ErrReplacementCycle:      "cell %q cannot replace cell %q replacing it in turn",
+}
+
+//--------------------
+// CELL ERRORS
+//--------------------
+
+// CellErrors collects the errors of individual cells, e.g. when
+// stopping an environment or emitting to the subscribers of a
+// cell. The key is the ID of the cell. The IsXyzError() checks
+// of this package are true if one of the errors matches.
+type CellErrors map[string]error
+
+// Error is specified on the error interface.
+func (cerrs CellErrors) Error() string {
+	ids := []string{}
+	for id := range cerrs {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	msgs := []string{}
+	for _, id := range ids {
+		msgs = append(msgs, fmt.Sprintf("cell %q: %v", id, cerrs[id]))
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// isError checks if an error has the code. CellErrors, e.g.
+// returned when emitting to subscribers, have the code if the
+// error of one of the cells has it.
+func isError(err error, code int) bool {
+	if cerrs, ok := err.(CellErrors); ok {
+		for _, cerr := range cerrs {
+			if errors.IsError(cerr, code) {
+				return true
+			}
+		}
+		return false
+	}
+	return errors.IsError(err, code)
 }
 
 //--------------------
@@ -59,7 +157,7 @@ var errorMessages = map[int]string{
 
 // IsCellInitError checks if an error is a cell init error.
 func IsCellInitError(err error) bool {
-	return errors.IsError(err, ErrCellInit)
+	return isError(err, ErrCellInit)
 }
 
 // NewCannotRecoverError returns an error showing that a cell cannot
@@ -71,65 +169,75 @@ func NewCannotRecoverError(id string, err interface{}) error {
 // IsCannotRecoverError checks if an error shows a cell that cannot
 // recover.
 func IsCannotRecoverError(err error) bool {
-	return errors.IsError(err, ErrCannotRecover)
+	return isError(err, ErrCannotRecover)
 }
 
 // IsDuplicateIdError checks if an error is a cell already exists error.
 func IsDuplicateIdError(err error) bool {
-	return errors.IsError(err, ErrDuplicateId)
+	return isError(err, ErrDuplicateId)
 }
 
 // IsInvalidIdError checks if an error is a cell does not exist error.
 func IsInvalidIdError(err error) bool {
-	return errors.IsError(err, ErrInvalidID)
+	return isError(err, ErrInvalidID)
 }
 
 // IsEventRecoveringError checks if an error is an error recovering error.
 func IsEventRecoveringError(err error) bool {
-	return errors.IsError(err, ErrEventRecovering)
+	return isError(err, ErrEventRecovering)
 }
 
 // IsRecoveredTooOftenError checks if an error is an illegal query error.
 func IsRecoveredTooOftenError(err error) bool {
-	return errors.IsError(err, ErrRecoveredTooOften)
+	return isError(err, ErrRecoveredTooOften)
 }
 
 // IsNoTopicError checks if an error shows that an event has no topic..
 func IsNoTopicError(err error) bool {
-	return errors.IsError(err, ErrNoTopic)
+	return isError(err, ErrNoTopic)
 }
 
 // IsNoRequestError checks if an error signals that an event is no request.
 func IsNoRequestError(err error) bool {
-	return errors.IsError(err, ErrNoRequest)
+	return isError(err, ErrNoRequest)
 }
 
 // IsInactiveError checks if an error is a cell inactive error.
 func IsInactiveError(err error) bool {
-	return errors.IsError(err, ErrInactive)
+	return isError(err, ErrInactive)
 }
 
 // IsStoppingError checks if the error shows a stopping entity.
 func IsStoppingError(err error) bool {
-	return errors.IsError(err, ErrStopping)
+	return isError(err, ErrStopping)
+}
+
+// newContextError returns the error for an operation ended by a
+// done context. An exceeded deadline is a timeout error, otherwise
+// it's a canceled error.
+func newContextError(ctx context.Context, op string) error {
+	if ctx.Err() == context.DeadlineExceeded {
+		return errors.New(ErrTimeout, errorMessages, op)
+	}
+	return errors.New(ErrCanceled, errorMessages, op)
 }
 
 // IsTimeoutError checks if an error is a timeout error.
 func IsTimeoutError(err error) bool {
-	return errors.IsError(err, ErrTimeout)
+	return isError(err, ErrTimeout)
 }
 
 // IsMissingSceneError checks if an error signals a request
 // without a scene.
 func IsMissingSceneError(err error) bool {
-	return errors.IsError(err, ErrMissingScene)
+	return isError(err, ErrMissingScene)
 }
 
 // IsInvalidResponseEventError checks if an error signals an event
 // used for a response but containing no storeID as payload and/or
 // no scene.
 func IsInvalidResponseEventError(err error) bool {
-	return errors.IsError(err, ErrInvalidResponseEvent)
+	return isError(err, ErrInvalidResponseEvent)
 }
 
 // NewInvalidResponseError returns an error showing that a
@@ -141,7 +249,170 @@ func NewInvalidResponseError(response interface{}) error {
 // IsInvalidResponseError checks if an error signals an
 // invalid response.
 func IsInvalidResponseError(err error) bool {
-	return errors.IsError(err, ErrInvalidResponse)
+	return isError(err, ErrInvalidResponse)
+}
+
+// IsQueueOverflowError checks if an error signals an event
+// queue which reached its capacity.
+func IsQueueOverflowError(err error) bool {
+	return isError(err, ErrQueueOverflow)
+}
+
+// IsEncodingError checks if an error signals a failed
+// encoding of an event.
+func IsEncodingError(err error) bool {
+	return isError(err, ErrEncoding)
+}
+
+// IsDecodingError checks if an error signals a failed
+// decoding of an event.
+func IsDecodingError(err error) bool {
+	return isError(err, ErrDecoding)
+}
+
+// IsQueuePersistenceError checks if an error signals a
+// failing read or write of a durable event queue.
+func IsQueuePersistenceError(err error) bool {
+	return isError(err, ErrQueuePersistence)
+}
+
+// IsCanceledError checks if an error signals an operation
+// canceled by its context.
+func IsCanceledError(err error) bool {
+	return isError(err, ErrCanceled)
+}
+
+// IsPendingEventsError checks if an error signals a cell
+// stopped while still having pending events.
+func IsPendingEventsError(err error) bool {
+	return isError(err, ErrPendingEvents)
+}
+
+// IsStoppedWithErrorsError checks if an error signals an
+// environment where stopping cells failed. The errors per
+// cell are annotated as CellErrors.
+func IsStoppedWithErrorsError(err error) bool {
+	return isError(err, ErrStoppedWithErrors)
+}
+
+// IsSupervisorGaveUpError checks if an error signals a
+// supervisor which gave up restarting its children.
+func IsSupervisorGaveUpError(err error) bool {
+	return isError(err, ErrSupervisorGaveUp)
+}
+
+// IsInvalidSupervisorSpecError checks if an error signals
+// an invalid supervisor specification.
+func IsInvalidSupervisorSpecError(err error) bool {
+	return isError(err, ErrInvalidSupervisorSpec)
+}
+
+// IsMaxHopsError checks if an error signals an event
+// exceeding the maximum hop count.
+func IsMaxHopsError(err error) bool {
+	return isError(err, ErrMaxHops)
+}
+
+// IsLinkNotConnectedError checks if an error signals
+// a link which is currently not connected.
+func IsLinkNotConnectedError(err error) bool {
+	return isError(err, ErrLinkNotConnected)
+}
+
+// IsLinkProtocolError checks if an error signals an
+// invalid message received by a link.
+func IsLinkProtocolError(err error) bool {
+	return isError(err, ErrLinkProtocol)
+}
+
+// IsRemoteError checks if an error signals a failed
+// operation in a remote environment.
+func IsRemoteError(err error) bool {
+	return isError(err, ErrRemote)
+}
+
+// IsUnknownCodecError checks if an error signals
+// a payload codec which is not registered.
+func IsUnknownCodecError(err error) bool {
+	return isError(err, ErrUnknownCodec)
+}
+
+// IsPayloadTypeError checks if an error signals a payload
+// value of an unexpected type.
+func IsPayloadTypeError(err error) bool {
+	return isError(err, ErrPayloadType)
+}
+
+// IsNoStructError checks if an error signals a value
+// which is no struct or pointer to a struct.
+func IsNoStructError(err error) bool {
+	return isError(err, ErrNoStruct)
+}
+
+// IsIncompleteResponsesError checks if an error signals a
+// scatter-gather request with too few responses.
+func IsIncompleteResponsesError(err error) bool {
+	return isError(err, ErrIncompleteResponses)
+}
+
+// IsRejectedError checks if an error signals an event
+// rejected by an interceptor.
+func IsRejectedError(err error) bool {
+	return isError(err, ErrRejected)
+}
+
+// IsMigrationError checks if an error signals a failed
+// migration of a replaced behavior.
+func IsMigrationError(err error) bool {
+	return isError(err, ErrMigration)
+}
+
+// IsSelfReplacementError checks if an error signals a
+// behavior trying to replace itself.
+func IsSelfReplacementError(err error) bool {
+	return isError(err, ErrSelfReplacement)
+}
+
+// IsReplacementCycleError checks if an error signals
+// behaviors replacing the ones of each other.
+func IsReplacementCycleError(err error) bool {
+	return isError(err, ErrReplacementCycle)
+}
+
+// IsNoSnapshotStoreError checks if an error signals an
+// environment without snapshot store.
+func IsNoSnapshotStoreError(err error) bool {
+	return isError(err, ErrNoSnapshotStore)
+}
+
+// IsSnapshotError checks if an error signals a failed
+// snapshot of a cell.
+func IsSnapshotError(err error) bool {
+	return isError(err, ErrSnapshot)
+}
+
+// IsRestoreError checks if an error signals a failed
+// restore of a cell out of its snapshot.
+func IsRestoreError(err error) bool {
+	return isError(err, ErrRestore)
+}
+
+// IsInvalidRecordingError checks if an error signals
+// a recording which cannot be read.
+func IsInvalidRecordingError(err error) bool {
+	return isError(err, ErrInvalidRecording)
+}
+
+// IsLinkForbiddenError checks if an error signals an operation
+// of a linked environment rejected by a link authorizer.
+func IsLinkForbiddenError(err error) bool {
+	return isError(err, ErrLinkForbidden)
+}
+
+// IsTypeRegistrationError checks if an error signals a
+// payload type or name which is already registered differently.
+func IsTypeRegistrationError(err error) bool {
+	return isError(err, ErrTypeRegistration)
 }
 
 // EOF
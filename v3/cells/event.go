@@ -12,10 +12,13 @@ package cells
 //--------------------
 
 import (
+	"context"
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/tideland/goas/v1/scene"
+	"github.com/tideland/goas/v2/identifier"
 	"github.com/tideland/goas/v3/errors"
 )
 
@@ -40,6 +43,39 @@ type Payload interface {
 	// Get returns one of the payload values.
 	Get(key string) (interface{}, bool)
 
+	// GetString returns a string value or the default value if
+	// the key doesn't exist. A value of another type returns the
+	// default value and an error.
+	GetString(key string, dv string) (string, error)
+
+	// GetInt returns an int value or the default value if the
+	// key doesn't exist. Other numeric types are converted, as
+	// long as they have no fraction and don't overflow.
+	GetInt(key string, dv int) (int, error)
+
+	// GetFloat64 returns a float64 value or the default value if
+	// the key doesn't exist. Other numeric types are converted.
+	GetFloat64(key string, dv float64) (float64, error)
+
+	// GetBool returns a bool value or the default value
+	// if the key doesn't exist.
+	GetBool(key string, dv bool) (bool, error)
+
+	// GetTime returns a time value or the default value if the
+	// key doesn't exist. Strings in RFC 3339 format are converted.
+	GetTime(key string, dv time.Time) (time.Time, error)
+
+	// GetDuration returns a duration value or the default value if
+	// the key doesn't exist. Integers are taken as nanoseconds and
+	// strings like "1m30s" are parsed.
+	GetDuration(key string, dv time.Duration) (time.Duration, error)
+
+	// Unmarshal sets the fields of the struct the passed pointer
+	// points to. The payload keys are the field names or set with
+	// the tag `cells:"key"`, the tag `cells:"-"` skips a field.
+	// Values are converted like with the typed getters.
+	Unmarshal(s interface{}) error
+
 	// Keys return all keys of the payload.
 	Keys() []string
 
@@ -147,6 +183,51 @@ func (p *payload) String() string {
 	return strings.Join(ps, ", ")
 }
 
+//--------------------
+// METADATA
+//--------------------
+
+// Metadata describes the origin of an event and its
+// way through the cells.
+type Metadata struct {
+	// ID identifies the event. It stays the same when
+	// the event is passed through cells.
+	ID string `json:"id"`
+
+	// Created is the time the event has been created.
+	Created time.Time `json:"created"`
+
+	// SourceID is the ID of the cell which emitted the event
+	// last. It's empty if it has been emitted from outside.
+	SourceID string `json:"source_id,omitempty"`
+
+	// CausationID is the ID of the event a cell processed
+	// when it emitted this one as a new event.
+	CausationID string `json:"causation_id,omitempty"`
+
+	// CorrelationID is the ID of the first event of a
+	// chain of caused events.
+	CorrelationID string `json:"correlation_id"`
+
+	// Hops is the number of emits by cells.
+	Hops int `json:"hops"`
+
+	// SceneID is the ID of the scene the event has been created
+	// with. It's kept when encoding the event while the scene
+	// itself is local.
+	SceneID string `json:"scene_id,omitempty"`
+}
+
+// newMetadata creates the metadata of a new event.
+func newMetadata() Metadata {
+	id := identifier.NewUUID().String()
+	return Metadata{
+		ID:            id,
+		Created:       time.Now(),
+		CorrelationID: id,
+	}
+}
+
 //--------------------
 // EVENT
 //--------------------
@@ -165,6 +246,15 @@ type Event interface {
 	// with the event.
 	Scene() scene.Scene
 
+	// Metadata returns the metadata of the event.
+	Metadata() Metadata
+
+	// Context returns the context of the event. For requests
+	// emitted with Environment.RequestContext() it's the one
+	// of the requester, so the processing behavior can check
+	// if the requester has already given up.
+	Context() context.Context
+
 	// Respond responds to a request event emitted
 	// with Environment.Request().
 	Respond(response interface{}) error
@@ -172,18 +262,55 @@ type Event interface {
 
 // event implements the Event interface.
 type event struct {
-	topic   string
-	payload Payload
-	scene   scene.Scene
+	topic     string
+	payload   Payload
+	scene     scene.Scene
+	ctx       context.Context
+	metadata  Metadata
+	responder func(response interface{}) interface{}
 }
 
 // NewEvent creates a new event with the given topic and payload.
 func NewEvent(topic string, payload interface{}, scene scene.Scene) (Event, error) {
+	return newEventContext(context.Background(), topic, payload, scene)
+}
+
+// newEventContext creates a new event with the given context.
+func newEventContext(ctx context.Context, topic string, payload interface{}, scene scene.Scene) (Event, error) {
 	if topic == "" {
 		return nil, errors.New(ErrNoTopic, errorMessages)
 	}
 	p := NewPayload(payload)
-	return &event{topic, p, scene}, nil
+	md := newMetadata()
+	if scene != nil {
+		md.SceneID = scene.ID().String()
+	}
+	return &event{topic, p, scene, ctx, md, nil}, nil
+}
+
+// emittedEvent returns a copy of the event as emitted by the cell with
+// the source ID. A new event created while the cell processed the cause
+// continues its chain. Events of other implementations are returned
+// unchanged.
+func emittedEvent(sourceID string, cause, e Event) Event {
+	ev, ok := e.(*event)
+	if !ok {
+		return e
+	}
+	md := ev.metadata
+	if cause != nil && md.SourceID == "" && md.CausationID == "" {
+		cmd := cause.Metadata()
+		if cmd.ID != md.ID {
+			md.CausationID = cmd.ID
+			md.CorrelationID = cmd.CorrelationID
+			md.Hops = cmd.Hops
+		}
+	}
+	md.SourceID = sourceID
+	md.Hops++
+	emitted := *ev
+	emitted.metadata = md
+	return &emitted
 }
 
 // Topic is specified on the Event interface.
@@ -201,6 +328,16 @@ func (e *event) Scene() scene.Scene {
 	return e.scene
 }
 
+// Metadata is specified on the Event interface.
+func (e *event) Metadata() Metadata {
+	return e.metadata
+}
+
+// Context is specified on the Event interface.
+func (e *event) Context() context.Context {
+	return e.ctx
+}
+
 // Respond is specified on the Event interface.
 func (e *event) Respond(response interface{}) error {
 	responseChanPayload, ok := e.Payload().Get(ResponseChanPayload)
@@ -211,6 +348,9 @@ func (e *event) Respond(response interface{}) error {
 	if !ok {
 		return errors.New(ErrInvalidResponseEvent, errorMessages, "invalid response channel")
 	}
+	if e.responder != nil {
+		response = e.responder(response)
+	}
 	responseChan <- response
 	return nil
 }
@@ -10,6 +10,12 @@ package cells
 var (
 	NewRingBuffer              = newRingBuffer
 	MakeLocalEventQueueFactory = makeLocalEventQueueFactory
+
+	MakeBoundedLocalEventQueueFactory = makeBoundedLocalEventQueueFactory
+	MakeDiskEventQueueFactory         = makeDiskEventQueueFactory
+	MakePriorityEventQueueFactory     = makePriorityEventQueueFactory
+
+	SupervisorBackoff = SupervisorSpec.backoff
 )
 
 // EOF
@@ -0,0 +1,85 @@
+// Tideland Go Cell Network - Cells - Subscription Filter
+//
+// Copyright (C) 2010-2015 Frank Mueller / Tideland / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package cells
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"regexp"
+	"strings"
+)
+
+//--------------------
+// SUBSCRIPTION FILTER
+//--------------------
+
+// SubscriptionFilter checks if an event emitted by a cell shall be
+// delivered to a subscriber. It's called by the emitting cell, so
+// it must not block and must not change the subscriptions.
+type SubscriptionFilter func(event Event) bool
+
+// TopicFilter returns a filter for events with one of the
+// given topics.
+func TopicFilter(topics ...string) SubscriptionFilter {
+	matches := make(map[string]bool)
+	for _, topic := range topics {
+		matches[topic] = true
+	}
+	return func(event Event) bool {
+		return matches[event.Topic()]
+	}
+}
+
+// TopicPrefixFilter returns a filter for events with topics
+// starting with the given prefix.
+func TopicPrefixFilter(prefix string) SubscriptionFilter {
+	return func(event Event) bool {
+		return strings.HasPrefix(event.Topic(), prefix)
+	}
+}
+
+// TopicPatternFilter returns a filter for events with topics matching
+// the given glob pattern. Topics are separated into parts by dots. A
+// "*" matches any characters inside of one part, a "**" also across
+// parts, and a "?" matches one character. So "order.*.created" matches
+// "order.book.created" but not "order.book.paper.created".
+func TopicPatternFilter(pattern string) SubscriptionFilter {
+	re := regexp.MustCompile(globToRegexp(pattern))
+	return func(event Event) bool {
+		return re.MatchString(event.Topic())
+	}
+}
+
+//--------------------
+// HELPERS
+//--------------------
+
+// globToRegexp translates a topic pattern into a regular expression.
+func globToRegexp(pattern string) string {
+	var expr strings.Builder
+	expr.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		switch {
+		case strings.HasPrefix(pattern[i:], "**"):
+			expr.WriteString(".*")
+			i++
+		case pattern[i] == '*':
+			expr.WriteString(`[^.]*`)
+		case pattern[i] == '?':
+			expr.WriteString(`[^.]`)
+		default:
+			expr.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		}
+	}
+	expr.WriteString("$")
+	return expr.String()
+}
+
+// EOF
@@ -0,0 +1,173 @@
+// Tideland Go Cell Network - Cells - Future
+//
+// Copyright (C) 2010-2015 Frank Mueller / Tideland / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package cells
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/tideland/goas/v1/scene"
+)
+
+//--------------------
+// FUTURE
+//--------------------
+
+// Future is the pending response of an asynchronous request.
+type Future interface {
+	// ID returns the ID of the request event. It correlates
+	// the request with the response event delivered to a
+	// requesting cell.
+	ID() string
+
+	// Done returns a channel which is closed when the response
+	// has been received or the request timed out.
+	Done() <-chan struct{}
+
+	// Response waits until the future is done and returns the
+	// response or the error.
+	Response() (interface{}, error)
+}
+
+// future implements the Future interface.
+type future struct {
+	id       string
+	done     chan struct{}
+	response interface{}
+	err      error
+}
+
+// newFuture creates a future for the request with the ID.
+func newFuture(id string) *future {
+	return &future{
+		id:   id,
+		done: make(chan struct{}),
+	}
+}
+
+// ID is specified on the Future interface.
+func (f *future) ID() string {
+	return f.id
+}
+
+// Done is specified on the Future interface.
+func (f *future) Done() <-chan struct{} {
+	return f.done
+}
+
+// Response is specified on the Future interface.
+func (f *future) Response() (interface{}, error) {
+	<-f.done
+	return f.response, f.err
+}
+
+// resolve sets the response or the error and closes
+// the done channel.
+func (f *future) resolve(response interface{}, err error) {
+	f.response = response
+	f.err = err
+	close(f.done)
+}
+
+//--------------------
+// ASYNCHRONOUS REQUEST
+//--------------------
+
+// requestAsync emits the request using the passed emit function and
+// returns a future for the response. If a deliver function is passed
+// it's called with the resolved future.
+func (env *environment) requestAsync(
+	id, topic string,
+	payload interface{},
+	scn scene.Scene,
+	timeout time.Duration,
+	emit func(ctx context.Context, id string, event Event) error,
+	deliver func(f *future),
+) (Future, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	responseChan := make(chan interface{}, 1)
+	p := NewPayload(payload).Apply(PayloadValues{ResponseChanPayload: responseChan})
+	event, err := newEventContext(ctx, topic, p, scn)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if err := emit(ctx, id, event); err != nil {
+		cancel()
+		return nil, err
+	}
+	f := newFuture(event.Metadata().ID)
+	go func() {
+		defer cancel()
+		select {
+		case response := <-responseChan:
+			if err, ok := response.(error); ok {
+				f.resolve(nil, err)
+			} else {
+				f.resolve(response, nil)
+			}
+		case <-ctx.Done():
+			op := fmt.Sprintf("request %q to %q", topic, id)
+			f.resolve(nil, newContextError(ctx, op))
+		}
+		if deliver != nil {
+			deliver(f)
+		}
+	}()
+	return f, nil
+}
+
+// deliverResponse pushes the response of an asynchronous request
+// as event with the ResponseTopic into the queue of the cell.
+func (c *cell) deliverResponse(request Event, f *future) {
+	var value interface{} = f.response
+	if f.err != nil {
+		value = f.err
+	}
+	response, err := newResponseEvent(c.id, request, value)
+	if err != nil {
+		c.logger().Error("cannot create response event", LogErrorKey, err)
+		return
+	}
+	if err := c.processEvent(response); err != nil {
+		c.logger().Warn("cannot receive response", "request", f.id, LogErrorKey, err)
+	}
+}
+
+// newResponseEvent creates an event with the ResponseTopic for the
+// response to the request. Errors are set as ResponseErrorPayload,
+// other responses as ResponsePayload.
+func newResponseEvent(sourceID string, request Event, response interface{}) (Event, error) {
+	values := PayloadValues{
+		RequestIDPayload:    request.Metadata().ID,
+		RequestTopicPayload: request.Topic(),
+	}
+	if err, ok := response.(error); ok {
+		values[ResponseErrorPayload] = err
+	} else {
+		values[ResponsePayload] = response
+	}
+	responseEvent, err := NewEvent(ResponseTopic, values, request.Scene())
+	if err != nil {
+		return nil, err
+	}
+	rmd := request.Metadata()
+	md := &responseEvent.(*event).metadata
+	md.SourceID = sourceID
+	md.CausationID = rmd.ID
+	md.CorrelationID = rmd.CorrelationID
+	md.Hops = rmd.Hops
+	return responseEvent, nil
+}
+
+// EOF
@@ -0,0 +1,72 @@
+// Tideland Go Cell Network - Cells - Gob Codec
+//
+// Copyright (C) 2010-2015 Frank Mueller / Tideland / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package cells
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"bytes"
+	"encoding/gob"
+
+	"github.com/tideland/goas/v3/errors"
+)
+
+//--------------------
+// GOB CODEC
+//--------------------
+
+// gobEvent is the gob representation of an event.
+type gobEvent struct {
+	Topic    string
+	Payload  map[string]interface{}
+	Metadata Metadata
+}
+
+// gobPayloadCodec implements the PayloadCodec interface using
+// gob. It keeps the types of the payload values, but custom
+// types have to be registered with RegisterPayloadType().
+type gobPayloadCodec struct{}
+
+// NewGobPayloadCodec creates a payload codec using gob.
+func NewGobPayloadCodec() PayloadCodec {
+	return &gobPayloadCodec{}
+}
+
+// Encode is specified on the PayloadCodec interface.
+func (c *gobPayloadCodec) Encode(event Event) ([]byte, error) {
+	values, err := encodablePayloadValues(event.Payload(), false)
+	if err != nil {
+		return nil, errors.Annotate(err, ErrEncoding, errorMessages, event)
+	}
+	ge := gobEvent{
+		Topic:    event.Topic(),
+		Payload:  values,
+		Metadata: event.Metadata(),
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(ge); err != nil {
+		return nil, errors.Annotate(err, ErrEncoding, errorMessages, event)
+	}
+	return buf.Bytes(), nil
+}
+
+// Decode is specified on the PayloadCodec interface.
+func (c *gobPayloadCodec) Decode(data []byte) (Event, error) {
+	var ge gobEvent
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&ge); err != nil {
+		return nil, errors.Annotate(err, ErrDecoding, errorMessages, err)
+	}
+	if ge.Payload == nil {
+		ge.Payload = map[string]interface{}{}
+	}
+	return decodedEvent(ge.Topic, ge.Payload, &ge.Metadata)
+}
+
+// EOF
@@ -0,0 +1,136 @@
+// Tideland Go Cell Network - Cells - Interceptor
+//
+// Copyright (C) 2010-2015 Frank Mueller / Tideland / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package cells
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"github.com/tideland/goas/v3/errors"
+)
+
+//--------------------
+// INTERCEPTOR
+//--------------------
+
+// InterceptionPoint tells where an event is intercepted.
+type InterceptionPoint int
+
+const (
+	// EmitPoint is the emitting of an event into
+	// the queue of the target cell.
+	EmitPoint InterceptionPoint = iota
+
+	// DeliveryPoint is the delivery of a queued event
+	// to the behavior of the target cell.
+	DeliveryPoint
+
+	// ResponsePoint is the response of the source cell
+	// to a request of the target cell.
+	ResponsePoint
+)
+
+// String is specified on the Stringer interface.
+func (p InterceptionPoint) String() string {
+	switch p {
+	case EmitPoint:
+		return "emit"
+	case DeliveryPoint:
+		return "delivery"
+	case ResponsePoint:
+		return "response"
+	}
+	return "unknown"
+}
+
+// Interceptor is called for each event passing an interception point.
+// The source and target are the IDs of the cells, the source is empty
+// for events emitted from the outside as well as the target for
+// responses to requests from the outside. An interceptor observes the
+// event and returns it, modifies it by returning a different one, or
+// delays it by blocking. Returning nil keeps the event, returning an
+// error rejects it. Responses are passed as events with the topic
+// cells.ResponseTopic, the payload contains the request ID and topic
+// as well as the response or the error.
+type Interceptor func(point InterceptionPoint, sourceID, targetID string, event Event) (Event, error)
+
+// intercept lets the event pass the interceptors of the
+// environment in their order.
+func (env *environment) intercept(point InterceptionPoint, sourceID, targetID string, event Event) (Event, error) {
+	for _, interceptor := range env.interceptors {
+		intercepted, err := interceptor(point, sourceID, targetID, event)
+		if err != nil {
+			return nil, errors.Annotate(err, ErrRejected, errorMessages, point, event.Topic(), targetID)
+		}
+		if intercepted != nil {
+			event = intercepted
+		}
+	}
+	return event, nil
+}
+
+// interceptEmit lets an event emitted to the cell
+// pass the interceptors.
+func (c *cell) interceptEmit(event Event) (Event, error) {
+	if len(c.env.interceptors) == 0 {
+		return event, nil
+	}
+	return c.env.intercept(EmitPoint, event.Metadata().SourceID, c.id, event)
+}
+
+// interceptDelivery lets an event delivered to the behavior pass the
+// interceptors. Rejected requests are responded with the error. The
+// responses to passed requests are intercepted too.
+func (c *cell) interceptDelivery(delivered Event) (Event, bool) {
+	if len(c.env.interceptors) == 0 {
+		return delivered, true
+	}
+	sourceID := delivered.Metadata().SourceID
+	intercepted, err := c.env.intercept(DeliveryPoint, sourceID, c.id, delivered)
+	if err != nil {
+		c.logger().Warn("cell drops rejected event", LogTopicKey, delivered.Topic(), LogErrorKey, err)
+		c.env.deadLetter(c.id, delivered, err)
+		if _, ok := delivered.Payload().Get(ResponseChanPayload); ok {
+			delivered.Respond(err)
+		}
+		return nil, false
+	}
+	ev, ok := intercepted.(*event)
+	if !ok {
+		return intercepted, true
+	}
+	if _, ok := ev.payload.Get(ResponseChanPayload); !ok {
+		return ev, true
+	}
+	responding := *ev
+	responding.responder = func(response interface{}) interface{} {
+		return c.interceptResponse(sourceID, ev, response)
+	}
+	return &responding, true
+}
+
+// interceptResponse lets the response to a request pass
+// the interceptors and returns the intercepted response.
+func (c *cell) interceptResponse(targetID string, request Event, response interface{}) interface{} {
+	event, err := newResponseEvent(c.id, request, response)
+	if err != nil {
+		return err
+	}
+	intercepted, err := c.env.intercept(ResponsePoint, c.id, targetID, event)
+	if err != nil {
+		return err
+	}
+	if err, ok := intercepted.Payload().Get(ResponseErrorPayload); ok {
+		return err
+	}
+	response, _ = intercepted.Payload().Get(ResponsePayload)
+	return response
+}
+
+// EOF
@@ -0,0 +1,170 @@
+// Tideland Go Cell Network - Cells - Logging
+//
+// Copyright (C) 2010-2015 Frank Mueller / Tideland / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package cells
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+
+	"github.com/tideland/goas/v2/logger"
+)
+
+//--------------------
+// CONSTANTS
+//--------------------
+
+const (
+	// Keys of the structured log attributes.
+	LogEnvironmentKey = "environment"
+	LogCellKey        = "cell"
+	LogBehaviorKey    = "behavior"
+	LogTopicKey       = "topic"
+	LogErrorKey       = "error"
+)
+
+//--------------------
+// LEVEL HANDLER
+//--------------------
+
+// levelHandler filters the records of a handler by a level.
+type levelHandler struct {
+	level   slog.Leveler
+	handler slog.Handler
+}
+
+// Enabled is specified on the slog.Handler interface.
+func (h *levelHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	if h.level != nil && level < h.level.Level() {
+		return false
+	}
+	return h.handler.Enabled(ctx, level)
+}
+
+// Handle is specified on the slog.Handler interface.
+func (h *levelHandler) Handle(ctx context.Context, r slog.Record) error {
+	return h.handler.Handle(ctx, r)
+}
+
+// WithAttrs is specified on the slog.Handler interface.
+func (h *levelHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &levelHandler{h.level, h.handler.WithAttrs(attrs)}
+}
+
+// WithGroup is specified on the slog.Handler interface.
+func (h *levelHandler) WithGroup(name string) slog.Handler {
+	return &levelHandler{h.level, h.handler.WithGroup(name)}
+}
+
+//--------------------
+// GOAS HANDLER
+//--------------------
+
+// goasHandler is the default handler writing the records
+// as text to the goas logger.
+type goasHandler struct {
+	attrs []slog.Attr
+	group string
+}
+
+// Enabled is specified on the slog.Handler interface.
+func (h *goasHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return true
+}
+
+// Handle is specified on the slog.Handler interface.
+func (h *goasHandler) Handle(ctx context.Context, r slog.Record) error {
+	var buf bytes.Buffer
+	buf.WriteString(r.Message)
+	for _, attr := range h.attrs {
+		fmt.Fprintf(&buf, " %s=%q", attr.Key, attr.Value.String())
+	}
+	r.Attrs(func(attr slog.Attr) bool {
+		key := attr.Key
+		if h.group != "" {
+			key = h.group + "." + key
+		}
+		fmt.Fprintf(&buf, " %s=%q", key, attr.Value.String())
+		return true
+	})
+	switch {
+	case r.Level >= slog.LevelError:
+		logger.Errorf("%s", buf.String())
+	case r.Level >= slog.LevelWarn:
+		logger.Warningf("%s", buf.String())
+	case r.Level >= slog.LevelInfo:
+		logger.Infof("%s", buf.String())
+	default:
+		logger.Debugf("%s", buf.String())
+	}
+	return nil
+}
+
+// WithAttrs is specified on the slog.Handler interface.
+func (h *goasHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	all := make([]slog.Attr, 0, len(h.attrs)+len(attrs))
+	all = append(all, h.attrs...)
+	for _, attr := range attrs {
+		if h.group != "" {
+			attr.Key = h.group + "." + attr.Key
+		}
+		all = append(all, attr)
+	}
+	return &goasHandler{all, h.group}
+}
+
+// WithGroup is specified on the slog.Handler interface.
+func (h *goasHandler) WithGroup(name string) slog.Handler {
+	if h.group != "" {
+		name = h.group + "." + name
+	}
+	return &goasHandler{h.attrs, name}
+}
+
+//--------------------
+// HELPERS
+//--------------------
+
+// newLogger creates the logger of the environment.
+func newLogger(env *environment) *slog.Logger {
+	handler := env.logHandler
+	if handler == nil {
+		handler = &goasHandler{}
+	}
+	if env.logLevel != nil {
+		handler = &levelHandler{env.logLevel, handler}
+	}
+	return slog.New(handler).With(LogEnvironmentKey, env.id)
+}
+
+// loggerOf returns the logger of the environment, e.g. for
+// queues created by a factory. Without environment the
+// default handler is used.
+func loggerOf(env Environment) *slog.Logger {
+	switch e := env.(type) {
+	case *environment:
+		return e.log
+	case *cellEnvironment:
+		return e.log
+	case nil:
+		return slog.New(&goasHandler{})
+	}
+	return slog.New(&goasHandler{}).With(LogEnvironmentKey, env.ID())
+}
+
+// behaviorType returns the type name of the behavior.
+func behaviorType(behavior Behavior) string {
+	return fmt.Sprintf("%T", behavior)
+}
+
+// EOF
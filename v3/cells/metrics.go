@@ -0,0 +1,338 @@
+// Tideland Go Cell Network - Cells - Metrics
+//
+// Copyright (C) 2010-2015 Frank Mueller / Tideland / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package cells
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"bufio"
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+//--------------------
+// CONSTANTS
+//--------------------
+
+const (
+	// DefaultMetricsTopics is the default maximum number of
+	// topics with own metrics per cell.
+	DefaultMetricsTopics = 100
+
+	// OtherMetricsTopic is the topic the metrics of further
+	// topics are collected with.
+	OtherMetricsTopic = "_other"
+)
+
+// LatencyBounds are the upper bounds of the buckets of the
+// processing latency histograms in seconds.
+var LatencyBounds = []float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5}
+
+//--------------------
+// METRICS
+//--------------------
+
+// Histogram contains the distribution of processing latencies.
+type Histogram struct {
+	// Bounds are the upper bounds of the buckets in seconds.
+	Bounds []float64
+
+	// Counts are the cumulative counts of the buckets.
+	Counts []int64
+
+	// Count is the total number of observations.
+	Count int64
+
+	// Sum is the sum of all observations in seconds.
+	Sum float64
+}
+
+// TopicMetrics contains the metrics of a cell for one topic.
+type TopicMetrics struct {
+	// Processed is the number of processed events.
+	Processed int64
+
+	// EmitErrors is the number of failed emits by the cell
+	// while processing events with the topic.
+	EmitErrors int64
+
+	// Latency is the histogram of the processing latencies.
+	Latency Histogram
+}
+
+// CellMetrics contains the metrics of one cell.
+type CellMetrics struct {
+	// ID is the ID of the cell.
+	ID string
+
+	// Behavior is the type name of the behavior.
+	Behavior string
+
+	// QueueLen is the number of queued events, -1 if
+	// the queue cannot report it.
+	QueueLen int
+
+	// Recoveries is the number of recoveries after panics.
+	Recoveries int64
+
+	// Topics maps the topics to their metrics.
+	Topics map[string]TopicMetrics
+}
+
+// Metrics is a snapshot of the metrics of the cells of an environment.
+type Metrics struct {
+	// EnvironmentID is the ID of the environment.
+	EnvironmentID string
+
+	// Cells are the metrics of the cells sorted by ID.
+	Cells []CellMetrics
+}
+
+// newMetrics creates a snapshot of the metrics of the environment.
+func newMetrics(env *environment) Metrics {
+	m := Metrics{
+		EnvironmentID: env.ID(),
+		Cells:         []CellMetrics{},
+	}
+	for _, c := range env.cells.all() {
+		m.Cells = append(m.Cells, c.metrics.snapshot(c))
+	}
+	sort.Slice(m.Cells, func(i, j int) bool { return m.Cells[i].ID < m.Cells[j].ID })
+	return m
+}
+
+//--------------------
+// CELL METRICS
+//--------------------
+
+// topicCounters collects the metrics of a cell for one topic.
+type topicCounters struct {
+	processed  int64
+	emitErrors int64
+	buckets    []int64
+	sum        time.Duration
+}
+
+// cellCounters collects the metrics of a cell.
+type cellCounters struct {
+	mux        sync.Mutex
+	recoveries int64
+	limit      int
+	normalize  func(topic string) string
+	named      int
+	topics     map[string]*topicCounters
+}
+
+// newCellCounters creates the metrics collector of a cell
+// with own metrics for at most limit normalized topics.
+func newCellCounters(limit int, normalize func(topic string) string) *cellCounters {
+	return &cellCounters{
+		limit:     limit,
+		normalize: normalize,
+		topics:    make(map[string]*topicCounters),
+	}
+}
+
+// topic returns the counters of the topic. Topics exceeding
+// the limit share the counters of the OtherMetricsTopic. It
+// has to be called with a locked mutex.
+func (cc *cellCounters) topic(topic string) *topicCounters {
+	if cc.normalize != nil {
+		topic = cc.normalize(topic)
+	}
+	if _, ok := cc.topics[topic]; !ok && topic != OtherMetricsTopic {
+		if cc.named >= cc.limit {
+			topic = OtherMetricsTopic
+		} else {
+			cc.named++
+		}
+	}
+	tc, ok := cc.topics[topic]
+	if !ok {
+		tc = &topicCounters{
+			buckets: make([]int64, len(LatencyBounds)+1),
+		}
+		cc.topics[topic] = tc
+	}
+	return tc
+}
+
+// processed counts a processed event and its latency.
+func (cc *cellCounters) processed(topic string, latency time.Duration) {
+	cc.mux.Lock()
+	defer cc.mux.Unlock()
+	tc := cc.topic(topic)
+	tc.processed++
+	tc.sum += latency
+	seconds := latency.Seconds()
+	bucket := sort.SearchFloat64s(LatencyBounds, seconds)
+	tc.buckets[bucket]++
+}
+
+// emitError counts a failed emit while processing
+// an event with the topic.
+func (cc *cellCounters) emitError(topic string) {
+	cc.mux.Lock()
+	defer cc.mux.Unlock()
+	cc.topic(topic).emitErrors++
+}
+
+// recovered counts a recovery.
+func (cc *cellCounters) recovered() {
+	cc.mux.Lock()
+	defer cc.mux.Unlock()
+	cc.recoveries++
+}
+
+// snapshot returns the metrics of the cell.
+func (cc *cellCounters) snapshot(c *cell) CellMetrics {
+	info := newCellInfo(c)
+	cm := CellMetrics{
+		ID:       c.id,
+		Behavior: info.Behavior,
+		QueueLen: info.QueueLen,
+		Topics:   make(map[string]TopicMetrics),
+	}
+	cc.mux.Lock()
+	defer cc.mux.Unlock()
+	cm.Recoveries = cc.recoveries
+	for topic, tc := range cc.topics {
+		h := Histogram{
+			Bounds: LatencyBounds,
+			Counts: make([]int64, len(LatencyBounds)),
+			Count:  tc.processed,
+			Sum:    tc.sum.Seconds(),
+		}
+		var cumulative int64
+		for i := range LatencyBounds {
+			cumulative += tc.buckets[i]
+			h.Counts[i] = cumulative
+		}
+		cm.Topics[topic] = TopicMetrics{
+			Processed:  tc.processed,
+			EmitErrors: tc.emitErrors,
+			Latency:    h,
+		}
+	}
+	return cm
+}
+
+// countEmitError counts a failed emit of the cell
+// while it's processing an event.
+func (c *cell) countEmitError(err error) {
+	if err == nil {
+		return
+	}
+	topic := ""
+	if current := c.currentEvent(); current != nil {
+		topic = current.Topic()
+	}
+	c.metrics.emitError(topic)
+}
+
+//--------------------
+// EXPORT
+//--------------------
+
+// NewMetricsHandler returns a handler writing the metrics of the
+// environment in the Prometheus text format. The metrics are labeled
+// with the environment ID, the cell ID, the behavior type, and the
+// topic. The number of topics per cell is limited, see the option
+// MetricsTopics().
+func NewMetricsHandler(env Environment) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		env.Metrics().WritePrometheus(w)
+	})
+}
+
+// PublishMetrics publishes the metrics of the environment with
+// the name "cells.<environment ID>" through expvar. Publishing
+// the same environment again does nothing.
+func PublishMetrics(env Environment) {
+	name := "cells." + env.ID()
+	if expvar.Get(name) != nil {
+		return
+	}
+	expvar.Publish(name, expvar.Func(func() interface{} {
+		return env.Metrics()
+	}))
+}
+
+// WritePrometheus writes the metrics in the Prometheus text format.
+func (m Metrics) WritePrometheus(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	type family struct {
+		name string
+		kind string
+		help string
+	}
+	families := []family{
+		{"cells_events_processed_total", "counter", "Number of events processed by a cell."},
+		{"cells_event_processing_seconds", "histogram", "Processing latency of events by a cell."},
+		{"cells_emit_errors_total", "counter", "Number of failed emits of a cell."},
+		{"cells_queue_length", "gauge", "Number of events queued for a cell."},
+		{"cells_recoveries_total", "counter", "Number of recoveries of a cell."},
+	}
+	for _, f := range families {
+		fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.kind)
+		for _, cm := range m.Cells {
+			labels := fmt.Sprintf("environment=%s,cell=%s,behavior=%s",
+				promLabel(m.EnvironmentID), promLabel(cm.ID), promLabel(cm.Behavior))
+			switch f.name {
+			case "cells_queue_length":
+				if cm.QueueLen >= 0 {
+					fmt.Fprintf(bw, "%s{%s} %d\n", f.name, labels, cm.QueueLen)
+				}
+				continue
+			case "cells_recoveries_total":
+				fmt.Fprintf(bw, "%s{%s} %d\n", f.name, labels, cm.Recoveries)
+				continue
+			}
+			topics := []string{}
+			for topic := range cm.Topics {
+				topics = append(topics, topic)
+			}
+			sort.Strings(topics)
+			for _, topic := range topics {
+				tm := cm.Topics[topic]
+				tlabels := labels + ",topic=" + promLabel(topic)
+				switch f.name {
+				case "cells_events_processed_total":
+					fmt.Fprintf(bw, "%s{%s} %d\n", f.name, tlabels, tm.Processed)
+				case "cells_emit_errors_total":
+					fmt.Fprintf(bw, "%s{%s} %d\n", f.name, tlabels, tm.EmitErrors)
+				case "cells_event_processing_seconds":
+					h := tm.Latency
+					for i, bound := range h.Bounds {
+						fmt.Fprintf(bw, "%s_bucket{%s,le=\"%g\"} %d\n", f.name, tlabels, bound, h.Counts[i])
+					}
+					fmt.Fprintf(bw, "%s_bucket{%s,le=\"+Inf\"} %d\n", f.name, tlabels, h.Count)
+					fmt.Fprintf(bw, "%s_sum{%s} %g\n", f.name, tlabels, h.Sum)
+					fmt.Fprintf(bw, "%s_count{%s} %d\n", f.name, tlabels, h.Count)
+				}
+			}
+		}
+	}
+	return bw.Flush()
+}
+
+// promLabel returns the quoted and escaped label value.
+func promLabel(value string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value) + `"`
+}
+
+// EOF
@@ -0,0 +1,458 @@
+// Tideland Go Cell Network - Cells - MessagePack Codec
+//
+// Copyright (C) 2010-2015 Frank Mueller / Tideland / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package cells
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/tideland/goas/v3/errors"
+)
+
+//--------------------
+// MESSAGEPACK CODEC
+//--------------------
+
+// msgPackPayloadCodec implements the PayloadCodec interface using
+// MessagePack. Integers are decoded as int64, floats as float64.
+// Values of registered types are restored, other values are
+// encoded in their generic JSON representation.
+type msgPackPayloadCodec struct{}
+
+// NewMsgPackPayloadCodec creates a payload codec using MessagePack.
+func NewMsgPackPayloadCodec() PayloadCodec {
+	return &msgPackPayloadCodec{}
+}
+
+// Encode is specified on the PayloadCodec interface.
+func (c *msgPackPayloadCodec) Encode(event Event) ([]byte, error) {
+	values, err := encodablePayloadValues(event.Payload(), true)
+	if err != nil {
+		return nil, errors.Annotate(err, ErrEncoding, errorMessages, event)
+	}
+	md := event.Metadata()
+	me := map[string]interface{}{
+		"topic":   event.Topic(),
+		"payload": values,
+		"metadata": map[string]interface{}{
+			"id":             md.ID,
+			"created":        md.Created.UnixNano(),
+			"source_id":      md.SourceID,
+			"causation_id":   md.CausationID,
+			"correlation_id": md.CorrelationID,
+			"hops":           md.Hops,
+			"scene_id":       md.SceneID,
+		},
+	}
+	var enc msgPackEncoder
+	if err := enc.encode(me); err != nil {
+		return nil, errors.Annotate(err, ErrEncoding, errorMessages, event)
+	}
+	return enc.buf.Bytes(), nil
+}
+
+// Decode is specified on the PayloadCodec interface.
+func (c *msgPackPayloadCodec) Decode(data []byte) (Event, error) {
+	dec := msgPackDecoder{data: data}
+	value, err := dec.decode()
+	if err != nil {
+		return nil, errors.Annotate(err, ErrDecoding, errorMessages, err)
+	}
+	me, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, errors.New(ErrDecoding, errorMessages, "no event map")
+	}
+	topic, _ := me["topic"].(string)
+	values, _ := me["payload"].(map[string]interface{})
+	if values == nil {
+		values = map[string]interface{}{}
+	}
+	var md *Metadata
+	if mm, ok := me["metadata"].(map[string]interface{}); ok {
+		md = &Metadata{}
+		md.ID, _ = mm["id"].(string)
+		md.SourceID, _ = mm["source_id"].(string)
+		md.CausationID, _ = mm["causation_id"].(string)
+		md.CorrelationID, _ = mm["correlation_id"].(string)
+		md.SceneID, _ = mm["scene_id"].(string)
+		if created, ok := mm["created"].(int64); ok {
+			md.Created = time.Unix(0, created)
+		}
+		if hops, ok := mm["hops"].(int64); ok {
+			md.Hops = int(hops)
+		}
+	}
+	return decodedEvent(topic, values, md)
+}
+
+//--------------------
+// ENCODER
+//--------------------
+
+// msgPackEncoder writes values in the MessagePack format.
+type msgPackEncoder struct {
+	buf bytes.Buffer
+}
+
+// encode writes one value.
+func (e *msgPackEncoder) encode(value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		e.buf.WriteByte(0xc0)
+	case bool:
+		if v {
+			e.buf.WriteByte(0xc3)
+		} else {
+			e.buf.WriteByte(0xc2)
+		}
+	case int:
+		e.encodeInt(int64(v))
+	case int8:
+		e.encodeInt(int64(v))
+	case int16:
+		e.encodeInt(int64(v))
+	case int32:
+		e.encodeInt(int64(v))
+	case int64:
+		e.encodeInt(v)
+	case uint:
+		e.encodeUint(uint64(v))
+	case uint8:
+		e.encodeUint(uint64(v))
+	case uint16:
+		e.encodeUint(uint64(v))
+	case uint32:
+		e.encodeUint(uint64(v))
+	case uint64:
+		e.encodeUint(v)
+	case float32:
+		e.buf.WriteByte(0xca)
+		e.write(uint64(math.Float32bits(v)), 4)
+	case float64:
+		e.buf.WriteByte(0xcb)
+		e.write(math.Float64bits(v), 8)
+	case string:
+		e.encodeString(v)
+	case []byte:
+		e.encodeHeader(len(v), 0, 0xc4, 0xc5, 0xc6)
+		e.buf.Write(v)
+	case []interface{}:
+		e.encodeHeader(len(v), 0x90, 0, 0xdc, 0xdd)
+		for _, item := range v {
+			if err := e.encode(item); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		e.encodeHeader(len(v), 0x80, 0, 0xde, 0xdf)
+		for _, key := range keys {
+			e.encodeString(key)
+			if err := e.encode(v[key]); err != nil {
+				return err
+			}
+		}
+	case PayloadValues:
+		return e.encode(map[string]interface{}(v))
+	default:
+		generic, err := genericValue(value)
+		if err != nil {
+			return err
+		}
+		return e.encode(generic)
+	}
+	return nil
+}
+
+// encodeInt writes a signed integer in the shortest format.
+func (e *msgPackEncoder) encodeInt(v int64) {
+	switch {
+	case v >= 0:
+		e.encodeUint(uint64(v))
+	case v >= -32:
+		e.buf.WriteByte(byte(v))
+	case v >= math.MinInt8:
+		e.buf.WriteByte(0xd0)
+		e.write(uint64(v), 1)
+	case v >= math.MinInt16:
+		e.buf.WriteByte(0xd1)
+		e.write(uint64(v), 2)
+	case v >= math.MinInt32:
+		e.buf.WriteByte(0xd2)
+		e.write(uint64(v), 4)
+	default:
+		e.buf.WriteByte(0xd3)
+		e.write(uint64(v), 8)
+	}
+}
+
+// encodeUint writes an unsigned integer in the shortest format.
+func (e *msgPackEncoder) encodeUint(v uint64) {
+	switch {
+	case v < 128:
+		e.buf.WriteByte(byte(v))
+	case v <= math.MaxUint8:
+		e.buf.WriteByte(0xcc)
+		e.write(v, 1)
+	case v <= math.MaxUint16:
+		e.buf.WriteByte(0xcd)
+		e.write(v, 2)
+	case v <= math.MaxUint32:
+		e.buf.WriteByte(0xce)
+		e.write(v, 4)
+	default:
+		e.buf.WriteByte(0xcf)
+		e.write(v, 8)
+	}
+}
+
+// encodeString writes a string.
+func (e *msgPackEncoder) encodeString(s string) {
+	if len(s) < 32 {
+		e.buf.WriteByte(0xa0 | byte(len(s)))
+	} else {
+		e.encodeHeader(len(s), 0, 0xd9, 0xda, 0xdb)
+	}
+	e.buf.WriteString(s)
+}
+
+// encodeHeader writes the header of a container with the length n.
+// The fix code is used for short ones if it's not 0, otherwise the
+// 8, 16, or 32 bit codes. A 0 code skips this size.
+func (e *msgPackEncoder) encodeHeader(n int, fix, code8, code16, code32 byte) {
+	switch {
+	case fix != 0 && n < 16:
+		e.buf.WriteByte(fix | byte(n))
+	case code8 != 0 && n <= math.MaxUint8:
+		e.buf.WriteByte(code8)
+		e.write(uint64(n), 1)
+	case n <= math.MaxUint16:
+		e.buf.WriteByte(code16)
+		e.write(uint64(n), 2)
+	default:
+		e.buf.WriteByte(code32)
+		e.write(uint64(n), 4)
+	}
+}
+
+// write writes the size lowest bytes of v in big endian order.
+func (e *msgPackEncoder) write(v uint64, size int) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], v)
+	e.buf.Write(b[8-size:])
+}
+
+//--------------------
+// DECODER
+//--------------------
+
+// msgPackMaxDepth limits the nesting of arrays and maps like
+// encoding/json does, so that crafted data can't exhaust the stack.
+const msgPackMaxDepth = 10000
+
+// msgPackDecoder reads values in the MessagePack format.
+type msgPackDecoder struct {
+	data  []byte
+	pos   int
+	depth int
+}
+
+// decode reads the next value.
+func (d *msgPackDecoder) decode() (interface{}, error) {
+	code, err := d.read(1)
+	if err != nil {
+		return nil, err
+	}
+	c := code[0]
+	switch {
+	case c <= 0x7f:
+		return int64(c), nil
+	case c >= 0xe0:
+		return int64(int8(c)), nil
+	case c&0xf0 == 0x80:
+		return d.decodeMap(int(c & 0x0f))
+	case c&0xf0 == 0x90:
+		return d.decodeArray(int(c & 0x0f))
+	case c&0xe0 == 0xa0:
+		return d.decodeString(int(c & 0x1f))
+	}
+	switch c {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xc5, 0xc6:
+		n, err := d.readUint(1 << (c - 0xc4))
+		if err != nil {
+			return nil, err
+		}
+		b, err := d.read(int(n))
+		if err != nil {
+			return nil, err
+		}
+		return append([]byte{}, b...), nil
+	case 0xca:
+		v, err := d.readUint(4)
+		return float64(math.Float32frombits(uint32(v))), err
+	case 0xcb:
+		v, err := d.readUint(8)
+		return math.Float64frombits(v), err
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		v, err := d.readUint(1 << (c - 0xcc))
+		if err != nil {
+			return nil, err
+		}
+		if v > math.MaxInt64 {
+			return v, nil
+		}
+		return int64(v), nil
+	case 0xd0:
+		v, err := d.readUint(1)
+		return int64(int8(v)), err
+	case 0xd1:
+		v, err := d.readUint(2)
+		return int64(int16(v)), err
+	case 0xd2:
+		v, err := d.readUint(4)
+		return int64(int32(v)), err
+	case 0xd3:
+		v, err := d.readUint(8)
+		return int64(v), err
+	case 0xd9, 0xda, 0xdb:
+		n, err := d.readUint(1 << (c - 0xd9))
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeString(int(n))
+	case 0xdc, 0xdd:
+		n, err := d.readUint(2 << (c - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeArray(int(n))
+	case 0xde, 0xdf:
+		n, err := d.readUint(2 << (c - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeMap(int(n))
+	}
+	return nil, fmt.Errorf("unsupported MessagePack code 0x%02x", c)
+}
+
+// decodeString reads a string with n bytes.
+func (d *msgPackDecoder) decodeString(n int) (interface{}, error) {
+	b, err := d.read(n)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+// decodeArray reads an array with n values.
+func (d *msgPackDecoder) decodeArray(n int) (interface{}, error) {
+	if err := d.nest(); err != nil {
+		return nil, err
+	}
+	defer d.unnest()
+	// Each value needs at least one byte.
+	if n > len(d.data)-d.pos {
+		return nil, fmt.Errorf("MessagePack array of %d values exceeds data", n)
+	}
+	values := make([]interface{}, n)
+	for i := range values {
+		value, err := d.decode()
+		if err != nil {
+			return nil, err
+		}
+		values[i] = value
+	}
+	return values, nil
+}
+
+// decodeMap reads a map with n string keys and their values.
+func (d *msgPackDecoder) decodeMap(n int) (interface{}, error) {
+	if err := d.nest(); err != nil {
+		return nil, err
+	}
+	defer d.unnest()
+	// Each key and value need at least one byte.
+	if n > (len(d.data)-d.pos)/2 {
+		return nil, fmt.Errorf("MessagePack map of %d entries exceeds data", n)
+	}
+	values := make(map[string]interface{}, n)
+	for i := 0; i < n; i++ {
+		key, err := d.decode()
+		if err != nil {
+			return nil, err
+		}
+		skey, ok := key.(string)
+		if !ok {
+			return nil, fmt.Errorf("invalid MessagePack map key %v", key)
+		}
+		value, err := d.decode()
+		if err != nil {
+			return nil, err
+		}
+		values[skey] = value
+	}
+	return values, nil
+}
+
+// nest enters an array or map and checks the nesting depth.
+func (d *msgPackDecoder) nest() error {
+	if d.depth >= msgPackMaxDepth {
+		return fmt.Errorf("MessagePack data nested deeper than %d", msgPackMaxDepth)
+	}
+	d.depth++
+	return nil
+}
+
+// unnest leaves an array or map.
+func (d *msgPackDecoder) unnest() {
+	d.depth--
+}
+
+// readUint reads an unsigned big endian integer with size bytes.
+func (d *msgPackDecoder) readUint(size int) (uint64, error) {
+	b, err := d.read(size)
+	if err != nil {
+		return 0, err
+	}
+	var v uint64
+	for _, x := range b {
+		v = v<<8 | uint64(x)
+	}
+	return v, nil
+}
+
+// read returns the next n bytes.
+func (d *msgPackDecoder) read(n int) ([]byte, error) {
+	if n < 0 || d.pos+n > len(d.data) {
+		return nil, fmt.Errorf("unexpected end of MessagePack data")
+	}
+	b := d.data[d.pos : d.pos+n]
+	d.pos += n
+	return b, nil
+}
+
+// EOF
@@ -12,11 +12,14 @@ package cells
 //--------------------
 
 import (
+	"log/slog"
+	"time"
+
 	"github.com/tideland/goas/v2/identifier"
 )
 
 //--------------------
-// OPTIONS
+// ENVIRONMENT OPTIONS
 //--------------------
 
 // Option allows to set an option of the environment.
@@ -56,7 +59,231 @@ func LocalQueueFactory(size int) Option {
 		if size < 5 {
 			size = 5
 		}
-		QueueFactory(makeLocalEventQueueFactory(size))
+		QueueFactory(makeLocalEventQueueFactory(size))(env)
+	}
+}
+
+// BoundedLocalQueueFactory is the option to set the queue factory
+// of the environment to create local event queues holding at most
+// capacity events. The policy defines what happens when an event is
+// pushed into a full queue, the timeout is only used by the policy
+// OverflowBlockTimeout.
+func BoundedLocalQueueFactory(capacity int, policy OverflowPolicy, timeout time.Duration) Option {
+	return func(env Environment) {
+		if capacity < 1 {
+			capacity = 1
+		}
+		if timeout <= 0 {
+			timeout = DefaultTimeout
+		}
+		QueueFactory(makeBoundedLocalEventQueueFactory(10, capacity, policy, timeout))(env)
+	}
+}
+
+// PriorityQueueFactory is the option to set the queue factory of
+// the environment to create priority event queues. Events with a
+// higher priority are delivered first, those with the same priority
+// in FIFO order. The priority is taken from the payload value
+// cells.PriorityPayload, otherwise from the topic priorities, and
+// defaults to 0. The priority of waiting events raises by one per
+// aging duration, so that low priority events don't starve. An
+// aging of 0 disables it.
+func PriorityQueueFactory(priorities map[string]int, aging time.Duration) Option {
+	return func(env Environment) {
+		tps := make(map[string]int)
+		for topic, priority := range priorities {
+			tps[topic] = priority
+		}
+		QueueFactory(makePriorityEventQueueFactory(tps, aging))(env)
+	}
+}
+
+// DiskQueueFactory is the option to set the queue factory of the
+// environment to create durable event queues. Each cell gets an own
+// segment log in a subdirectory of dir named by its ID. So when a
+// cell with the same ID is started again it receives the events not
+// processed before. The codec is used for the encoding of the events,
+// default is JSON. The sync policy controls the flushing to disk,
+// segments are started after segmentSize bytes.
+func DiskQueueFactory(dir string, codec PayloadCodec, syncPolicy SyncPolicy, segmentSize int64) Option {
+	return func(env Environment) {
+		if codec == nil {
+			codec = NewJSONPayloadCodec()
+		}
+		if segmentSize <= 0 {
+			segmentSize = DefaultSegmentSize
+		}
+		QueueFactory(makeDiskEventQueueFactory(dir, codec, syncPolicy, segmentSize))(env)
+	}
+}
+
+// ErrorCell is the option to set the ID of the cell receiving the
+// events about recoverings and failures of cells. They have the
+// topics cells.RecoveringTopic and cells.FailedTopic, the payload
+// contains the cell ID and the reason. In case of panics it also
+// contains the stack trace of the panic, errors returned by the
+// behavior have no stack.
+func ErrorCell(id string) Option {
+	return func(env Environment) {
+		e := env.(*environment)
+		e.errorCellID = id
+	}
+}
+
+// DeadLetterCell is the option to set the ID of the cell receiving
+// the events which couldn't be delivered, e.g. because the target
+// cell doesn't exist, its queue is stopping, or its behavior failed
+// processing them. They have the topic cells.DeadLetterTopic, the
+// payload contains the event, the reason, the ID of the intended
+// target cell, and the ID of the source cell. The events don't
+// contain the response channels of requests, so the dead-letter
+// cell can also use a persistent queue like the disk queue.
+func DeadLetterCell(id string) Option {
+	return func(env Environment) {
+		e := env.(*environment)
+		e.deadLetterCellID = id
+	}
+}
+
+// MaxHops sets the maximum number of emits by cells an event
+// may pass. Events exceeding it are logged and passed to the
+// dead-letter cell instead of being emitted, so loops in the
+// topology are stopped while the emitting cells keep working.
+// Requests exceeding it fail at once with an error signaled by
+// IsMaxHopsError(). Default is 0, meaning no limit.
+func MaxHops(hops int) Option {
+	return func(env Environment) {
+		e := env.(*environment)
+		e.maxHops = hops
+	}
+}
+
+// Heartbeat sets the interval of the heartbeats of links. A link
+// not receiving anything for three intervals is seen as broken.
+// Default is cells.DefaultHeartbeat.
+func Heartbeat(interval time.Duration) Option {
+	return func(env Environment) {
+		e := env.(*environment)
+		if interval > 0 {
+			e.heartbeat = interval
+		}
+	}
+}
+
+// TransportCodec sets the codec used for the events transported
+// by links. Both sides of a link have to use the same one. Default
+// is cells.NewJSONPayloadCodec().
+func TransportCodec(codec PayloadCodec) Option {
+	return func(env Environment) {
+		e := env.(*environment)
+		if codec != nil {
+			e.transportCodec = codec
+		}
+	}
+}
+
+// Interceptors adds interceptors to the environment. They are called
+// in the order they are added for each event emitted to a cell, for
+// each event delivered to a behavior, and for each response to a
+// request.
+func Interceptors(interceptors ...Interceptor) Option {
+	return func(env Environment) {
+		e := env.(*environment)
+		e.interceptors = append(e.interceptors, interceptors...)
+	}
+}
+
+// MetricsTopics sets the maximum number of topics with own metrics
+// per cell, default is DefaultMetricsTopics. The metrics of further
+// topics are collected with the OtherMetricsTopic, with a limit of 0
+// or less those of all topics. The optional normalizer maps topics
+// before, e.g. to remove IDs contained in them.
+func MetricsTopics(limit int, normalize func(topic string) string) Option {
+	return func(env Environment) {
+		e := env.(*environment)
+		e.metricsTopics = limit
+		e.normalizeTopic = normalize
+	}
+}
+
+// Snapshots sets the store for the snapshots of the behaviors
+// implementing the Snapshotter. With an interval greater than 0
+// all cells are snapshotted periodically, otherwise only on
+// demand and when they are stopped.
+func Snapshots(store SnapshotStore, interval time.Duration) Option {
+	return func(env Environment) {
+		e := env.(*environment)
+		e.snapshotStore = store
+		e.snapshotInterval = interval
+	}
+}
+
+// SnapshotDirectory sets a store writing the snapshots of the
+// behaviors into files of the directory, see Snapshots().
+func SnapshotDirectory(dir string, interval time.Duration) Option {
+	return Snapshots(NewDirectorySnapshotStore(dir), interval)
+}
+
+// Recording sets the recorder of the events emitted to the cells.
+// They can be replayed into another environment with a Replayer.
+func Recording(recorder *Recorder) Option {
+	return func(env Environment) {
+		e := env.(*environment)
+		e.recorder = recorder
+	}
+}
+
+// Logger sets the handler for the structured logging of the
+// environment. All records contain the environment ID, those of
+// cells also the cell ID and the behavior type. Default is a
+// handler writing to the goas logger.
+func Logger(handler slog.Handler) Option {
+	return func(env Environment) {
+		e := env.(*environment)
+		e.logHandler = handler
+	}
+}
+
+// LogLevel sets the minimum level of the records logged by the
+// environment. Passing a *slog.LevelVar allows to change it at
+// runtime. Default is to let the handler decide.
+func LogLevel(level slog.Leveler) Option {
+	return func(env Environment) {
+		e := env.(*environment)
+		e.logLevel = level
+	}
+}
+
+//--------------------
+// CELL OPTIONS
+//--------------------
+
+// CellOption allows to set an option of a cell when starting it.
+type CellOption func(ctx Context)
+
+// RecoveryPolicy is the option to set how often a cell may recover
+// after a panic. If maxRecoveries happen inside the window the cell
+// fails. Otherwise it waits for the backoff before continuing. The
+// default is 12 recoveries per minute without backoff. Less than one
+// recovery is set to one, a window of zero or less to the default
+// one minute, and a negative backoff to none.
+func RecoveryPolicy(maxRecoveries int, window, backoff time.Duration) CellOption {
+	return func(ctx Context) {
+		c := ctx.(*cell)
+		if maxRecoveries < 1 {
+			maxRecoveries = 1
+		}
+		if window <= 0 {
+			window = time.Minute
+		}
+		if backoff < 0 {
+			backoff = 0
+		}
+		c.recovery = recoveryPolicy{
+			maxRecoveries: maxRecoveries,
+			window:        window,
+			backoff:       backoff,
+		}
 	}
 }
 
@@ -0,0 +1,320 @@
+// Tideland Go Cell Network - Cells - Payload Accessors
+//
+// Copyright (C) 2010-2015 Frank Mueller / Tideland / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package cells
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"math"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/tideland/goas/v3/errors"
+)
+
+//--------------------
+// CONSTANTS
+//--------------------
+
+// payloadTag is the tag of struct fields naming the
+// payload key of the field.
+const payloadTag = "cells"
+
+//--------------------
+// TYPED ACCESSORS
+//--------------------
+
+// GetString is specified on the Payload interface.
+func (p *payload) GetString(key string, dv string) (string, error) {
+	value, ok := p.values[key]
+	if !ok {
+		return dv, nil
+	}
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case []byte:
+		return string(v), nil
+	}
+	return dv, newPayloadTypeError(key, value, "string")
+}
+
+// GetInt is specified on the Payload interface.
+func (p *payload) GetInt(key string, dv int) (int, error) {
+	value, ok := p.values[key]
+	if !ok {
+		return dv, nil
+	}
+	i, ok := toInt64(value)
+	if !ok || i < math.MinInt || i > math.MaxInt {
+		return dv, newPayloadTypeError(key, value, "int")
+	}
+	return int(i), nil
+}
+
+// GetFloat64 is specified on the Payload interface.
+func (p *payload) GetFloat64(key string, dv float64) (float64, error) {
+	value, ok := p.values[key]
+	if !ok {
+		return dv, nil
+	}
+	f, ok := toFloat64(value)
+	if !ok {
+		return dv, newPayloadTypeError(key, value, "float64")
+	}
+	return f, nil
+}
+
+// GetBool is specified on the Payload interface.
+func (p *payload) GetBool(key string, dv bool) (bool, error) {
+	value, ok := p.values[key]
+	if !ok {
+		return dv, nil
+	}
+	b, ok := value.(bool)
+	if !ok {
+		return dv, newPayloadTypeError(key, value, "bool")
+	}
+	return b, nil
+}
+
+// GetTime is specified on the Payload interface.
+func (p *payload) GetTime(key string, dv time.Time) (time.Time, error) {
+	value, ok := p.values[key]
+	if !ok {
+		return dv, nil
+	}
+	t, ok := toTime(value)
+	if !ok {
+		return dv, newPayloadTypeError(key, value, "time.Time")
+	}
+	return t, nil
+}
+
+// GetDuration is specified on the Payload interface.
+func (p *payload) GetDuration(key string, dv time.Duration) (time.Duration, error) {
+	value, ok := p.values[key]
+	if !ok {
+		return dv, nil
+	}
+	d, ok := toDuration(value)
+	if !ok {
+		return dv, newPayloadTypeError(key, value, "time.Duration")
+	}
+	return d, nil
+}
+
+//--------------------
+// STRUCTS
+//--------------------
+
+// NewPayloadFromStruct creates a payload containing the exported
+// fields of the passed struct or struct pointer. The keys are the
+// field names or set with the tag `cells:"key"`, the tag `cells:"-"`
+// skips a field.
+func NewPayloadFromStruct(s interface{}) (Payload, error) {
+	sv := reflect.ValueOf(s)
+	if sv.Kind() == reflect.Ptr {
+		sv = sv.Elem()
+	}
+	if sv.Kind() != reflect.Struct {
+		return nil, errors.New(ErrNoStruct, errorMessages, s)
+	}
+	values := PayloadValues{}
+	st := sv.Type()
+	for i := 0; i < st.NumField(); i++ {
+		key, ok := payloadKey(st.Field(i))
+		if ok {
+			values[key] = sv.Field(i).Interface()
+		}
+	}
+	return NewPayload(values), nil
+}
+
+// Unmarshal is specified on the Payload interface.
+func (p *payload) Unmarshal(s interface{}) error {
+	sv := reflect.ValueOf(s)
+	if sv.Kind() != reflect.Ptr || sv.Elem().Kind() != reflect.Struct {
+		return errors.New(ErrNoStruct, errorMessages, s)
+	}
+	sv = sv.Elem()
+	st := sv.Type()
+	for i := 0; i < st.NumField(); i++ {
+		key, ok := payloadKey(st.Field(i))
+		if !ok {
+			continue
+		}
+		value, ok := p.values[key]
+		if !ok {
+			continue
+		}
+		if err := setField(sv.Field(i), key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//--------------------
+// HELPERS
+//--------------------
+
+// newPayloadTypeError returns the error for a payload value
+// not convertible into the wanted type.
+func newPayloadTypeError(key string, value interface{}, wanted string) error {
+	return errors.New(ErrPayloadType, errorMessages, key, value, wanted)
+}
+
+// payloadKey returns the payload key of a struct field.
+func payloadKey(field reflect.StructField) (string, bool) {
+	if field.PkgPath != "" {
+		return "", false
+	}
+	tag := field.Tag.Get(payloadTag)
+	if tag == "-" {
+		return "", false
+	}
+	if name := strings.Split(tag, ",")[0]; name != "" {
+		return name, true
+	}
+	return field.Name, true
+}
+
+// setField sets a struct field to the payload value
+// converted into the type of the field.
+func setField(field reflect.Value, key string, value interface{}) error {
+	if value == nil {
+		field.Set(reflect.Zero(field.Type()))
+		return nil
+	}
+	vv := reflect.ValueOf(value)
+	ft := field.Type()
+	switch {
+	case vv.Type().AssignableTo(ft):
+		field.Set(vv)
+		return nil
+	case ft == reflect.TypeOf(time.Duration(0)):
+		if d, ok := toDuration(value); ok {
+			field.SetInt(int64(d))
+			return nil
+		}
+	case ft == reflect.TypeOf(time.Time{}):
+		if t, ok := toTime(value); ok {
+			field.Set(reflect.ValueOf(t))
+			return nil
+		}
+	}
+	switch ft.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if i, ok := toInt64(value); ok && !field.OverflowInt(i) {
+			field.SetInt(i)
+			return nil
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if i, ok := toInt64(value); ok && i >= 0 && !field.OverflowUint(uint64(i)) {
+			field.SetUint(uint64(i))
+			return nil
+		}
+	case reflect.Float32, reflect.Float64:
+		if f, ok := toFloat64(value); ok && !field.OverflowFloat(f) {
+			field.SetFloat(f)
+			return nil
+		}
+	default:
+		if vv.Type().ConvertibleTo(ft) && vv.Kind() == ft.Kind() {
+			field.Set(vv.Convert(ft))
+			return nil
+		}
+	}
+	return newPayloadTypeError(key, value, ft.String())
+}
+
+// toInt64 converts numeric values into an int64. Floats
+// are only converted if they have no fraction.
+func toInt64(value interface{}) (int64, bool) {
+	switch v := value.(type) {
+	case int:
+		return int64(v), true
+	case int8:
+		return int64(v), true
+	case int16:
+		return int64(v), true
+	case int32:
+		return int64(v), true
+	case int64:
+		return v, true
+	case uint:
+		return int64(v), v <= math.MaxInt64
+	case uint8:
+		return int64(v), true
+	case uint16:
+		return int64(v), true
+	case uint32:
+		return int64(v), true
+	case uint64:
+		return int64(v), v <= math.MaxInt64
+	case float32:
+		return toInt64(float64(v))
+	case float64:
+		if v != math.Trunc(v) || v < math.MinInt64 || v >= math.MaxInt64 {
+			return 0, false
+		}
+		return int64(v), true
+	}
+	return 0, false
+}
+
+// toFloat64 converts numeric values into a float64.
+func toFloat64(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case float32:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	case uint:
+		return float64(v), true
+	}
+	if i, ok := toInt64(value); ok {
+		return float64(i), true
+	}
+	return 0, false
+}
+
+// toTime converts times and their RFC 3339 representation
+// into a time.
+func toTime(value interface{}) (time.Time, bool) {
+	switch v := value.(type) {
+	case time.Time:
+		return v, true
+	case string:
+		t, err := time.Parse(time.RFC3339Nano, v)
+		return t, err == nil
+	}
+	return time.Time{}, false
+}
+
+// toDuration converts durations, numbers of nanoseconds,
+// and strings like "1m30s" into a duration.
+func toDuration(value interface{}) (time.Duration, bool) {
+	switch v := value.(type) {
+	case time.Duration:
+		return v, true
+	case string:
+		d, err := time.ParseDuration(v)
+		return d, err == nil
+	}
+	i, ok := toInt64(value)
+	return time.Duration(i), ok
+}
+
+// EOF
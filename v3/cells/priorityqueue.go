@@ -0,0 +1,187 @@
+// Tideland Go Cell Network - Cells - Priority Queue
+//
+// Copyright (C) 2010-2015 Frank Mueller / Tideland / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package cells
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/tideland/goas/v2/loop"
+	"github.com/tideland/goas/v3/errors"
+)
+
+//--------------------
+// PRIORITY EVENT QUEUE
+//--------------------
+
+// prioritizedEvent is a queued event with its priority
+// and its time of queueing.
+type prioritizedEvent struct {
+	event    Event
+	priority int
+	queued   time.Time
+}
+
+// priorityEventQueue implements an in-memory event queue delivering
+// events with higher priority first. Events with the same priority
+// are delivered in FIFO order. To avoid starvation the priority of
+// waiting events raises by one each aging duration.
+type priorityEventQueue struct {
+	priorities map[string]int
+	aging      time.Duration
+	levels     map[int][]prioritizedEvent
+	length     int64
+	pushc      chan Event
+	eventc     chan Event
+	loop       loop.Loop
+}
+
+// makePriorityEventQueueFactory creates a factory for priority event
+// queues. The priorities map topics to priorities, an aging of 0 or
+// less disables the aging.
+func makePriorityEventQueueFactory(priorities map[string]int, aging time.Duration) EventQueueFactory {
+	return func(env Environment, id string) (EventQueue, error) {
+		queue := &priorityEventQueue{
+			priorities: priorities,
+			aging:      aging,
+			levels:     make(map[int][]prioritizedEvent),
+			pushc:      make(chan Event),
+			eventc:     make(chan Event),
+		}
+		queue.loop = loop.Go(queue.backendLoop)
+		return queue, nil
+	}
+}
+
+// Push appends an event to the end of the queue.
+func (q *priorityEventQueue) Push(event Event) error {
+	return q.PushContext(context.Background(), event)
+}
+
+// PushContext appends an event to the end of the queue. It
+// returns an error if the context is done while waiting.
+func (q *priorityEventQueue) PushContext(ctx context.Context, event Event) error {
+	select {
+	case q.pushc <- event:
+	case <-ctx.Done():
+		return newContextError(ctx, "push to event queue")
+	case <-q.loop.IsStopping():
+		return errors.New(ErrStopping, errorMessages, "event queue")
+	}
+	return nil
+}
+
+// Events returns a channel delivering the event
+// with the highest priority.
+func (q *priorityEventQueue) Events() <-chan Event {
+	return q.eventc
+}
+
+// Len returns the number of currently queued events.
+func (q *priorityEventQueue) Len() int {
+	return int(atomic.LoadInt64(&q.length))
+}
+
+// Dropped returns the number of dropped events. Priority
+// event queues never drop events.
+func (q *priorityEventQueue) Dropped() int64 {
+	return 0
+}
+
+// Stop tells the queue to end working.
+func (q *priorityEventQueue) Stop() error {
+	return q.loop.Stop()
+}
+
+// priority returns the priority of an event. It's taken from
+// the payload value cells.PriorityPayload, otherwise from the
+// topic priorities. Default is 0.
+func (q *priorityEventQueue) priority(event Event) int {
+	dv := q.priorities[event.Topic()]
+	if event.Payload() == nil {
+		return dv
+	}
+	priority, _ := event.Payload().GetInt(PriorityPayload, dv)
+	return priority
+}
+
+// push adds an event to the level of its priority.
+func (q *priorityEventQueue) push(event Event) {
+	priority := q.priority(event)
+	q.levels[priority] = append(q.levels[priority], prioritizedEvent{
+		event:    event,
+		priority: priority,
+		queued:   time.Now(),
+	})
+	atomic.AddInt64(&q.length, 1)
+}
+
+// next returns the priority level of the next event to deliver,
+// the oldest one of the highest aged priority.
+func (q *priorityEventQueue) next(now time.Time) (int, bool) {
+	var best *prioritizedEvent
+	bestPriority := 0
+	for _, events := range q.levels {
+		head := &events[0]
+		priority := head.priority
+		if q.aging > 0 {
+			priority += int(now.Sub(head.queued) / q.aging)
+		}
+		if best == nil || priority > bestPriority ||
+			(priority == bestPriority && head.queued.Before(best.queued)) {
+			best = head
+			bestPriority = priority
+		}
+	}
+	if best == nil {
+		return 0, false
+	}
+	return best.priority, true
+}
+
+// pop removes the first event of a priority level.
+func (q *priorityEventQueue) pop(priority int) {
+	events := q.levels[priority]
+	events[0] = prioritizedEvent{}
+	if len(events) == 1 {
+		delete(q.levels, priority)
+	} else {
+		q.levels[priority] = events[1:]
+	}
+	atomic.AddInt64(&q.length, -1)
+}
+
+// backendLoop realizes the backend of the queue.
+func (q *priorityEventQueue) backendLoop(l loop.Loop) error {
+	for {
+		// A nil channel disables delivering while
+		// there's no queued event.
+		var eventc chan Event
+		var event Event
+		priority, ok := q.next(time.Now())
+		if ok {
+			eventc = q.eventc
+			event = q.levels[priority][0].event
+		}
+		select {
+		case <-l.ShallStop():
+			return nil
+		case pushed := <-q.pushc:
+			q.push(pushed)
+		case eventc <- event:
+			q.pop(priority)
+		}
+	}
+}
+
+// EOF
@@ -12,6 +12,11 @@ package cells
 //--------------------
 
 import (
+	"context"
+	"log/slog"
+	"sync/atomic"
+	"time"
+
 	"github.com/tideland/goas/v2/loop"
 	"github.com/tideland/goas/v3/errors"
 )
@@ -22,8 +27,9 @@ import (
 
 // EventQueueFactory describes a function returning individual
 // implementations of the EventQueue interface. This way different
-// types of event queues can be injected into environments.
-type EventQueueFactory func(env Environment) (EventQueue, error)
+// types of event queues can be injected into environments. The
+// passed ID is the one of the cell the queue is created for.
+type EventQueueFactory func(env Environment, id string) (EventQueue, error)
 
 // EventQueue describes the methods any queue implementation
 // must provide.
@@ -39,6 +45,78 @@ type EventQueue interface {
 	Stop() error
 }
 
+// ContextEventQueue is implemented by event queues which are
+// able to cancel a blocking push.
+type ContextEventQueue interface {
+	EventQueue
+
+	// PushContext appends an event to the end of the queue. It
+	// returns an error if the context is done while waiting.
+	PushContext(ctx context.Context, event Event) error
+}
+
+// MeasurableEventQueue is implemented by event queues which are
+// able to report their current state.
+type MeasurableEventQueue interface {
+	EventQueue
+
+	// Len returns the number of currently queued events.
+	Len() int
+
+	// Dropped returns the number of events dropped due
+	// to an overflow of the queue.
+	Dropped() int64
+}
+
+//--------------------
+// OVERFLOW POLICY
+//--------------------
+
+// dropReportInterval is the minimum time between two
+// reports of events dropped by a bounded event queue.
+const dropReportInterval = 10 * time.Second
+
+// OverflowPolicy defines how a bounded event queue reacts when
+// an event is pushed while the queue is full.
+type OverflowPolicy int
+
+const (
+	// OverflowBlock lets the emitter block until the
+	// queue has space again.
+	OverflowBlock OverflowPolicy = iota
+
+	// OverflowBlockTimeout lets the emitter block until the queue
+	// has space again or returns a timeout error.
+	OverflowBlockTimeout
+
+	// OverflowDropNewest drops the pushed event.
+	OverflowDropNewest
+
+	// OverflowDropOldest drops the oldest queued event to
+	// make space for the pushed one.
+	OverflowDropOldest
+
+	// OverflowError lets the push return a queue overflow error.
+	OverflowError
+)
+
+// String is specified on the Stringer interface.
+func (p OverflowPolicy) String() string {
+	switch p {
+	case OverflowBlock:
+		return "block"
+	case OverflowBlockTimeout:
+		return "block-timeout"
+	case OverflowDropNewest:
+		return "drop-newest"
+	case OverflowDropOldest:
+		return "drop-oldest"
+	case OverflowError:
+		return "error"
+	}
+	return "unknown"
+}
+
 //--------------------
 // LOCAL EVENT QUEUE
 //--------------------
@@ -126,20 +204,45 @@ func (rb *ringBuffer) Pop() {
 
 // localEventQueue implements a local in-memory event queue.
 type localEventQueue struct {
-	buffer *ringBuffer
-	pushc  chan Event
-	eventc chan Event
-	loop   loop.Loop
+	buffer   *ringBuffer
+	length   int64
+	dropped  int64
+	reported int64
+	lastDrop time.Time
+	capacity int
+	policy   OverflowPolicy
+	timeout  time.Duration
+	pushc    chan Event
+	resultc  chan error
+	eventc   chan Event
+	loop     loop.Loop
+	log      *slog.Logger
 }
 
-// makeLocalEventQueueFactory creates a factory for local
-// event queues.
+// makeLocalEventQueueFactory creates a factory for unbounded
+// local event queues.
 func makeLocalEventQueueFactory(size int) EventQueueFactory {
-	return func(env Environment) (EventQueue, error) {
+	return makeBoundedLocalEventQueueFactory(size, 0, OverflowBlock, 0)
+}
+
+// makeBoundedLocalEventQueueFactory creates a factory for local
+// event queues holding at most capacity events. A capacity of 0
+// or less means the queue is unbounded. When the queue is full
+// the policy defines how pushes are handled.
+func makeBoundedLocalEventQueueFactory(size, capacity int, policy OverflowPolicy, timeout time.Duration) EventQueueFactory {
+	if capacity > 0 && size > capacity {
+		size = capacity
+	}
+	return func(env Environment, id string) (EventQueue, error) {
 		queue := &localEventQueue{
-			buffer: newRingBuffer(size),
-			pushc:  make(chan Event),
-			eventc: make(chan Event),
+			buffer:   newRingBuffer(size),
+			capacity: capacity,
+			policy:   policy,
+			timeout:  timeout,
+			pushc:    make(chan Event),
+			resultc:  make(chan error),
+			eventc:   make(chan Event),
+			log:      loggerOf(env).With(LogCellKey, id),
 		}
 		queue.loop = loop.Go(queue.backendLoop)
 		return queue, nil
@@ -148,11 +251,31 @@ func makeLocalEventQueueFactory(size int) EventQueueFactory {
 
 // Push appends an event to the end of the queue.
 func (q *localEventQueue) Push(event Event) error {
+	return q.PushContext(context.Background(), event)
+}
+
+// PushContext appends an event to the end of the queue. It
+// returns an error if the context is done while waiting.
+func (q *localEventQueue) PushContext(ctx context.Context, event Event) error {
+	var timeoutc <-chan time.Time
+	if q.capacity > 0 && q.policy == OverflowBlockTimeout {
+		timer := time.NewTimer(q.timeout)
+		defer timer.Stop()
+		timeoutc = timer.C
+	}
 	select {
 	case q.pushc <- event:
+	case <-timeoutc:
+		return errors.New(ErrTimeout, errorMessages, "push to event queue")
+	case <-ctx.Done():
+		return newContextError(ctx, "push to event queue")
 	case <-q.loop.IsStopping():
 		return errors.New(ErrStopping, errorMessages, "event queue")
 	}
+	if q.capacity > 0 {
+		// Bounded queues report if the event has been accepted.
+		return <-q.resultc
+	}
 	return nil
 }
 
@@ -162,31 +285,102 @@ func (q *localEventQueue) Events() <-chan Event {
 	return q.eventc
 }
 
+// Len returns the number of currently queued events.
+func (q *localEventQueue) Len() int {
+	return int(atomic.LoadInt64(&q.length))
+}
+
+// Dropped returns the number of events dropped due
+// to an overflow of the queue.
+func (q *localEventQueue) Dropped() int64 {
+	return atomic.LoadInt64(&q.dropped)
+}
+
 // Stop tells the queue to end working.
 func (l *localEventQueue) Stop() error {
 	return l.loop.Stop()
 }
 
+// isFull returns true if the queue is bounded and
+// has reached its capacity.
+func (q *localEventQueue) isFull() bool {
+	return q.capacity > 0 && q.Len() >= q.capacity
+}
+
+// push adds an event received by the backend loop to the buffer
+// and handles a possible overflow based on the policy.
+func (q *localEventQueue) push(event Event) {
+	if q.capacity <= 0 {
+		q.buffer.Push(event)
+		atomic.AddInt64(&q.length, 1)
+		return
+	}
+	if q.isFull() {
+		switch q.policy {
+		case OverflowDropNewest:
+			q.drop(event)
+			q.resultc <- nil
+			return
+		case OverflowDropOldest:
+			q.drop(q.buffer.Peek())
+			q.pop()
+		case OverflowError:
+			q.resultc <- errors.New(ErrQueueOverflow, errorMessages, q.capacity, event)
+			return
+		}
+	}
+	q.buffer.Push(event)
+	atomic.AddInt64(&q.length, 1)
+	q.resultc <- nil
+}
+
+// pop removes the first event of the buffer after delivery.
+func (q *localEventQueue) pop() {
+	q.buffer.Pop()
+	atomic.AddInt64(&q.length, -1)
+}
+
+// drop counts a dropped event. The first drop is reported at once,
+// further ones at most every dropReportInterval together with the
+// number of events dropped since the last report.
+func (q *localEventQueue) drop(event Event) {
+	dropped := atomic.AddInt64(&q.dropped, 1)
+	now := time.Now()
+	if !q.lastDrop.IsZero() && now.Sub(q.lastDrop) < dropReportInterval {
+		return
+	}
+	q.log.Warn("event queue overflow, dropped events", LogTopicKey, event.Topic(),
+		"dropped", dropped, "since_last_report", dropped-q.reported)
+	q.lastDrop = now
+	q.reported = dropped
+}
+
 // backendLoop realizes the backend of the queue.
 func (q *localEventQueue) backendLoop(l loop.Loop) error {
 	for {
+		// A nil channel blocks the receiving of pushed events
+		// while a full queue lets the emitters wait.
+		pushc := q.pushc
+		if q.isFull() && (q.policy == OverflowBlock || q.policy == OverflowBlockTimeout) {
+			pushc = nil
+		}
 		if q.buffer.Peek() == nil {
 			// Empty buffer.
 			select {
 			case <-l.ShallStop():
 				return nil
-			case event := <-q.pushc:
-				q.buffer.Push(event)
+			case event := <-pushc:
+				q.push(event)
 			}
 		} else {
 			// At least one event in buffer.
 			select {
 			case <-l.ShallStop():
 				return nil
-			case event := <-q.pushc:
-				q.buffer.Push(event)
+			case event := <-pushc:
+				q.push(event)
 			case q.eventc <- q.buffer.Peek():
-				q.buffer.Pop()
+				q.pop()
 			}
 		}
 	}
@@ -0,0 +1,401 @@
+// Tideland Go Cell Network - Cells - Recorder
+//
+// Copyright (C) 2010-2015 Frank Mueller / Tideland / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package cells
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/tideland/goas/v3/errors"
+)
+
+//--------------------
+// RECORDED EVENT
+//--------------------
+
+// RecordedEvent is an event recorded when it has been emitted
+// to a cell of an environment.
+type RecordedEvent struct {
+	// Offset is the time since the first recorded event.
+	Offset time.Duration
+
+	// SourceID is the ID of the emitting cell. It's empty
+	// for events emitted from the outside.
+	SourceID string
+
+	// TargetID is the ID of the cell the event has been
+	// emitted to.
+	TargetID string
+
+	// Request is true if the event has been a request.
+	Request bool
+
+	// Event is the recorded event. Its scene is not recorded.
+	Event Event
+}
+
+// String is specified on the Stringer interface.
+func (re RecordedEvent) String() string {
+	values, _ := encodablePayloadValues(re.Event.Payload(), false)
+	return fmt.Sprintf("<%q -> %q: %s %v>", re.SourceID, re.TargetID, re.Event.Topic(), values)
+}
+
+// recordLine is one line of a recording.
+type recordLine struct {
+	Offset   time.Duration   `json:"offset"`
+	SourceID string          `json:"source_id,omitempty"`
+	TargetID string          `json:"target_id"`
+	Request  bool            `json:"request,omitempty"`
+	Event    json.RawMessage `json:"event"`
+}
+
+//--------------------
+// RECORDER
+//--------------------
+
+// Recorder writes the events emitted to the cells of an environment
+// as lines of JSON. It is set with the option Recording(). Events
+// which cannot be encoded or written are skipped, logged, and
+// counted, the recording goes on with the next ones. The writer is
+// called synchronously while emitting and serialized by a mutex, so
+// slow writers slow down the cells. Use a buffered writer, e.g. a
+// bufio.Writer flushed after stopping the environment, or one
+// writing asynchronously.
+type Recorder struct {
+	mux      sync.Mutex
+	writer   io.Writer
+	codec    PayloadCodec
+	internal bool
+	start    time.Time
+	skipped  int
+	err      error
+}
+
+// NewRecorder creates a recorder writing to the writer. It records
+// the events emitted from the outside with Emit(), EmitNew(), and
+// the requests. If internal is true also the events emitted by
+// cells are recorded.
+func NewRecorder(writer io.Writer, internal bool) *Recorder {
+	return &Recorder{
+		writer:   writer,
+		codec:    NewJSONPayloadCodec(),
+		internal: internal,
+	}
+}
+
+// Err returns the last error recording an event.
+func (r *Recorder) Err() error {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	return r.err
+}
+
+// Skipped returns the number of events which
+// couldn't be recorded.
+func (r *Recorder) Skipped() int {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	return r.skipped
+}
+
+// record writes the event emitted to the target cell. If
+// it fails the event is skipped and the error returned.
+func (r *Recorder) record(targetID string, event Event) error {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	now := time.Now()
+	if r.start.IsZero() {
+		r.start = now
+	}
+	err := r.write(now, targetID, event)
+	if err != nil {
+		r.skipped++
+		r.err = err
+	}
+	return err
+}
+
+// write writes the line of the event. It has to be
+// called with a locked mutex.
+func (r *Recorder) write(now time.Time, targetID string, event Event) error {
+	data, err := r.codec.Encode(event)
+	if err != nil {
+		return err
+	}
+	_, request := event.Payload().Get(ResponseChanPayload)
+	line, err := json.Marshal(recordLine{
+		Offset:   now.Sub(r.start),
+		SourceID: event.Metadata().SourceID,
+		TargetID: targetID,
+		Request:  request,
+		Event:    data,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = r.writer.Write(append(line, '\n'))
+	return err
+}
+
+// recordExternal records an event emitted from
+// the outside, if a recorder is set.
+func (env *environment) recordExternal(targetID string, event Event) {
+	if env.recorder == nil {
+		return
+	}
+	if err := env.recorder.record(targetID, event); err != nil {
+		env.log.Warn("cells environment cannot record event", LogCellKey, targetID, LogTopicKey, event.Topic(), LogErrorKey, err)
+	}
+}
+
+// recordInternal records an event emitted by a cell,
+// if a recorder for internal events is set.
+func (c *cell) recordInternal(event Event) {
+	recorder := c.env.recorder
+	if recorder == nil || !recorder.internal || event.Metadata().SourceID == "" {
+		return
+	}
+	if err := recorder.record(c.id, event); err != nil {
+		c.logger().Warn("cell cannot record event", LogTopicKey, event.Topic(), LogErrorKey, err)
+	}
+}
+
+// ReadRecording reads the events written by a recorder.
+func ReadRecording(reader io.Reader) ([]RecordedEvent, error) {
+	codec := NewJSONPayloadCodec()
+	recording := []RecordedEvent{}
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	number := 0
+	for scanner.Scan() {
+		number++
+		data := bytes.TrimSpace(scanner.Bytes())
+		if len(data) == 0 {
+			continue
+		}
+		var line recordLine
+		if err := json.Unmarshal(data, &line); err != nil {
+			return nil, errors.Annotate(err, ErrInvalidRecording, errorMessages, number)
+		}
+		event, err := codec.Decode(line.Event)
+		if err != nil {
+			return nil, errors.Annotate(err, ErrInvalidRecording, errorMessages, number)
+		}
+		recording = append(recording, RecordedEvent{
+			Offset:   line.Offset,
+			SourceID: line.SourceID,
+			TargetID: line.TargetID,
+			Request:  line.Request,
+			Event:    event,
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Annotate(err, ErrInvalidRecording, errorMessages, number+1)
+	}
+	return recording, nil
+}
+
+//--------------------
+// REPLAYER
+//--------------------
+
+// Replayer emits the recorded events emitted from the outside
+// into an environment again. They keep their metadata, so the
+// chains of caused events can be compared. Recorded requests are
+// emitted as requests too, but the responses are dropped. Events
+// emitted by cells are not replayed, they are expected to be
+// emitted again.
+type Replayer struct {
+	env       Environment
+	recording []RecordedEvent
+	next      int
+}
+
+// NewReplayer creates a replayer of the recording into
+// the environment.
+func NewReplayer(env Environment, recording []RecordedEvent) *Replayer {
+	external := []RecordedEvent{}
+	for _, re := range recording {
+		if re.SourceID == "" {
+			external = append(external, re)
+		}
+	}
+	return &Replayer{
+		env:       env,
+		recording: external,
+	}
+}
+
+// Len returns the number of events not yet replayed.
+func (r *Replayer) Len() int {
+	return len(r.recording) - r.next
+}
+
+// Step replays the next event at once and returns it. If all
+// events are replayed io.EOF is returned.
+func (r *Replayer) Step() (RecordedEvent, error) {
+	if r.next >= len(r.recording) {
+		return RecordedEvent{}, io.EOF
+	}
+	re := r.recording[r.next]
+	r.next++
+	replayed := re.Event
+	if ev, ok := replayed.(*event); ok {
+		copied := *ev
+		if re.Request {
+			responseChan := make(chan interface{}, 1)
+			copied.payload = ev.payload.Apply(PayloadValues{ResponseChanPayload: responseChan})
+		}
+		replayed = &copied
+	}
+	if err := r.env.Emit(re.TargetID, replayed); err != nil {
+		return re, err
+	}
+	return re, nil
+}
+
+// Run replays the remaining events with the recorded time between
+// them divided by speed. So a speed of 1 is the original one, 2
+// is twice as fast, and 0 or less replays without waiting. It
+// ends with the first failing emit or when the context is done.
+func (r *Replayer) Run(ctx context.Context, speed float64) error {
+	var last time.Duration
+	if r.next > 0 {
+		last = r.recording[r.next-1].Offset
+	} else if r.next < len(r.recording) {
+		last = r.recording[r.next].Offset
+	}
+	for r.next < len(r.recording) {
+		offset := r.recording[r.next].Offset
+		if speed > 0 && offset > last {
+			timer := time.NewTimer(time.Duration(float64(offset-last) / speed))
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return newContextError(ctx, "replay")
+			case <-timer.C:
+			}
+		}
+		last = offset
+		if _, err := r.Step(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//--------------------
+// DIFF
+//--------------------
+
+// RecordingDiff is a difference between two recordings.
+type RecordingDiff struct {
+	// SourceID and TargetID identify the emits compared.
+	SourceID string
+	TargetID string
+
+	// Index is the position of the event in the emits
+	// from the source to the target.
+	Index int
+
+	// Expected and Actual are the different events. One of
+	// them is nil if the other recording has more emits.
+	Expected *RecordedEvent
+	Actual   *RecordedEvent
+}
+
+// String is specified on the Stringer interface.
+func (d RecordingDiff) String() string {
+	describe := func(re *RecordedEvent) string {
+		if re == nil {
+			return "nothing"
+		}
+		values, _ := encodablePayloadValues(re.Event.Payload(), false)
+		return fmt.Sprintf("%s %v", re.Event.Topic(), values)
+	}
+	return fmt.Sprintf("%q -> %q #%d: expected %s, got %s",
+		d.SourceID, d.TargetID, d.Index, describe(d.Expected), describe(d.Actual))
+}
+
+// DiffRecordings compares the recorded traffic, e.g. of a replay
+// against a known good run. As cells work concurrently the events
+// are compared per source and target in their order. Events are
+// equal if they have the same topic and payload.
+func DiffRecordings(expected, actual []RecordedEvent) []RecordingDiff {
+	type link struct {
+		sourceID string
+		targetID string
+	}
+	links := []link{}
+	expectedEmits := make(map[link][]RecordedEvent)
+	actualEmits := make(map[link][]RecordedEvent)
+	group := func(recording []RecordedEvent, emits map[link][]RecordedEvent) {
+		for _, re := range recording {
+			l := link{re.SourceID, re.TargetID}
+			if _, ok := expectedEmits[l]; !ok {
+				if _, ok := actualEmits[l]; !ok {
+					links = append(links, l)
+				}
+			}
+			emits[l] = append(emits[l], re)
+		}
+	}
+	group(expected, expectedEmits)
+	group(actual, actualEmits)
+	diffs := []RecordingDiff{}
+	for _, l := range links {
+		es := expectedEmits[l]
+		as := actualEmits[l]
+		for i := 0; i < len(es) || i < len(as); i++ {
+			var e, a *RecordedEvent
+			if i < len(es) {
+				e = &es[i]
+			}
+			if i < len(as) {
+				a = &as[i]
+			}
+			if e != nil && a != nil && equalRecordedEvents(*e, *a) {
+				continue
+			}
+			diffs = append(diffs, RecordingDiff{l.sourceID, l.targetID, i, e, a})
+		}
+	}
+	return diffs
+}
+
+// equalRecordedEvents checks if two recorded events have
+// the same topic and payload.
+func equalRecordedEvents(e, a RecordedEvent) bool {
+	if e.Event.Topic() != a.Event.Topic() || e.Request != a.Request {
+		return false
+	}
+	encode := func(re RecordedEvent) string {
+		values, err := encodablePayloadValues(re.Event.Payload(), true)
+		if err != nil {
+			return ""
+		}
+		data, err := json.Marshal(values)
+		if err != nil {
+			return ""
+		}
+		return string(data)
+	}
+	return encode(e) == encode(a)
+}
+
+// EOF
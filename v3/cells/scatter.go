@@ -0,0 +1,134 @@
+// Tideland Go Cell Network - Cells - Scatter-Gather
+//
+// Copyright (C) 2010-2015 Frank Mueller / Tideland / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package cells
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/tideland/goas/v1/scene"
+	"github.com/tideland/goas/v3/errors"
+)
+
+//--------------------
+// SCATTER-GATHER
+//--------------------
+
+// ScatterResult contains the outcome of a scatter-gather request.
+type ScatterResult struct {
+	// Responses maps the IDs of the responding cells
+	// to their responses.
+	Responses map[string]interface{}
+
+	// Errors maps the IDs of cells to the errors of emitting
+	// the request or the errors they responded.
+	Errors map[string]error
+
+	// Missing are the sorted IDs of the cells which
+	// didn't respond in time.
+	Missing []string
+
+	// Skipped are the sorted IDs of the cells which
+	// haven't been waited for after the quorum has
+	// been reached.
+	Skipped []string
+}
+
+// scatterReply is the response of one cell.
+type scatterReply struct {
+	id       string
+	response interface{}
+}
+
+// scatterGather emits the requests using the passed emit
+// function and collects the responses.
+func (env *environment) scatterGather(
+	ids []string,
+	topic string,
+	payload interface{},
+	scn scene.Scene,
+	quorum int,
+	timeout time.Duration,
+	emit func(ctx context.Context, id string, event Event) error,
+) (*ScatterResult, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	result := &ScatterResult{
+		Responses: make(map[string]interface{}),
+		Errors:    make(map[string]error),
+		Missing:   []string{},
+		Skipped:   []string{},
+	}
+	// Scatter the requests.
+	replyc := make(chan scatterReply, len(ids))
+	pending := make(map[string]bool)
+	for _, id := range ids {
+		if pending[id] {
+			continue
+		}
+		responseChan := make(chan interface{}, 1)
+		p := NewPayload(payload).Apply(PayloadValues{ResponseChanPayload: responseChan})
+		event, err := newEventContext(ctx, topic, p, scn)
+		if err != nil {
+			return nil, err
+		}
+		if err := emit(ctx, id, event); err != nil {
+			result.Errors[id] = err
+			continue
+		}
+		pending[id] = true
+		go func(id string) {
+			select {
+			case response := <-responseChan:
+				replyc <- scatterReply{id, response}
+			case <-ctx.Done():
+			}
+		}(id)
+	}
+	// Gather the responses.
+	requested := len(pending) + len(result.Errors)
+	needed := requested
+	if quorum > 0 && quorum < needed {
+		needed = quorum
+	}
+	done := false
+	for !done && len(pending) > 0 && len(result.Responses) < needed {
+		select {
+		case reply := <-replyc:
+			delete(pending, reply.id)
+			if err, ok := reply.response.(error); ok {
+				result.Errors[reply.id] = err
+			} else {
+				result.Responses[reply.id] = reply.response
+			}
+		case <-ctx.Done():
+			done = true
+		}
+	}
+	complete := len(result.Responses) >= needed
+	for id := range pending {
+		if complete {
+			result.Skipped = append(result.Skipped, id)
+		} else {
+			result.Missing = append(result.Missing, id)
+		}
+	}
+	sort.Strings(result.Missing)
+	sort.Strings(result.Skipped)
+	if !complete {
+		return result, errors.New(ErrIncompleteResponses, errorMessages, len(result.Responses), requested, needed)
+	}
+	return result, nil
+}
+
+// EOF
@@ -0,0 +1,216 @@
+// Tideland Go Cell Network - Cells - Snapshots
+//
+// Copyright (C) 2010-2015 Frank Mueller / Tideland / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package cells
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/tideland/goas/v2/loop"
+	"github.com/tideland/goas/v3/errors"
+)
+
+//--------------------
+// CONSTANTS
+//--------------------
+
+// snapshotExt is the extension of the snapshot files.
+const snapshotExt = ".snapshot"
+
+//--------------------
+// SNAPSHOT STORE
+//--------------------
+
+// SnapshotStore stores the snapshots of the behaviors
+// of cells by the cell IDs.
+type SnapshotStore interface {
+	// Save stores the snapshot of the cell with the ID,
+	// replacing an older one.
+	Save(id string, snapshot []byte) error
+
+	// Load returns the latest snapshot of the cell with
+	// the ID or nil if there's none.
+	Load(id string) ([]byte, error)
+}
+
+// directorySnapshotStore stores each snapshot in a
+// file of a directory.
+type directorySnapshotStore struct {
+	dir string
+}
+
+// NewDirectorySnapshotStore creates a snapshot store writing the
+// snapshot of each cell into a file of the directory named by its
+// ID. The directory is created if needed.
+func NewDirectorySnapshotStore(dir string) SnapshotStore {
+	return &directorySnapshotStore{dir}
+}
+
+// Save is specified on the SnapshotStore interface. The snapshot
+// is written to a temporary file first and renamed afterwards, so
+// a crash doesn't leave a partial snapshot.
+func (s *directorySnapshotStore) Save(id string, snapshot []byte) error {
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return err
+	}
+	filename := s.filename(id)
+	tmp := filename + ".tmp"
+	if err := os.WriteFile(tmp, snapshot, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
+
+// Load is specified on the SnapshotStore interface.
+func (s *directorySnapshotStore) Load(id string) ([]byte, error) {
+	snapshot, err := os.ReadFile(s.filename(id))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return snapshot, err
+}
+
+// filename returns the name of the snapshot file of the cell.
+func (s *directorySnapshotStore) filename(id string) string {
+	return filepath.Join(s.dir, url.PathEscape(id)+snapshotExt)
+}
+
+//--------------------
+// ENVIRONMENT SNAPSHOTS
+//--------------------
+
+// Snapshot is specified on the Environment interface.
+func (env *environment) Snapshot(ids ...string) error {
+	snapshotCells, err := env.snapshotCells(ids)
+	if err != nil {
+		return err
+	}
+	return takeSnapshots(snapshotCells)
+}
+
+// snapshotCells returns the cells with the passed IDs
+// or all cells for taking snapshots.
+func (env *environment) snapshotCells(ids []string) ([]*cell, error) {
+	if env.snapshotStore == nil {
+		return nil, errors.New(ErrNoSnapshotStore, errorMessages, env.id)
+	}
+	if len(ids) == 0 {
+		return env.cells.all(), nil
+	}
+	var snapshotCells []*cell
+	for _, id := range ids {
+		c, err := env.cells.cell(id)
+		if err != nil {
+			return nil, err
+		}
+		snapshotCells = append(snapshotCells, c)
+	}
+	return snapshotCells, nil
+}
+
+// takeSnapshots takes the snapshots of the cells, each one
+// after its current event is processed.
+func takeSnapshots(snapshotCells []*cell) error {
+	cerrs := CellErrors{}
+	for _, c := range snapshotCells {
+		if err := c.snapshot(true); err != nil {
+			cerrs[c.id] = err
+		}
+	}
+	if len(cerrs) > 0 {
+		return cerrs
+	}
+	return nil
+}
+
+// periodicSnapshots takes the snapshots of all cells periodically.
+func (env *environment) periodicSnapshots(l loop.Loop) error {
+	ticker := time.NewTicker(env.snapshotInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.ShallStop():
+			return nil
+		case <-ticker.C:
+			if err := env.Snapshot(); err != nil {
+				env.log.Error("cells environment cannot take snapshots", LogErrorKey, err)
+			}
+		}
+	}
+}
+
+//--------------------
+// CELL SNAPSHOTS
+//--------------------
+
+// snapshot stores the snapshot of the behavior if it's a
+// Snapshotter. With lock it waits until the current event
+// is processed.
+func (c *cell) snapshot(lock bool) error {
+	if c.env.snapshotStore == nil {
+		return nil
+	}
+	if lock {
+		c.swapping.Lock()
+		defer c.swapping.Unlock()
+		c.processing.Lock()
+		defer c.processing.Unlock()
+	}
+	snapshotter, ok := c.currentBehavior().(Snapshotter)
+	if !ok {
+		return nil
+	}
+	snapshot, err := snapshotter.Snapshot()
+	if err != nil {
+		return errors.Annotate(err, ErrSnapshot, errorMessages, c.id)
+	}
+	if err := c.env.snapshotStore.Save(c.id, snapshot); err != nil {
+		return errors.Annotate(err, ErrSnapshot, errorMessages, c.id)
+	}
+	return nil
+}
+
+// restore restores the behavior out of the latest
+// snapshot of the cell, if there's one.
+func (c *cell) restore(behavior Behavior) error {
+	if c.env.snapshotStore == nil {
+		return nil
+	}
+	snapshotter, ok := behavior.(Snapshotter)
+	if !ok {
+		return nil
+	}
+	snapshot, err := c.env.snapshotStore.Load(c.id)
+	if err != nil {
+		return errors.Annotate(err, ErrRestore, errorMessages, c.id)
+	}
+	if snapshot == nil {
+		return nil
+	}
+	if err := snapshotter.Restore(snapshot); err != nil {
+		return errors.Annotate(err, ErrRestore, errorMessages, c.id)
+	}
+	c.logger().Info("cell restored from snapshot")
+	return nil
+}
+
+// process lets the behavior process the event while
+// no snapshot is taken.
+func (c *cell) process(behavior Behavior, event Event) error {
+	c.processing.Lock()
+	defer c.processing.Unlock()
+	return behavior.ProcessEvent(event)
+}
+
+// EOF
@@ -0,0 +1,316 @@
+// Tideland Go Cell Network - Cells - Supervisor
+//
+// Copyright (C) 2010-2015 Frank Mueller / Tideland / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package cells
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"sync"
+	"time"
+
+	"github.com/tideland/goas/v3/errors"
+)
+
+//--------------------
+// SUPERVISOR SPECIFICATION
+//--------------------
+
+// BehaviorFactory creates a fresh behavior instance, e.g.
+// when a supervised cell is restarted.
+type BehaviorFactory func() Behavior
+
+// RestartStrategy defines which cells are restarted by a
+// supervisor when one of its children fails.
+type RestartStrategy int
+
+const (
+	// OneForOne restarts only the failed child.
+	OneForOne RestartStrategy = iota
+
+	// OneForAll restarts all children.
+	OneForAll
+
+	// RestForOne restarts the failed child and all
+	// children specified after it.
+	RestForOne
+)
+
+// ChildSpec specifies a child of a supervisor. It's either a cell
+// with the ID created by the factory or a nested supervisor.
+type ChildSpec struct {
+	// ID is the ID of the cell.
+	ID string
+
+	// Factory creates the behavior of the cell.
+	Factory BehaviorFactory
+
+	// Options are the options the cell is started with.
+	Options []CellOption
+
+	// Supervisor specifies a nested supervisor instead of a cell.
+	Supervisor *SupervisorSpec
+}
+
+// SupervisorSpec specifies a supervisor and its children.
+type SupervisorSpec struct {
+	// ID identifies the supervisor.
+	ID string
+
+	// Strategy defines which children are restarted.
+	Strategy RestartStrategy
+
+	// MaxRestarts is the maximum number of restarts inside of
+	// Period. If it's exceeded the supervisor gives up and fails
+	// itself, so that its parent restarts it. A supervisor without
+	// a parent stops its children instead. Default is 3.
+	MaxRestarts int
+
+	// Period is the duration MaxRestarts is checked for.
+	// Default is 5 seconds.
+	Period time.Duration
+
+	// Backoff is the initial delay before a restart. It doubles
+	// with each further restart inside of Period.
+	Backoff time.Duration
+
+	// MaxBackoff limits the doubled Backoff. Default is 1 minute.
+	MaxBackoff time.Duration
+
+	// Children are the supervised cells and supervisors in
+	// their starting order.
+	Children []ChildSpec
+}
+
+// CellSpec returns the child specification of a cell.
+func CellSpec(id string, factory BehaviorFactory, options ...CellOption) ChildSpec {
+	return ChildSpec{
+		ID:      id,
+		Factory: factory,
+		Options: options,
+	}
+}
+
+// SupervisorChildSpec returns the child specification
+// of a nested supervisor.
+func SupervisorChildSpec(spec SupervisorSpec) ChildSpec {
+	return ChildSpec{
+		ID:         spec.ID,
+		Supervisor: &spec,
+	}
+}
+
+// validate checks the spec and its nested specs for
+// missing factories and duplicate IDs.
+func (spec SupervisorSpec) validate(ids map[string]bool) error {
+	if spec.ID == "" {
+		return errors.New(ErrInvalidSupervisorSpec, errorMessages, spec.ID, "missing ID")
+	}
+	for _, child := range spec.Children {
+		if ids[child.ID] {
+			return errors.New(ErrDuplicateId, errorMessages, child.ID)
+		}
+		ids[child.ID] = true
+		switch {
+		case child.Supervisor != nil:
+			if err := child.Supervisor.validate(ids); err != nil {
+				return err
+			}
+		case child.Factory == nil:
+			return errors.New(ErrInvalidSupervisorSpec, errorMessages, spec.ID, "missing factory of "+child.ID)
+		}
+	}
+	return nil
+}
+
+// backoff returns the delay before a restart after the
+// given number of restarts inside of the period.
+func (spec SupervisorSpec) backoff(restarts int) time.Duration {
+	delay := spec.Backoff
+	for i := 1; i < restarts && delay < spec.MaxBackoff; i++ {
+		if delay > spec.MaxBackoff/2 {
+			return spec.MaxBackoff
+		}
+		delay *= 2
+	}
+	if delay > spec.MaxBackoff {
+		return spec.MaxBackoff
+	}
+	return delay
+}
+
+//--------------------
+// SUPERVISOR
+//--------------------
+
+// supervisor restarts its children after failures.
+type supervisor struct {
+	mux      sync.Mutex
+	env      *environment
+	parent   *supervisor
+	spec     SupervisorSpec
+	children map[string]*supervisor
+	restarts []time.Time
+}
+
+// newSupervisor creates a supervisor for the spec.
+func newSupervisor(env *environment, parent *supervisor, spec SupervisorSpec) *supervisor {
+	if spec.MaxRestarts <= 0 {
+		spec.MaxRestarts = 3
+	}
+	if spec.Period <= 0 {
+		spec.Period = 5 * time.Second
+	}
+	if spec.MaxBackoff <= 0 {
+		spec.MaxBackoff = time.Minute
+	}
+	return &supervisor{
+		env:      env,
+		parent:   parent,
+		spec:     spec,
+		children: make(map[string]*supervisor),
+	}
+}
+
+// start starts all children in their order. If one fails
+// the already started ones are stopped again.
+func (s *supervisor) start() error {
+	for i, child := range s.spec.Children {
+		if err := s.startChild(child); err != nil {
+			for j := i - 1; j >= 0; j-- {
+				s.stopChild(s.spec.Children[j])
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// startChild starts a cell or a nested supervisor.
+func (s *supervisor) startChild(child ChildSpec) error {
+	if child.Supervisor != nil {
+		nested := newSupervisor(s.env, s, *child.Supervisor)
+		if err := nested.start(); err != nil {
+			return err
+		}
+		s.children[child.ID] = nested
+		return nil
+	}
+	if err := s.env.StartCell(child.ID, child.Factory(), child.Options...); err != nil {
+		return err
+	}
+	s.env.supervise(child.ID, s)
+	return nil
+}
+
+// stopChild stops a cell or a nested supervisor.
+func (s *supervisor) stopChild(child ChildSpec) {
+	if nested, ok := s.children[child.ID]; ok {
+		for i := len(nested.spec.Children) - 1; i >= 0; i-- {
+			nested.stopChild(nested.spec.Children[i])
+		}
+		delete(s.children, child.ID)
+		return
+	}
+	s.env.unsupervise(child.ID)
+	if err := s.env.StopCell(child.ID); err != nil && !IsInvalidIdError(err) {
+		s.env.log.Error("supervisor cannot stop cell", "supervisor", s.spec.ID, LogCellKey, child.ID, LogErrorKey, err)
+	}
+}
+
+// restartChild restarts a cell with a fresh behavior or
+// all children of a nested supervisor.
+func (s *supervisor) restartChild(child ChildSpec) error {
+	if nested, ok := s.children[child.ID]; ok {
+		nested.mux.Lock()
+		defer nested.mux.Unlock()
+		nested.restarts = nil
+		for _, nestedChild := range nested.spec.Children {
+			if err := nested.restartChild(nestedChild); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	cell, err := s.env.cells.cell(child.ID)
+	if err != nil {
+		// Cell has been stopped manually.
+		return nil
+	}
+	return cell.restart(child.Factory())
+}
+
+// childFailed handles the failure of a child based on
+// the restart strategy.
+func (s *supervisor) childFailed(id string, reason error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.env.isStopping() {
+		return
+	}
+	// Check the restart intensity.
+	now := time.Now()
+	restarts := []time.Time{}
+	for _, restart := range s.restarts {
+		if now.Sub(restart) < s.spec.Period {
+			restarts = append(restarts, restart)
+		}
+	}
+	s.restarts = append(restarts, now)
+	if len(s.restarts) > s.spec.MaxRestarts {
+		s.giveUp(errors.Annotate(reason, ErrSupervisorGaveUp, errorMessages, s.spec.ID))
+		return
+	}
+	// Wait for the backoff without blocking the handling
+	// of further failures.
+	if s.spec.Backoff > 0 {
+		delay := s.spec.backoff(len(s.restarts))
+		s.mux.Unlock()
+		time.Sleep(delay)
+		s.mux.Lock()
+		if s.env.isStopping() {
+			return
+		}
+	}
+	// Restart children based on strategy.
+	restarting := false
+	for _, child := range s.spec.Children {
+		switch {
+		case child.ID == id:
+			restarting = true
+		case s.spec.Strategy == OneForAll:
+		case s.spec.Strategy == RestForOne && restarting:
+		default:
+			continue
+		}
+		if err := s.restartChild(child); err != nil {
+			s.giveUp(errors.Annotate(err, ErrSupervisorGaveUp, errorMessages, s.spec.ID))
+			return
+		}
+		if s.spec.Strategy == OneForOne {
+			return
+		}
+	}
+}
+
+// giveUp lets the parent handle the failure, it will restart all
+// children. Without a parent all children are stopped.
+func (s *supervisor) giveUp(err error) {
+	s.env.log.Error("supervisor gives up", "supervisor", s.spec.ID, LogErrorKey, err)
+	if s.parent != nil {
+		go s.parent.childFailed(s.spec.ID, err)
+		return
+	}
+	for i := len(s.spec.Children) - 1; i >= 0; i-- {
+		s.stopChild(s.spec.Children[i])
+	}
+	s.env.removeSupervisor(s)
+}
+
+// EOF
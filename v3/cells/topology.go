@@ -0,0 +1,133 @@
+// Tideland Go Cell Network - Cells - Topology
+//
+// Copyright (C) 2010-2015 Frank Mueller / Tideland / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package cells
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+//--------------------
+// TOPOLOGY
+//--------------------
+
+// CellInfo describes one cell of a topology.
+type CellInfo struct {
+	// ID is the ID of the cell.
+	ID string
+
+	// Behavior is the type name of the behavior.
+	Behavior string
+
+	// Subscribers are the IDs of the subscribed cells.
+	Subscribers []string
+
+	// QueueLen is the number of queued events, -1 if
+	// the queue cannot report it.
+	QueueLen int
+
+	// Dropped is the number of dropped events.
+	Dropped int64
+}
+
+// Topology is a snapshot of the cells of an environment
+// and their subscriptions.
+type Topology struct {
+	// EnvironmentID is the ID of the environment.
+	EnvironmentID string
+
+	// Cells are the cells of the environment sorted by ID.
+	Cells []CellInfo
+}
+
+// newTopology creates a snapshot of the cells of the environment.
+func newTopology(env *environment) Topology {
+	t := Topology{
+		EnvironmentID: env.ID(),
+		Cells:         env.cells.infos(),
+	}
+	sort.Slice(t.Cells, func(i, j int) bool { return t.Cells[i].ID < t.Cells[j].ID })
+	return t
+}
+
+// newCellInfo returns the information about a cell.
+func newCellInfo(c *cell) CellInfo {
+	info := CellInfo{
+		ID:          c.id,
+		Behavior:    fmt.Sprintf("%T", c.currentBehavior()),
+		Subscribers: c.subscribers.ids(),
+		QueueLen:    -1,
+	}
+	sort.Strings(info.Subscribers)
+	if queue, ok := c.queue.(MeasurableEventQueue); ok {
+		info.QueueLen = queue.Len()
+		info.Dropped = queue.Dropped()
+	}
+	return info
+}
+
+// DOT returns the topology in the Graphviz DOT language.
+func (t Topology) DOT() string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "digraph %q {\n", t.EnvironmentID)
+	for _, info := range t.Cells {
+		label := fmt.Sprintf("%s\n%s\nqueue: %s", info.ID, info.Behavior, info.queueLabel())
+		fmt.Fprintf(&buf, "\t%q [label=%q];\n", info.ID, label)
+	}
+	for _, info := range t.Cells {
+		for _, sid := range info.Subscribers {
+			fmt.Fprintf(&buf, "\t%q -> %q;\n", info.ID, sid)
+		}
+	}
+	buf.WriteString("}\n")
+	return buf.String()
+}
+
+// Mermaid returns the topology as Mermaid flowchart.
+func (t Topology) Mermaid() string {
+	var buf bytes.Buffer
+	nodes := make(map[string]string)
+	for i, info := range t.Cells {
+		nodes[info.ID] = fmt.Sprintf("cell%d", i)
+	}
+	buf.WriteString("graph LR\n")
+	for _, info := range t.Cells {
+		label := fmt.Sprintf("%s<br/>%s<br/>queue: %s", info.ID, info.Behavior, info.queueLabel())
+		fmt.Fprintf(&buf, "\t%s[\"%s\"]\n", nodes[info.ID], mermaidEscape(label))
+	}
+	for _, info := range t.Cells {
+		for _, sid := range info.Subscribers {
+			if node, ok := nodes[sid]; ok {
+				fmt.Fprintf(&buf, "\t%s --> %s\n", nodes[info.ID], node)
+			}
+		}
+	}
+	return buf.String()
+}
+
+// queueLabel returns the queue length for the export.
+func (info CellInfo) queueLabel() string {
+	if info.QueueLen < 0 {
+		return "n/a"
+	}
+	return fmt.Sprintf("%d", info.QueueLen)
+}
+
+// mermaidEscape escapes the characters not allowed
+// inside of a Mermaid label.
+func mermaidEscape(s string) string {
+	return strings.NewReplacer(`"`, "#quot;", "<br/>", "<br/>", "<", "#lt;", ">", "#gt;").Replace(s)
+}
+
+// EOF
@@ -0,0 +1,1058 @@
+// Tideland Go Cell Network - Cells - Transport
+//
+// Copyright (C) 2010-2015 Frank Mueller / Tideland / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package cells
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tideland/goas/v2/loop"
+	"github.com/tideland/goas/v3/errors"
+)
+
+//--------------------
+// CONSTANTS
+//--------------------
+
+const (
+	// DefaultHeartbeat is the default interval of the heartbeats
+	// of links. A link is seen as broken if nothing has been
+	// received for three heartbeats.
+	DefaultHeartbeat = 5 * time.Second
+
+	// minReconnectDelay and maxReconnectDelay limit the delay
+	// between two connection attempts of a broken link.
+	minReconnectDelay = 100 * time.Millisecond
+	maxReconnectDelay = 5 * time.Second
+
+	// maxFrameSize is the maximum size of a link message.
+	maxFrameSize = 64 << 20
+
+	// linkResponseTopic is the topic of the events
+	// transporting request responses.
+	linkResponseTopic = "response"
+
+	// linkEmitQueueSize is the number of received emits a
+	// peer buffers while they wait for the target cells.
+	linkEmitQueueSize = 256
+)
+
+// Kinds of link messages.
+const (
+	msgHello       = "hello"
+	msgPing        = "ping"
+	msgPong        = "pong"
+	msgEmit        = "emit"
+	msgRequest     = "request"
+	msgSubscribe   = "subscribe"
+	msgUnsubscribe = "unsubscribe"
+	msgEvent       = "event"
+	msgResponse    = "response"
+	msgError       = "error"
+)
+
+// forwarderCounter makes the IDs of forwarder cells unique.
+var forwarderCounter uint64
+
+//--------------------
+// INTERFACES
+//--------------------
+
+// Listener accepts links of other environments.
+type Listener interface {
+	// Addr returns the network address of the listener.
+	Addr() net.Addr
+
+	// Close stops listening and closes the accepted links.
+	Close() error
+}
+
+// Link connects an environment to a remote one. It allows to emit
+// events to remote cells, to request them, and to subscribe local
+// cells to them. Events and payloads are transported encoded with
+// the transport codec, so scenes and other local values get lost.
+// A broken link is reconnected automatically, its subscriptions
+// are restored afterwards.
+type Link interface {
+	// RemoteID returns the ID of the remote environment.
+	RemoteID() string
+
+	// Connected returns true if the link is currently connected.
+	Connected() bool
+
+	// Emit emits an event to the remote cell with the given ID.
+	Emit(id string, event Event) error
+
+	// EmitNew creates an event and emits it to the remote
+	// cell with the given ID.
+	EmitNew(id, topic string, payload interface{}) error
+
+	// Request emits a request to the remote cell with the given
+	// ID and returns the decoded response.
+	Request(id, topic string, payload interface{}, timeout time.Duration) (interface{}, error)
+
+	// Subscribe assigns local cells as receivers of the events
+	// emitted by the remote cell with the emitter ID.
+	Subscribe(emitterID string, subscriberIDs ...string) error
+
+	// Unsubscribe removes the assignment of local cells
+	// to the remote emitter cell.
+	Unsubscribe(emitterID string, subscriberIDs ...string) error
+
+	// StartProxy starts a local cell with the given ID forwarding
+	// its events and requests to the remote cell. So local cells
+	// can subscribe the remote one through the proxy.
+	StartProxy(id, remoteID string) error
+
+	// Close stops the link.
+	Close() error
+}
+
+//--------------------
+// LINK AUTHORIZATION
+//--------------------
+
+// LinkOperation tells which operation a linked environment
+// wants to perform.
+type LinkOperation int
+
+const (
+	// LinkConnect is the connecting of an environment. The
+	// cell ID is empty.
+	LinkConnect LinkOperation = iota
+
+	// LinkEmit is the emitting of an event to a cell.
+	LinkEmit
+
+	// LinkRequest is the request of a cell.
+	LinkRequest
+
+	// LinkSubscribe is the subscription to a cell. It starts
+	// a forwarder cell with the ID "link-<n>:<cell ID>".
+	LinkSubscribe
+)
+
+// String is specified on the Stringer interface.
+func (op LinkOperation) String() string {
+	switch op {
+	case LinkConnect:
+		return "connect"
+	case LinkEmit:
+		return "emit"
+	case LinkRequest:
+		return "request"
+	case LinkSubscribe:
+		return "subscribe"
+	}
+	return "unknown"
+}
+
+// LinkAuthorizer is called by a listener before an operation of a
+// linked environment is performed. The remote ID is the one the
+// environment sent when connecting and the address is the one of
+// its connection. Returning an error rejects the operation. Note
+// that the remote ID is not authenticated, links themselves have
+// to be protected by the network, e.g. by listening on a Unix
+// socket with restricted permissions.
+type LinkAuthorizer func(op LinkOperation, remoteID string, remoteAddr net.Addr, cellID string) error
+
+// AllowEnvironments returns a link authorizer only accepting
+// links of environments with the given IDs.
+func AllowEnvironments(remoteIDs ...string) LinkAuthorizer {
+	allowed := make(map[string]bool)
+	for _, id := range remoteIDs {
+		allowed[id] = true
+	}
+	return func(op LinkOperation, remoteID string, remoteAddr net.Addr, cellID string) error {
+		if op == LinkConnect && !allowed[remoteID] {
+			return fmt.Errorf("environment %q is not allowed", remoteID)
+		}
+		return nil
+	}
+}
+
+// AllowCells returns a link authorizer only allowing to emit to,
+// request, and subscribe the cells with the given IDs.
+func AllowCells(ids ...string) LinkAuthorizer {
+	allowed := make(map[string]bool)
+	for _, id := range ids {
+		allowed[id] = true
+	}
+	return func(op LinkOperation, remoteID string, remoteAddr net.Addr, cellID string) error {
+		if op != LinkConnect && !allowed[cellID] {
+			return fmt.Errorf("cell %q is not allowed", cellID)
+		}
+		return nil
+	}
+}
+
+//--------------------
+// LINK MESSAGES
+//--------------------
+
+// linkMessage is the message exchanged between linked environments.
+type linkMessage struct {
+	Kind          string        `json:"kind"`
+	Serial        uint64        `json:"serial,omitempty"`
+	EnvironmentID string        `json:"environment_id,omitempty"`
+	CellID        string        `json:"cell_id,omitempty"`
+	Event         []byte        `json:"event,omitempty"`
+	Timeout       time.Duration `json:"timeout,omitempty"`
+	Heartbeat     time.Duration `json:"heartbeat,omitempty"`
+	Error         string        `json:"error,omitempty"`
+}
+
+// linkConn sends and receives length prefixed link messages.
+type linkConn struct {
+	conn    net.Conn
+	reader  *bufio.Reader
+	timeout time.Duration
+	mux     sync.Mutex
+}
+
+// newLinkConn wraps a network connection. The timeout is
+// used for reading and writing each message.
+func newLinkConn(conn net.Conn, timeout time.Duration) *linkConn {
+	return &linkConn{
+		conn:    conn,
+		reader:  bufio.NewReader(conn),
+		timeout: timeout,
+	}
+}
+
+// send writes a message to the connection.
+func (lc *linkConn) send(m *linkMessage) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	frame := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(frame, uint32(len(data)))
+	copy(frame[4:], data)
+	lc.mux.Lock()
+	defer lc.mux.Unlock()
+	lc.conn.SetWriteDeadline(time.Now().Add(lc.timeout))
+	_, err = lc.conn.Write(frame)
+	return err
+}
+
+// receive reads the next message from the connection.
+func (lc *linkConn) receive() (*linkMessage, error) {
+	lc.conn.SetReadDeadline(time.Now().Add(lc.timeout))
+	var header [4]byte
+	if _, err := io.ReadFull(lc.reader, header[:]); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(header[:])
+	if size > maxFrameSize {
+		return nil, errors.New(ErrLinkProtocol, errorMessages, fmt.Sprintf("message of %d bytes too large", size))
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(lc.reader, data); err != nil {
+		return nil, err
+	}
+	var m linkMessage
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, errors.Annotate(err, ErrLinkProtocol, errorMessages, "invalid message")
+	}
+	return &m, nil
+}
+
+// close closes the connection.
+func (lc *linkConn) close() error {
+	return lc.conn.Close()
+}
+
+//--------------------
+// LISTENER
+//--------------------
+
+// listener implements the Listener interface.
+type listener struct {
+	env         *environment
+	ln          net.Listener
+	authorizers []LinkAuthorizer
+	mux         sync.Mutex
+	peers       map[*peer]struct{}
+	closed      bool
+	closeErr    error
+}
+
+// newListener starts listening at the network address.
+func newListener(env *environment, network, address string, authorizers []LinkAuthorizer) (*listener, error) {
+	ln, err := net.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+	l := &listener{
+		env:         env,
+		ln:          ln,
+		authorizers: authorizers,
+		peers:       make(map[*peer]struct{}),
+	}
+	go l.acceptLoop()
+	env.log.Info("cells environment listening", "address", ln.Addr().String())
+	return l, nil
+}
+
+// Addr is specified on the Listener interface.
+func (l *listener) Addr() net.Addr {
+	return l.ln.Addr()
+}
+
+// Close is specified on the Listener interface.
+func (l *listener) Close() error {
+	l.mux.Lock()
+	if l.closed {
+		l.mux.Unlock()
+		return l.closeErr
+	}
+	l.closed = true
+	l.closeErr = l.ln.Close()
+	peers := []*peer{}
+	for p := range l.peers {
+		peers = append(peers, p)
+	}
+	l.mux.Unlock()
+	for _, p := range peers {
+		p.close()
+	}
+	l.env.removeTransport(l)
+	return l.closeErr
+}
+
+// acceptLoop accepts links until the listener is closed.
+func (l *listener) acceptLoop() {
+	for {
+		conn, err := l.ln.Accept()
+		if err != nil {
+			l.mux.Lock()
+			closed := l.closed
+			l.mux.Unlock()
+			if !closed {
+				l.env.log.Error("cells environment stops accepting links", LogErrorKey, err)
+			}
+			return
+		}
+		p := newPeer(l, conn)
+		l.mux.Lock()
+		if l.closed {
+			l.mux.Unlock()
+			conn.Close()
+			return
+		}
+		l.peers[p] = struct{}{}
+		l.mux.Unlock()
+		go p.serve()
+	}
+}
+
+// removePeer removes a closed peer.
+func (l *listener) removePeer(p *peer) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	delete(l.peers, p)
+}
+
+//--------------------
+// PEER
+//--------------------
+
+// peer serves one accepted link.
+type peer struct {
+	listener   *listener
+	env        *environment
+	lc         *linkConn
+	remoteID   string
+	ctx        context.Context
+	cancel     func()
+	emits      chan *linkMessage
+	mux        sync.Mutex
+	forwarders map[string]string
+	closeOnce  sync.Once
+}
+
+// newPeer creates the peer for an accepted connection.
+func newPeer(l *listener, conn net.Conn) *peer {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &peer{
+		listener:   l,
+		env:        l.env,
+		lc:         newLinkConn(conn, 3*l.env.heartbeat),
+		ctx:        ctx,
+		cancel:     cancel,
+		emits:      make(chan *linkMessage, linkEmitQueueSize),
+		forwarders: make(map[string]string),
+	}
+}
+
+// authorize lets the authorizers of the listener check
+// an operation of the remote environment.
+func (p *peer) authorize(op LinkOperation, cellID string) error {
+	for _, authorizer := range p.listener.authorizers {
+		if err := authorizer(op, p.remoteID, p.lc.conn.RemoteAddr(), cellID); err != nil {
+			return errors.Annotate(err, ErrLinkForbidden, errorMessages, op, cellID, p.remoteID)
+		}
+	}
+	return nil
+}
+
+// serve handles the messages of the remote environment
+// until the connection breaks.
+func (p *peer) serve() {
+	defer p.close()
+	hello, err := p.lc.receive()
+	if err != nil {
+		p.env.log.Warn("cells environment cannot accept link", LogErrorKey, err)
+		return
+	}
+	if hello.Kind != msgHello {
+		p.env.log.Warn("cells environment cannot accept link without hello", "kind", hello.Kind)
+		return
+	}
+	p.remoteID = hello.EnvironmentID
+	if hello.Heartbeat > 0 {
+		p.lc.timeout = 3 * hello.Heartbeat
+	}
+	if err := p.authorize(LinkConnect, ""); err != nil {
+		p.env.log.Warn("cells environment rejects link", "remote", p.remoteID, LogErrorKey, err)
+		p.reply(hello, err)
+		return
+	}
+	if err := p.lc.send(&linkMessage{Kind: msgHello, EnvironmentID: p.env.ID()}); err != nil {
+		p.env.log.Warn("cells environment cannot accept link", LogErrorKey, err)
+		return
+	}
+	p.env.log.Info("cells environment linked", "remote", p.remoteID)
+	go p.emitLoop()
+	for {
+		m, err := p.lc.receive()
+		if err != nil {
+			p.env.log.Warn("link broken", "remote", p.remoteID, LogErrorKey, err)
+			return
+		}
+		switch m.Kind {
+		case msgPing:
+			err = p.lc.send(&linkMessage{Kind: msgPong})
+		case msgEmit:
+			err = p.enqueueEmit(m)
+		case msgRequest:
+			go p.request(m)
+		case msgSubscribe:
+			err = p.reply(m, p.subscribe(m.CellID))
+		case msgUnsubscribe:
+			err = p.reply(m, p.unsubscribe(m.CellID))
+		default:
+			err = p.reply(m, errors.New(ErrLinkProtocol, errorMessages, "unexpected message "+m.Kind))
+		}
+		if err != nil {
+			p.env.log.Warn("link broken", "remote", p.remoteID, LogErrorKey, err)
+			return
+		}
+	}
+}
+
+// reply sends the response or the error of a message.
+func (p *peer) reply(m *linkMessage, err error) error {
+	if err != nil {
+		return p.lc.send(&linkMessage{Kind: msgError, Serial: m.Serial, Error: err.Error()})
+	}
+	return p.lc.send(&linkMessage{Kind: msgResponse, Serial: m.Serial})
+}
+
+// enqueueEmit passes a received emit to the emit loop, so a full
+// queue of the target cell doesn't block reading. If too many
+// emits are waiting already the emit fails.
+func (p *peer) enqueueEmit(m *linkMessage) error {
+	if err := p.authorize(LinkEmit, m.CellID); err != nil {
+		return p.reply(m, err)
+	}
+	select {
+	case p.emits <- m:
+		return nil
+	default:
+		return p.reply(m, errors.New(ErrQueueOverflow, errorMessages, linkEmitQueueSize, fmt.Sprintf("emit to %q", m.CellID)))
+	}
+}
+
+// emitLoop emits the received events in their order
+// until the peer is closed.
+func (p *peer) emitLoop() {
+	for {
+		select {
+		case <-p.ctx.Done():
+			return
+		case m := <-p.emits:
+			if err := p.reply(m, p.emit(m)); err != nil {
+				p.env.log.Warn("cannot reply to emit", "remote", p.remoteID, LogErrorKey, err)
+			}
+		}
+	}
+}
+
+// emit emits a received event to the local cell. It waits at
+// most the default timeout for the queue of the cell.
+func (p *peer) emit(m *linkMessage) error {
+	event, err := p.env.transportCodec.Decode(m.Event)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(p.ctx, DefaultTimeout)
+	defer cancel()
+	return p.env.EmitContext(ctx, m.CellID, event)
+}
+
+// request performs a received request and sends the response.
+func (p *peer) request(m *linkMessage) {
+	if err := p.authorize(LinkRequest, m.CellID); err != nil {
+		p.reply(m, err)
+		return
+	}
+	event, err := p.env.transportCodec.Decode(m.Event)
+	if err != nil {
+		p.reply(m, err)
+		return
+	}
+	timeout := m.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	response, err := p.env.Request(m.CellID, event.Topic(), event.Payload(), nil, timeout)
+	if err != nil {
+		p.reply(m, err)
+		return
+	}
+	responseEvent, err := NewEvent(linkResponseTopic, PayloadValues{DefaultPayload: response}, nil)
+	if err != nil {
+		p.reply(m, err)
+		return
+	}
+	data, err := p.env.transportCodec.Encode(responseEvent)
+	if err != nil {
+		p.reply(m, err)
+		return
+	}
+	if err := p.lc.send(&linkMessage{Kind: msgResponse, Serial: m.Serial, Event: data}); err != nil {
+		p.env.log.Warn("cannot send response", "remote", p.remoteID, LogErrorKey, err)
+	}
+}
+
+// subscribe starts a cell forwarding the events of the
+// emitter cell to the remote environment.
+func (p *peer) subscribe(emitterID string) error {
+	if err := p.authorize(LinkSubscribe, emitterID); err != nil {
+		return err
+	}
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	if _, ok := p.forwarders[emitterID]; ok {
+		return nil
+	}
+	id := fmt.Sprintf("link-%d:%s", atomic.AddUint64(&forwarderCounter, 1), emitterID)
+	if err := p.env.StartCell(id, &forwarderBehavior{p, emitterID}); err != nil {
+		return err
+	}
+	if err := p.env.Subscribe(emitterID, id); err != nil {
+		p.env.StopCell(id)
+		return err
+	}
+	p.forwarders[emitterID] = id
+	return nil
+}
+
+// unsubscribe stops the forwarding cell of the emitter cell.
+func (p *peer) unsubscribe(emitterID string) error {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	id, ok := p.forwarders[emitterID]
+	if !ok {
+		return nil
+	}
+	delete(p.forwarders, emitterID)
+	return p.env.StopCell(id)
+}
+
+// close closes the connection and stops the forwarding cells.
+func (p *peer) close() {
+	p.closeOnce.Do(func() {
+		p.cancel()
+		p.lc.close()
+		p.mux.Lock()
+		for emitterID, id := range p.forwarders {
+			if err := p.env.StopCell(id); err != nil && !IsInvalidIdError(err) {
+				p.env.log.Error("cannot stop forwarder", LogCellKey, emitterID, LogErrorKey, err)
+			}
+		}
+		p.forwarders = make(map[string]string)
+		p.mux.Unlock()
+		p.listener.removePeer(p)
+	})
+}
+
+// forwarderBehavior sends the events of the emitter cell
+// it is subscribed to to a linked environment.
+type forwarderBehavior struct {
+	peer      *peer
+	emitterID string
+}
+
+// Init is specified on the Behavior interface.
+func (b *forwarderBehavior) Init(ctx Context) error {
+	return nil
+}
+
+// Terminate is specified on the Behavior interface.
+func (b *forwarderBehavior) Terminate() error {
+	return nil
+}
+
+// ProcessEvent is specified on the Behavior interface.
+func (b *forwarderBehavior) ProcessEvent(event Event) error {
+	data, err := b.peer.env.transportCodec.Encode(event)
+	if err != nil {
+		b.peer.env.log.Error("cannot forward event", LogCellKey, b.emitterID, LogErrorKey, err)
+		return nil
+	}
+	m := &linkMessage{Kind: msgEvent, CellID: b.emitterID, Event: data}
+	if err := b.peer.lc.send(m); err != nil {
+		b.peer.env.log.Warn("cannot forward event", LogCellKey, b.emitterID, "remote", b.peer.remoteID, LogErrorKey, err)
+	}
+	return nil
+}
+
+// Recover is specified on the Behavior interface.
+func (b *forwarderBehavior) Recover(r interface{}) error {
+	return nil
+}
+
+//--------------------
+// LINK
+//--------------------
+
+// link implements the Link interface.
+type link struct {
+	env           *environment
+	network       string
+	address       string
+	remoteID      string
+	mux           sync.Mutex
+	lc            *linkConn
+	serial        uint64
+	pending       map[uint64]chan *linkMessage
+	subscriptions map[string]map[string]bool
+	loop          loop.Loop
+}
+
+// newLink connects to the environment listening at the
+// network address.
+func newLink(env *environment, network, address string) (*link, error) {
+	l := &link{
+		env:           env,
+		network:       network,
+		address:       address,
+		pending:       make(map[uint64]chan *linkMessage),
+		subscriptions: make(map[string]map[string]bool),
+	}
+	lc, err := l.dial()
+	if err != nil {
+		return nil, err
+	}
+	l.lc = lc
+	l.loop = loop.Go(l.backendLoop)
+	env.log.Info("cells environment linked", "remote", l.remoteID)
+	return l, nil
+}
+
+// RemoteID is specified on the Link interface.
+func (l *link) RemoteID() string {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	return l.remoteID
+}
+
+// Connected is specified on the Link interface.
+func (l *link) Connected() bool {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	return l.lc != nil
+}
+
+// Emit is specified on the Link interface.
+func (l *link) Emit(id string, event Event) error {
+	data, err := l.env.transportCodec.Encode(event)
+	if err != nil {
+		return err
+	}
+	_, err = l.call(&linkMessage{Kind: msgEmit, CellID: id, Event: data}, DefaultTimeout)
+	return err
+}
+
+// EmitNew is specified on the Link interface.
+func (l *link) EmitNew(id, topic string, payload interface{}) error {
+	event, err := NewEvent(topic, payload, nil)
+	if err != nil {
+		return err
+	}
+	return l.Emit(id, event)
+}
+
+// Request is specified on the Link interface.
+func (l *link) Request(id, topic string, payload interface{}, timeout time.Duration) (interface{}, error) {
+	event, err := NewEvent(topic, payload, nil)
+	if err != nil {
+		return nil, err
+	}
+	data, err := l.env.transportCodec.Encode(event)
+	if err != nil {
+		return nil, err
+	}
+	reply, err := l.call(&linkMessage{Kind: msgRequest, CellID: id, Event: data, Timeout: timeout}, timeout)
+	if err != nil {
+		return nil, err
+	}
+	responseEvent, err := l.env.transportCodec.Decode(reply.Event)
+	if err != nil {
+		return nil, err
+	}
+	response, _ := responseEvent.Payload().Get(DefaultPayload)
+	return response, nil
+}
+
+// Subscribe is specified on the Link interface.
+func (l *link) Subscribe(emitterID string, subscriberIDs ...string) error {
+	for _, id := range subscriberIDs {
+		if !l.env.HasCell(id) {
+			return errors.New(ErrInvalidID, errorMessages, id)
+		}
+	}
+	l.mux.Lock()
+	subscribers, ok := l.subscriptions[emitterID]
+	if !ok {
+		subscribers = make(map[string]bool)
+		l.subscriptions[emitterID] = subscribers
+	}
+	for _, id := range subscriberIDs {
+		subscribers[id] = true
+	}
+	l.mux.Unlock()
+	if ok {
+		return nil
+	}
+	if _, err := l.call(&linkMessage{Kind: msgSubscribe, CellID: emitterID}, DefaultTimeout); err != nil {
+		l.mux.Lock()
+		delete(l.subscriptions, emitterID)
+		l.mux.Unlock()
+		return err
+	}
+	return nil
+}
+
+// Unsubscribe is specified on the Link interface.
+func (l *link) Unsubscribe(emitterID string, subscriberIDs ...string) error {
+	l.mux.Lock()
+	subscribers, ok := l.subscriptions[emitterID]
+	if !ok {
+		l.mux.Unlock()
+		return nil
+	}
+	for _, id := range subscriberIDs {
+		delete(subscribers, id)
+	}
+	if len(subscribers) > 0 {
+		l.mux.Unlock()
+		return nil
+	}
+	delete(l.subscriptions, emitterID)
+	l.mux.Unlock()
+	_, err := l.call(&linkMessage{Kind: msgUnsubscribe, CellID: emitterID}, DefaultTimeout)
+	return err
+}
+
+// StartProxy is specified on the Link interface.
+func (l *link) StartProxy(id, remoteID string) error {
+	return l.env.StartCell(id, &proxyBehavior{l, remoteID})
+}
+
+// Close is specified on the Link interface.
+func (l *link) Close() error {
+	l.env.removeTransport(l)
+	return l.loop.Stop()
+}
+
+// dial connects to the remote environment and exchanges
+// the hello messages.
+func (l *link) dial() (*linkConn, error) {
+	timeout := 3 * l.env.heartbeat
+	conn, err := net.DialTimeout(l.network, l.address, timeout)
+	if err != nil {
+		return nil, err
+	}
+	lc := newLinkConn(conn, timeout)
+	hello := &linkMessage{Kind: msgHello, EnvironmentID: l.env.ID(), Heartbeat: l.env.heartbeat}
+	if err := lc.send(hello); err != nil {
+		lc.close()
+		return nil, err
+	}
+	reply, err := lc.receive()
+	if err != nil {
+		lc.close()
+		return nil, err
+	}
+	if reply.Kind == msgError {
+		lc.close()
+		return nil, errors.New(ErrRemote, errorMessages, l.address, reply.Error)
+	}
+	if reply.Kind != msgHello {
+		lc.close()
+		return nil, errors.New(ErrLinkProtocol, errorMessages, "expected hello, got "+reply.Kind)
+	}
+	l.mux.Lock()
+	l.remoteID = reply.EnvironmentID
+	l.mux.Unlock()
+	return lc, nil
+}
+
+// call sends a message and waits for its response.
+func (l *link) call(m *linkMessage, timeout time.Duration) (*linkMessage, error) {
+	l.mux.Lock()
+	lc := l.lc
+	if lc == nil {
+		l.mux.Unlock()
+		return nil, errors.New(ErrLinkNotConnected, errorMessages, l.address)
+	}
+	l.serial++
+	m.Serial = l.serial
+	replyc := make(chan *linkMessage, 1)
+	l.pending[m.Serial] = replyc
+	l.mux.Unlock()
+	defer func() {
+		l.mux.Lock()
+		delete(l.pending, m.Serial)
+		l.mux.Unlock()
+	}()
+	if err := lc.send(m); err != nil {
+		return nil, errors.Annotate(err, ErrLinkNotConnected, errorMessages, l.address)
+	}
+	select {
+	case reply, ok := <-replyc:
+		if !ok {
+			return nil, errors.New(ErrLinkNotConnected, errorMessages, l.address)
+		}
+		if reply.Kind == msgError {
+			return nil, errors.New(ErrRemote, errorMessages, l.RemoteID(), reply.Error)
+		}
+		return reply, nil
+	case <-time.After(timeout):
+		op := fmt.Sprintf("%s of %q via link to %q", m.Kind, m.CellID, l.address)
+		return nil, errors.New(ErrTimeout, errorMessages, op)
+	}
+}
+
+// backendLoop serves the connection and reconnects
+// it when it's broken.
+func (l *link) backendLoop(lp loop.Loop) error {
+	for {
+		l.mux.Lock()
+		lc := l.lc
+		l.mux.Unlock()
+		stop := l.serve(lp, lc)
+		l.disconnect()
+		if stop || !l.reconnect(lp) {
+			return nil
+		}
+	}
+}
+
+// serve sends the heartbeats and handles the received messages
+// until the connection breaks or the link shall stop.
+func (l *link) serve(lp loop.Loop, lc *linkConn) bool {
+	errc := make(chan error, 1)
+	go func() {
+		errc <- l.readLoop(lc)
+	}()
+	go l.resubscribe()
+	heartbeat := time.NewTicker(l.env.heartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-lp.ShallStop():
+			return true
+		case <-heartbeat.C:
+			if err := lc.send(&linkMessage{Kind: msgPing}); err != nil {
+				l.env.log.Warn("link broken", "address", l.address, LogErrorKey, err)
+				return false
+			}
+		case err := <-errc:
+			l.env.log.Warn("link broken", "address", l.address, LogErrorKey, err)
+			return false
+		}
+	}
+}
+
+// readLoop handles the received messages.
+func (l *link) readLoop(lc *linkConn) error {
+	for {
+		m, err := lc.receive()
+		if err != nil {
+			return err
+		}
+		switch m.Kind {
+		case msgPing:
+			if err := lc.send(&linkMessage{Kind: msgPong}); err != nil {
+				return err
+			}
+		case msgPong:
+		case msgEvent:
+			l.deliver(m)
+		case msgResponse, msgError:
+			l.reply(m)
+		default:
+			return errors.New(ErrLinkProtocol, errorMessages, "unexpected message "+m.Kind)
+		}
+	}
+}
+
+// reply passes a response to the waiting call.
+func (l *link) reply(m *linkMessage) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	if replyc, ok := l.pending[m.Serial]; ok {
+		delete(l.pending, m.Serial)
+		replyc <- m
+	}
+}
+
+// deliver emits a received event to the subscribed local cells.
+func (l *link) deliver(m *linkMessage) {
+	event, err := l.env.transportCodec.Decode(m.Event)
+	if err != nil {
+		l.env.log.Error("cannot deliver event", LogCellKey, m.CellID, LogErrorKey, err)
+		return
+	}
+	l.mux.Lock()
+	ids := []string{}
+	for id := range l.subscriptions[m.CellID] {
+		ids = append(ids, id)
+	}
+	l.mux.Unlock()
+	for _, id := range ids {
+		if err := l.env.Emit(id, event); err != nil {
+			l.env.log.Warn("cannot deliver event", LogCellKey, m.CellID, "target", id, LogErrorKey, err)
+		}
+	}
+}
+
+// resubscribe restores the subscriptions after reconnecting.
+func (l *link) resubscribe() {
+	l.mux.Lock()
+	emitterIDs := []string{}
+	for emitterID := range l.subscriptions {
+		emitterIDs = append(emitterIDs, emitterID)
+	}
+	l.mux.Unlock()
+	for _, emitterID := range emitterIDs {
+		if _, err := l.call(&linkMessage{Kind: msgSubscribe, CellID: emitterID}, DefaultTimeout); err != nil {
+			l.env.log.Error("cannot restore subscription", LogCellKey, emitterID, "address", l.address, LogErrorKey, err)
+		}
+	}
+}
+
+// disconnect closes the connection and lets the
+// waiting calls fail.
+func (l *link) disconnect() {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	if l.lc != nil {
+		l.lc.close()
+		l.lc = nil
+	}
+	for serial, replyc := range l.pending {
+		close(replyc)
+		delete(l.pending, serial)
+	}
+}
+
+// reconnect tries to connect again with a growing delay
+// until it succeeds or the link shall stop.
+func (l *link) reconnect(lp loop.Loop) bool {
+	delay := minReconnectDelay
+	for {
+		select {
+		case <-lp.ShallStop():
+			return false
+		case <-time.After(delay):
+		}
+		lc, err := l.dial()
+		if err == nil {
+			l.mux.Lock()
+			l.lc = lc
+			l.mux.Unlock()
+			l.env.log.Info("cells environment relinked", "remote", l.remoteID)
+			return true
+		}
+		l.env.log.Warn("cannot relink", "address", l.address, LogErrorKey, err)
+		delay *= 2
+		if delay > maxReconnectDelay {
+			delay = maxReconnectDelay
+		}
+	}
+}
+
+// proxyBehavior forwards events and requests to a remote cell.
+type proxyBehavior struct {
+	link     *link
+	remoteID string
+}
+
+// Init is specified on the Behavior interface.
+func (b *proxyBehavior) Init(ctx Context) error {
+	return nil
+}
+
+// Terminate is specified on the Behavior interface.
+func (b *proxyBehavior) Terminate() error {
+	return nil
+}
+
+// ProcessEvent is specified on the Behavior interface.
+func (b *proxyBehavior) ProcessEvent(event Event) error {
+	if _, ok := event.Payload().Get(ResponseChanPayload); ok {
+		timeout := DefaultTimeout
+		if deadline, ok := event.Context().Deadline(); ok {
+			timeout = time.Until(deadline)
+		}
+		response, err := b.link.Request(b.remoteID, event.Topic(), event.Payload(), timeout)
+		if err != nil {
+			return event.Respond(err)
+		}
+		return event.Respond(response)
+	}
+	if err := b.link.Emit(b.remoteID, event); err != nil {
+		b.link.env.log.Warn("proxy cannot emit event", "remote", b.remoteID, LogErrorKey, err)
+	}
+	return nil
+}
+
+// Recover is specified on the Behavior interface.
+func (b *proxyBehavior) Recover(r interface{}) error {
+	return nil
+}
+
+// EOF
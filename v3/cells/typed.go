@@ -0,0 +1,182 @@
+// Tideland Go Cell Network - Cells - Typed Helpers
+//
+// Copyright (C) 2010-2015 Frank Mueller / Tideland / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package cells
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"context"
+	"time"
+
+	"github.com/tideland/goas/v1/scene"
+)
+
+//--------------------
+// TYPED REQUESTS
+//--------------------
+
+// RequestAs performs a request like Environment.Request() and returns
+// the response as type T. A response of another type returns an
+// invalid response error.
+func RequestAs[T any](
+	env Environment,
+	id, topic string,
+	payload interface{},
+	scn scene.Scene,
+	timeout time.Duration,
+) (T, error) {
+	response, err := env.Request(id, topic, payload, scn, timeout)
+	return responseAs[T](response, err)
+}
+
+// RequestContextAs performs a request like Environment.RequestContext()
+// and returns the response as type T. A response of another type returns
+// an invalid response error.
+func RequestContextAs[T any](
+	ctx context.Context,
+	env Environment,
+	id, topic string,
+	payload interface{},
+	scn scene.Scene,
+) (T, error) {
+	response, err := env.RequestContext(ctx, id, topic, payload, scn)
+	return responseAs[T](response, err)
+}
+
+// responseAs converts a response into the type T.
+func responseAs[T any](response interface{}, err error) (T, error) {
+	var zero T
+	if err != nil {
+		return zero, err
+	}
+	typed, ok := response.(T)
+	if !ok {
+		return zero, NewInvalidResponseError(response)
+	}
+	return typed, nil
+}
+
+//--------------------
+// TYPED BEHAVIOR
+//--------------------
+
+// EventHandler handles an event with the state of a typed behavior.
+type EventHandler[S any] func(ctx Context, state *S, event Event) error
+
+// RequestHandler handles a request with the state of a typed behavior.
+// The returned value is the response, a returned error is the response
+// too and will be returned by Environment.Request().
+type RequestHandler[S any] func(ctx Context, state *S, event Event) (interface{}, error)
+
+// TypedBehavior is a behavior managing a state of type S and
+// dispatching the events to handlers by their topics. The state
+// is only accessed by the handlers, so no locking is needed.
+type TypedBehavior[S any] struct {
+	ctx         Context
+	state       S
+	handlers    map[string]EventHandler[S]
+	fallback    EventHandler[S]
+	onInit      func(ctx Context, state *S) error
+	onTerminate func(state *S) error
+	onRecover   func(state *S, r interface{}) error
+}
+
+// NewTypedBehavior creates a typed behavior with the initial state.
+// Events with topics without handler are ignored.
+func NewTypedBehavior[S any](state S) *TypedBehavior[S] {
+	return &TypedBehavior[S]{
+		state:    state,
+		handlers: make(map[string]EventHandler[S]),
+	}
+}
+
+// Handle sets the handler for events with the topic.
+func (b *TypedBehavior[S]) Handle(topic string, handler EventHandler[S]) *TypedBehavior[S] {
+	b.handlers[topic] = handler
+	return b
+}
+
+// HandleRequest sets the handler for requests with the topic.
+// Its result is used as response.
+func (b *TypedBehavior[S]) HandleRequest(topic string, handler RequestHandler[S]) *TypedBehavior[S] {
+	b.handlers[topic] = func(ctx Context, state *S, event Event) error {
+		response, err := handler(ctx, state, event)
+		if err != nil {
+			return event.Respond(err)
+		}
+		return event.Respond(response)
+	}
+	return b
+}
+
+// HandleDefault sets the handler for events with topics
+// without an own handler.
+func (b *TypedBehavior[S]) HandleDefault(handler EventHandler[S]) *TypedBehavior[S] {
+	b.fallback = handler
+	return b
+}
+
+// OnInit sets a function called when the behavior is initialized.
+func (b *TypedBehavior[S]) OnInit(f func(ctx Context, state *S) error) *TypedBehavior[S] {
+	b.onInit = f
+	return b
+}
+
+// OnTerminate sets a function called when the behavior is terminated.
+func (b *TypedBehavior[S]) OnTerminate(f func(state *S) error) *TypedBehavior[S] {
+	b.onTerminate = f
+	return b
+}
+
+// OnRecover sets a function called when the behavior has to recover,
+// e.g. to reset the state. Without it the state is kept.
+func (b *TypedBehavior[S]) OnRecover(f func(state *S, r interface{}) error) *TypedBehavior[S] {
+	b.onRecover = f
+	return b
+}
+
+// Init is specified on the Behavior interface.
+func (b *TypedBehavior[S]) Init(ctx Context) error {
+	b.ctx = ctx
+	if b.onInit != nil {
+		return b.onInit(ctx, &b.state)
+	}
+	return nil
+}
+
+// Terminate is specified on the Behavior interface.
+func (b *TypedBehavior[S]) Terminate() error {
+	if b.onTerminate != nil {
+		return b.onTerminate(&b.state)
+	}
+	return nil
+}
+
+// ProcessEvent is specified on the Behavior interface.
+func (b *TypedBehavior[S]) ProcessEvent(event Event) error {
+	handler, ok := b.handlers[event.Topic()]
+	if !ok {
+		handler = b.fallback
+	}
+	if handler == nil {
+		return nil
+	}
+	return handler(b.ctx, &b.state, event)
+}
+
+// Recover is specified on the Behavior interface.
+func (b *TypedBehavior[S]) Recover(r interface{}) error {
+	if b.onRecover != nil {
+		return b.onRecover(&b.state, r)
+	}
+	return nil
+}
+
+// EOF
@@ -0,0 +1,257 @@
+// Tideland Go Cell Network - Config - Documents
+//
+// Copyright (C) 2010-2015 Frank Mueller / Tideland / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package config
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"io/ioutil"
+
+	"github.com/tideland/goas/v3/errors"
+	"github.com/tideland/gocn/v3/cells"
+)
+
+//--------------------
+// DOCUMENT
+//--------------------
+
+// CellConfig describes one cell of a document.
+type CellConfig struct {
+	// ID is the ID of the cell.
+	ID string
+
+	// Behavior is the registered name of the behavior.
+	Behavior string
+
+	// Params are passed to the constructor of the behavior.
+	Params cells.PayloadValues
+
+	// Subscribers are the IDs of the subscribed cells.
+	Subscribers []string
+
+	// Line is the line of the cell in the document.
+	Line int
+
+	// Lines of the fields for error messages.
+	behaviorLine    int
+	subscriberLines []int
+}
+
+// Document describes an environment with its cells and
+// their subscriptions.
+type Document struct {
+	// ID is the ID of the environment, it's optional.
+	ID string
+
+	// Cells are the cells in their starting order.
+	Cells []CellConfig
+}
+
+// Parse parses a YAML or JSON document. Documents starting with
+// a brace are parsed as JSON. Errors in the syntax or structure
+// are reported with their lines.
+func Parse(data []byte) (*Document, error) {
+	root, err := parse(data)
+	if err != nil {
+		return nil, err
+	}
+	d := &Document{}
+	verrs := ValidationErrors{}
+	if root.kind != mapNode {
+		verrs = append(verrs, errors.New(ErrInvalidField, errorMessages, root.line, "document", "a mapping"))
+		return nil, errors.Annotate(verrs, ErrInvalidDocument, errorMessages)
+	}
+	for _, key := range root.keys {
+		field := root.fields[key]
+		switch key {
+		case "id":
+			d.ID = stringField(field, key, &verrs)
+		case "cells":
+			if field.kind != seqNode {
+				verrs = append(verrs, errors.New(ErrInvalidField, errorMessages, field.line, key, "a list"))
+				continue
+			}
+			for _, item := range field.items {
+				if cc, ok := cellConfig(item, &verrs); ok {
+					d.Cells = append(d.Cells, cc)
+				}
+			}
+		default:
+			verrs = append(verrs, errors.New(ErrUnknownField, errorMessages, field.line, key))
+		}
+	}
+	if len(verrs) > 0 {
+		return nil, errors.Annotate(verrs, ErrInvalidDocument, errorMessages)
+	}
+	return d, nil
+}
+
+// Validate checks the document for unknown behaviors, duplicate
+// cell IDs, and subscribers not defined in the document. The errors
+// are reported with their lines.
+func (d *Document) Validate() error {
+	verrs := ValidationErrors{}
+	lines := make(map[string]int)
+	for _, cc := range d.Cells {
+		if first, ok := lines[cc.ID]; ok {
+			verrs = append(verrs, errors.New(ErrDuplicateID, errorMessages, cc.Line, cc.ID, first))
+			continue
+		}
+		lines[cc.ID] = cc.Line
+		if _, ok := lookupBehavior(cc.Behavior); !ok {
+			verrs = append(verrs, errors.New(ErrUnknownBehavior, errorMessages, cc.behaviorLine, cc.Behavior, cc.ID))
+		}
+	}
+	for _, cc := range d.Cells {
+		for i, sid := range cc.Subscribers {
+			if _, ok := lines[sid]; !ok {
+				verrs = append(verrs, errors.New(ErrDanglingSubscription, errorMessages, cc.subscriberLine(i), sid, cc.ID))
+			}
+		}
+	}
+	if len(verrs) > 0 {
+		return errors.Annotate(verrs, ErrInvalidDocument, errorMessages)
+	}
+	return nil
+}
+
+// Build validates the document and creates an environment with
+// the passed options. The ID of the document is set before them, so
+// they may override it. The cells are started in their order and
+// subscribed afterwards. In case of an error the environment is
+// stopped again.
+func (d *Document) Build(options ...cells.Option) (cells.Environment, error) {
+	if err := d.Validate(); err != nil {
+		return nil, err
+	}
+	if d.ID != "" {
+		options = append([]cells.Option{cells.ID(d.ID)}, options...)
+	}
+	env := cells.NewEnvironment(options...)
+	fail := func(err error) (cells.Environment, error) {
+		env.Stop()
+		return nil, errors.Annotate(err, ErrBuilding, errorMessages)
+	}
+	for _, cc := range d.Cells {
+		constructor, _ := lookupBehavior(cc.Behavior)
+		behavior, err := constructor(cells.NewPayload(cc.Params))
+		if err != nil {
+			return fail(errors.Annotate(err, ErrBehaviorParams, errorMessages, cc.behaviorLine, cc.Behavior, cc.ID))
+		}
+		if err := env.StartCell(cc.ID, behavior); err != nil {
+			return fail(err)
+		}
+	}
+	for _, cc := range d.Cells {
+		if len(cc.Subscribers) == 0 {
+			continue
+		}
+		if err := env.Subscribe(cc.ID, cc.Subscribers...); err != nil {
+			return fail(err)
+		}
+	}
+	return env, nil
+}
+
+// Load parses the YAML or JSON document and builds the
+// environment with the passed options.
+func Load(data []byte, options ...cells.Option) (cells.Environment, error) {
+	d, err := Parse(data)
+	if err != nil {
+		return nil, err
+	}
+	return d.Build(options...)
+}
+
+// LoadFile reads, parses, and builds the document in the file.
+func LoadFile(filename string, options ...cells.Option) (cells.Environment, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return Load(data, options...)
+}
+
+//--------------------
+// HELPERS
+//--------------------
+
+// cellConfig creates the configuration of a cell out of a node.
+func cellConfig(n *node, verrs *ValidationErrors) (CellConfig, bool) {
+	cc := CellConfig{
+		Line:         n.line,
+		behaviorLine: n.line,
+	}
+	if n.kind != mapNode {
+		*verrs = append(*verrs, errors.New(ErrInvalidField, errorMessages, n.line, "cell", "a mapping"))
+		return cc, false
+	}
+	for _, key := range n.keys {
+		field := n.fields[key]
+		switch key {
+		case "id":
+			cc.ID = stringField(field, key, verrs)
+		case "behavior":
+			cc.Behavior = stringField(field, key, verrs)
+			cc.behaviorLine = field.line
+		case "params":
+			if field.kind != mapNode {
+				*verrs = append(*verrs, errors.New(ErrInvalidField, errorMessages, field.line, key, "a mapping"))
+				continue
+			}
+			cc.Params = cells.PayloadValues(field.interfaceValue().(map[string]interface{}))
+		case "subscribers":
+			if field.kind != seqNode {
+				*verrs = append(*verrs, errors.New(ErrInvalidField, errorMessages, field.line, key, "a list"))
+				continue
+			}
+			for _, item := range field.items {
+				if sid := stringField(item, key, verrs); sid != "" {
+					cc.Subscribers = append(cc.Subscribers, sid)
+					cc.subscriberLines = append(cc.subscriberLines, item.line)
+				}
+			}
+		default:
+			*verrs = append(*verrs, errors.New(ErrUnknownField, errorMessages, field.line, key))
+		}
+	}
+	ok := true
+	if cc.ID == "" {
+		*verrs = append(*verrs, errors.New(ErrMissingField, errorMessages, n.line, "id"))
+		ok = false
+	}
+	if cc.Behavior == "" {
+		*verrs = append(*verrs, errors.New(ErrMissingField, errorMessages, n.line, "behavior"))
+		ok = false
+	}
+	return cc, ok
+}
+
+// stringField returns the value of a string node, otherwise
+// an error is added.
+func stringField(n *node, key string, verrs *ValidationErrors) string {
+	s, ok := n.value.(string)
+	if n.kind != scalarNode || !ok {
+		*verrs = append(*verrs, errors.New(ErrInvalidField, errorMessages, n.line, key, "a string"))
+		return ""
+	}
+	return s
+}
+
+// subscriberLine returns the line of the subscriber with the
+// index, or the line of the cell if it's not known.
+func (cc CellConfig) subscriberLine(i int) int {
+	if i < len(cc.subscriberLines) {
+		return cc.subscriberLines[i]
+	}
+	return cc.Line
+}
+
+// EOF
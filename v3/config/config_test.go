@@ -0,0 +1,254 @@
+// Tideland Go Cell Network - Config - Unit Tests
+//
+// Copyright (C) 2010-2015 Frank Mueller / Tideland / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package config_test
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tideland/goas/v3/errors"
+	"github.com/tideland/gocn/v3/behaviors"
+	"github.com/tideland/gocn/v3/cells"
+	"github.com/tideland/gocn/v3/config"
+	"github.com/tideland/gocn/v3/testsupport"
+	"github.com/tideland/gots/v3/asserts"
+)
+
+//--------------------
+// TESTS
+//--------------------
+
+// TestParse tests parsing YAML and JSON documents.
+func TestParse(t *testing.T) {
+	assert := asserts.NewTestingAssertion(t, true)
+	yamlDoc := `
+# Test environment.
+id: parse-test
+cells:
+  - id: filter
+    behavior: filter
+    params:
+      topics: [a, "b c"]
+      nested:
+        max: 5
+        ratio: 0.5
+        enabled: true
+    subscribers:
+      - collector
+      - 'counter' # Comment.
+  - id: collector
+    behavior: collector
+    params: {max: 100}
+  - id: counter
+    behavior: counter
+`
+	jsonDoc := `{
+	"id": "parse-test",
+	"cells": [
+		{
+			"id": "filter",
+			"behavior": "filter",
+			"params": {
+				"topics": ["a", "b c"],
+				"nested": {"max": 5, "ratio": 0.5, "enabled": true}
+			},
+			"subscribers": ["collector", "counter"]
+		},
+		{"id": "collector", "behavior": "collector", "params": {"max": 100}},
+		{"id": "counter", "behavior": "counter"}
+	]
+}`
+	for _, doc := range []string{yamlDoc, jsonDoc} {
+		d := mustParse(assert, doc)
+		assert.Equal(d.ID, "parse-test")
+		assert.Length(d.Cells, 3)
+		assert.Equal(d.Cells[0].ID, "filter")
+		assert.Equal(d.Cells[0].Behavior, "filter")
+		assert.Equal(d.Cells[0].Params["topics"], []interface{}{"a", "b c"})
+		assert.Equal(d.Cells[0].Params["nested"], map[string]interface{}{"max": 5, "ratio": 0.5, "enabled": true})
+		assert.Equal(d.Cells[0].Subscribers, []string{"collector", "counter"})
+		assert.Equal(d.Cells[1].Params["max"], 100)
+		assert.Equal(d.Cells[2].ID, "counter")
+		assert.Nil(d.Validate())
+	}
+	assert.Equal(mustParse(assert, yamlDoc).Cells[1].Line, 16)
+	assert.Equal(mustParse(assert, jsonDoc).Cells[1].Line, 13)
+
+	// Escaped quotes and comment characters are part of strings.
+	for _, doc := range []string{
+		"id: \"a \\\"quoted\\\" # id\" # Comment.\ncells: []\n",
+		"id: 'a \"quoted\" # id' # Comment.\ncells: []\n",
+		`{"id": "a \"quoted\" # id", "cells": []}`,
+	} {
+		d := mustParse(assert, doc)
+		assert.Equal(d.ID, `a "quoted" # id`)
+		assert.Empty(d.Cells)
+	}
+	d := mustParse(assert, "id: 'it''s: # here'\ncells:\n  - {id: \"a\\\", b\", behavior: 'x'', y'}\n")
+	assert.Equal(d.ID, "it's: # here")
+	assert.Equal(d.Cells[0].ID, `a", b`)
+	assert.Equal(d.Cells[0].Behavior, "x', y")
+}
+
+// TestParseErrors tests the reporting of syntax and
+// structure errors.
+func TestParseErrors(t *testing.T) {
+	assert := asserts.NewTestingAssertion(t, true)
+
+	_, err := config.Parse([]byte("cells:\n  - id: a\n     behavior: b\n"))
+	assert.True(config.IsSyntaxError(err))
+	assert.ErrorMatch(err, "line 3: syntax error: unexpected indentation")
+
+	_, err = config.Parse([]byte("id: x\ncells: [\"a\\\"]\n"))
+	assert.True(config.IsSyntaxError(err))
+	assert.ErrorMatch(err, "line 2: syntax error: unterminated quoted string")
+
+	_, err = config.Parse([]byte("{\n\"cells\": [\n}"))
+	assert.True(config.IsSyntaxError(err))
+	assert.ErrorMatch(err, "line 3: syntax error: .*")
+
+	structureErrors := `invalid document: line 2: unknown field "name"; ` +
+		`line 5: field "behavior" has to be a string; line 4: missing field "behavior"; ` +
+		`line 7: unknown field "color"; line 6: missing field "id"`
+	_, err = config.Parse([]byte(`
+name: foo
+cells:
+  - id: a
+    behavior: [b]
+  - behavior: c
+    color: red
+`))
+	assert.True(config.IsInvalidDocumentError(err))
+	assert.ErrorMatch(err, structureErrors)
+
+	_, err = config.Parse([]byte(`{
+"name": "foo",
+"cells": [
+	{"id": "a",
+	 "behavior": ["b"]},
+	{"behavior": "c",
+	 "color": "red"}
+]
+}`))
+	assert.True(config.IsInvalidDocumentError(err))
+	assert.ErrorMatch(err, structureErrors)
+}
+
+// TestValidate tests the validation of YAML and JSON documents.
+func TestValidate(t *testing.T) {
+	assert := asserts.NewTestingAssertion(t, true)
+	yamlDoc := `cells:
+  - id: a
+    behavior: broadcaster
+    subscribers: [b, c]
+  - id: b
+    behavior: humpf
+  - id: a
+    behavior: logger
+  - id: d
+    behavior: collector
+    subscribers:
+      - a
+      - e
+`
+	jsonDoc := `{"cells": [
+	{"id": "a",
+	 "behavior": "broadcaster",
+	 "subscribers": ["b", "c"]},
+	{"id": "b",
+	 "behavior": "humpf"},
+	{"id": "a",
+	 "behavior": "logger"},
+	{"id": "d",
+	 "behavior": "collector",
+	 "subscribers": [
+		"a",
+		"e"]}
+]}`
+	for _, doc := range []string{yamlDoc, jsonDoc} {
+		d := mustParse(assert, doc)
+		err := d.Validate()
+		assert.True(config.IsInvalidDocumentError(err))
+		verrs, ok := errors.Annotated(err).(config.ValidationErrors)
+		assert.True(ok)
+		assert.Length(verrs, 4)
+		assert.ErrorMatch(verrs[0], `line 6: unknown behavior "humpf" of cell "b"`)
+		assert.ErrorMatch(verrs[1], `line 7: duplicate cell ID "a", first defined in line 2`)
+		assert.ErrorMatch(verrs[2], `line 4: subscriber "c" of cell "a" does not exist`)
+		assert.ErrorMatch(verrs[3], `line 13: subscriber "e" of cell "d" does not exist`)
+
+		_, err = config.Load([]byte(doc))
+		assert.True(config.IsInvalidDocumentError(err))
+	}
+}
+
+// TestLoad tests building an environment out of a document.
+func TestLoad(t *testing.T) {
+	assert := asserts.NewTestingAssertion(t, true)
+	doc := `{
+	"id": "load-test",
+	"cells": [
+		{
+			"id": "filter",
+			"behavior": "filter",
+			"params": {"topics": ["a", "c"]},
+			"subscribers": ["collector", "counter"]
+		},
+		{"id": "collector", "behavior": "collector"},
+		{"id": "counter", "behavior": "counter"},
+		{"id": "custom", "behavior": "test"}
+	]
+}`
+	config.RegisterBehavior("test", func(params cells.Payload) (cells.Behavior, error) {
+		return testsupport.NewTestBehavior(), nil
+	})
+	assert.Contents("test", config.BehaviorNames())
+
+	env, err := config.Load([]byte(doc))
+	assert.Nil(err)
+	defer env.Stop()
+	assert.Equal(env.ID(), "load-test")
+	assert.Equal(env.Cells(), []string{"collector", "counter", "custom", "filter"})
+
+	for _, topic := range []string{"a", "b", "c", "a"} {
+		env.EmitNew("filter", topic, nil, nil)
+	}
+	testsupport.LetItWork()
+
+	collected, err := env.Request("collector", cells.CollectedTopic, nil, nil, time.Second)
+	assert.Nil(err)
+	assert.Length(collected, 3)
+	counters, err := env.Request("counter", cells.CountersTopic, nil, nil, time.Second)
+	assert.Nil(err)
+	assert.Equal(counters, behaviors.Counters{"a": 2, "c": 1})
+	pong, err := env.Request("custom", cells.PingTopic, nil, nil, time.Second)
+	assert.Nil(err)
+	assert.Equal(pong, cells.PongResponse)
+
+	// Invalid parameters.
+	_, err = config.Load([]byte("{\"cells\": [\n{\"id\": \"ticker\",\n\"behavior\": \"ticker\",\n\"params\": {\"duration\": \"soon\"}}]}"))
+	assert.ErrorMatch(err, `cannot build environment: line 3: invalid parameters of behavior "ticker" of cell "ticker": .*`)
+}
+
+//--------------------
+// HELPERS
+//--------------------
+
+// mustParse parses the document and asserts that
+// there's no error.
+func mustParse(assert *asserts.Assertion, doc string) *config.Document {
+	d, err := config.Parse([]byte(doc))
+	assert.Nil(err)
+	return d
+}
+
+// EOF
@@ -0,0 +1,52 @@
+// Tideland Go Cell Network - Config
+//
+// Copyright (C) 2010-2015 Frank Mueller / Tideland / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+// The config package builds environments out of declarative YAML
+// or JSON documents. They contain the optional environment ID and
+// the list of cells with their IDs, the names of their behaviors,
+// the parameters for the behavior constructors, and the IDs of
+// their subscribers:
+//
+//	id: my-environment
+//	cells:
+//	  - id: ticker
+//	    behavior: ticker
+//	    params:
+//	      duration: 1s
+//	    subscribers: [counter]
+//	  - id: counter
+//	    behavior: counter
+//
+// The behaviors are created by constructors registered with
+// RegisterBehavior(). The standard behaviors are registered by
+// default. Before building a document is validated. Unknown
+// behaviors, duplicate IDs, and subscribers not defined in the
+// document are reported together with their lines.
+//
+// Only a subset of YAML is supported: block mappings and sequences,
+// flow mappings and sequences, plain and quoted scalars, as well as
+// comments.
+package config
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"github.com/tideland/goas/v1/version"
+)
+
+//--------------------
+// VERSION
+//--------------------
+
+// PackageVersion returns the version of the version package.
+func PackageVersion() version.Version {
+	return version.New(3, 2, 0)
+}
+
+// EOF
@@ -0,0 +1,79 @@
+// Tideland Go Cell Network - Config - Errors
+//
+// Copyright (C) 2010-2015 Frank Mueller / Tideland / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package config
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"strings"
+
+	"github.com/tideland/goas/v3/errors"
+)
+
+//--------------------
+// CONSTANTS
+//--------------------
+
+const (
+	ErrSyntax = iota + 1
+	ErrInvalidDocument
+	ErrUnknownField
+	ErrMissingField
+	ErrInvalidField
+	ErrUnknownBehavior
+	ErrDuplicateID
+	ErrDanglingSubscription
+	ErrBehaviorParams
+	ErrBuilding
+)
+
+var errorMessages = map[int]string{
+	ErrSyntax:               "line %d: syntax error: %s",
+	ErrInvalidDocument:      "invalid document",
+	ErrUnknownField:         "line %d: unknown field %q",
+	ErrMissingField:         "line %d: missing field %q",
+	ErrInvalidField:         "line %d: field %q has to be %s",
+	ErrUnknownBehavior:      "line %d: unknown behavior %q of cell %q",
+	ErrDuplicateID:          "line %d: duplicate cell ID %q, first defined in line %d",
+	ErrDanglingSubscription: "line %d: subscriber %q of cell %q does not exist",
+	ErrBehaviorParams:       "line %d: invalid parameters of behavior %q of cell %q",
+	ErrBuilding:             "cannot build environment",
+}
+
+//--------------------
+// ERRORS
+//--------------------
+
+// ValidationErrors collects the errors found when
+// validating a document.
+type ValidationErrors []error
+
+// Error is specified on the error interface.
+func (verrs ValidationErrors) Error() string {
+	msgs := make([]string, len(verrs))
+	for i, err := range verrs {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// IsSyntaxError checks if an error signals an invalid
+// YAML or JSON syntax.
+func IsSyntaxError(err error) bool {
+	return errors.IsError(err, ErrSyntax)
+}
+
+// IsInvalidDocumentError checks if an error signals a
+// document which didn't pass the validation.
+func IsInvalidDocumentError(err error) bool {
+	return errors.IsError(err, ErrInvalidDocument)
+}
+
+// EOF
@@ -0,0 +1,521 @@
+// Tideland Go Cell Network - Config - Parser
+//
+// Copyright (C) 2010-2015 Frank Mueller / Tideland / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package config
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/tideland/goas/v3/errors"
+)
+
+//--------------------
+// NODES
+//--------------------
+
+// nodeKind is the kind of a parsed node.
+type nodeKind int
+
+const (
+	scalarNode nodeKind = iota
+	mapNode
+	seqNode
+)
+
+// node is a parsed value of a document together
+// with its line for error messages.
+type node struct {
+	kind   nodeKind
+	line   int
+	value  interface{}
+	keys   []string
+	fields map[string]*node
+	items  []*node
+}
+
+// newMapNode creates an empty map node.
+func newMapNode(line int) *node {
+	return &node{
+		kind:   mapNode,
+		line:   line,
+		fields: make(map[string]*node),
+	}
+}
+
+// set sets a field of a map node. Duplicate keys are an error.
+func (n *node) set(line int, key string, value *node) error {
+	if _, ok := n.fields[key]; ok {
+		return errors.New(ErrSyntax, errorMessages, line, "duplicate key "+strconv.Quote(key))
+	}
+	n.keys = append(n.keys, key)
+	n.fields[key] = value
+	return nil
+}
+
+// interfaceValue returns the node as generic value.
+func (n *node) interfaceValue() interface{} {
+	switch n.kind {
+	case mapNode:
+		values := make(map[string]interface{}, len(n.fields))
+		for key, field := range n.fields {
+			values[key] = field.interfaceValue()
+		}
+		return values
+	case seqNode:
+		values := make([]interface{}, len(n.items))
+		for i, item := range n.items {
+			values[i] = item.interfaceValue()
+		}
+		return values
+	}
+	return n.value
+}
+
+//--------------------
+// PARSING
+//--------------------
+
+// parse parses a JSON document if it starts with a brace,
+// otherwise a YAML document.
+func parse(data []byte) (*node, error) {
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) > 0 && trimmed[0] == '{' {
+		return parseJSON(data)
+	}
+	return parseYAML(data)
+}
+
+//--------------------
+// JSON
+//--------------------
+
+// jsonParser creates nodes out of the tokens of a JSON document.
+type jsonParser struct {
+	data []byte
+	dec  *json.Decoder
+}
+
+// parseJSON parses a JSON document into nodes.
+func parseJSON(data []byte) (*node, error) {
+	p := &jsonParser{
+		data: data,
+		dec:  json.NewDecoder(bytes.NewReader(data)),
+	}
+	p.dec.UseNumber()
+	n, err := p.parseValue()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := p.dec.Token(); err != io.EOF {
+		return nil, errors.New(ErrSyntax, errorMessages, p.line(), "unexpected data after document")
+	}
+	return n, nil
+}
+
+// line returns the line of the current position.
+func (p *jsonParser) line() int {
+	return bytes.Count(p.data[:p.dec.InputOffset()], []byte("\n")) + 1
+}
+
+// token reads the next token.
+func (p *jsonParser) token() (json.Token, int, error) {
+	token, err := p.dec.Token()
+	line := p.line()
+	if err != nil {
+		return nil, line, errors.New(ErrSyntax, errorMessages, line, err.Error())
+	}
+	return token, line, nil
+}
+
+// parseValue parses the next value.
+func (p *jsonParser) parseValue() (*node, error) {
+	token, line, err := p.token()
+	if err != nil {
+		return nil, err
+	}
+	switch t := token.(type) {
+	case json.Delim:
+		switch t {
+		case '{':
+			n := newMapNode(line)
+			for p.dec.More() {
+				key, kline, err := p.token()
+				if err != nil {
+					return nil, err
+				}
+				value, err := p.parseValue()
+				if err != nil {
+					return nil, err
+				}
+				if err := n.set(kline, key.(string), value); err != nil {
+					return nil, err
+				}
+			}
+			_, _, err := p.token()
+			return n, err
+		case '[':
+			n := &node{kind: seqNode, line: line}
+			for p.dec.More() {
+				item, err := p.parseValue()
+				if err != nil {
+					return nil, err
+				}
+				n.items = append(n.items, item)
+			}
+			_, _, err := p.token()
+			return n, err
+		}
+		return nil, errors.New(ErrSyntax, errorMessages, line, "unexpected "+t.String())
+	case json.Number:
+		if i, err := t.Int64(); err == nil {
+			return &node{kind: scalarNode, line: line, value: int(i)}, nil
+		}
+		f, err := t.Float64()
+		if err != nil {
+			return nil, errors.New(ErrSyntax, errorMessages, line, err.Error())
+		}
+		return &node{kind: scalarNode, line: line, value: f}, nil
+	}
+	return &node{kind: scalarNode, line: line, value: token}, nil
+}
+
+//--------------------
+// YAML
+//--------------------
+
+// yamlLine is a significant line of a YAML document.
+type yamlLine struct {
+	number int
+	indent int
+	text   string
+}
+
+// yamlParser parses the block structure of a YAML document. It
+// supports the subset needed for configurations: block mappings and
+// sequences, flow sequences and mappings, plain and quoted scalars,
+// and comments. Anchors, tags, and multi-line scalars are not
+// supported.
+type yamlParser struct {
+	lines []yamlLine
+	pos   int
+}
+
+// parseYAML parses a YAML document into nodes.
+func parseYAML(data []byte) (*node, error) {
+	p := &yamlParser{}
+	for i, raw := range strings.Split(string(data), "\n") {
+		text := strings.TrimRight(stripComment(raw), " \t\r")
+		trimmed := strings.TrimLeft(text, " ")
+		if trimmed == "" || trimmed == "---" || trimmed == "..." {
+			continue
+		}
+		if strings.HasPrefix(trimmed, "\t") {
+			return nil, errors.New(ErrSyntax, errorMessages, i+1, "tabs are not allowed for indentation")
+		}
+		p.lines = append(p.lines, yamlLine{i + 1, len(text) - len(trimmed), trimmed})
+	}
+	if len(p.lines) == 0 {
+		return newMapNode(1), nil
+	}
+	n, err := p.parseBlock(p.lines[0].indent)
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.lines) {
+		return nil, errors.New(ErrSyntax, errorMessages, p.lines[p.pos].number, "unexpected indentation")
+	}
+	return n, nil
+}
+
+// parseBlock parses the block starting at the current line.
+func (p *yamlParser) parseBlock(indent int) (*node, error) {
+	l := p.lines[p.pos]
+	if isSeqItem(l.text) {
+		return p.parseSeq(indent)
+	}
+	if _, _, ok := splitKey(l.text); ok {
+		return p.parseMap(indent)
+	}
+	p.pos++
+	return parseScalar(l.number, l.text)
+}
+
+// parseMap parses a block mapping with the indentation.
+func (p *yamlParser) parseMap(indent int) (*node, error) {
+	n := newMapNode(p.lines[p.pos].number)
+	for p.pos < len(p.lines) {
+		l := p.lines[p.pos]
+		if l.indent < indent {
+			break
+		}
+		if l.indent > indent {
+			return nil, errors.New(ErrSyntax, errorMessages, l.number, "unexpected indentation")
+		}
+		if isSeqItem(l.text) {
+			break
+		}
+		key, rest, ok := splitKey(l.text)
+		if !ok {
+			return nil, errors.New(ErrSyntax, errorMessages, l.number, "expected key")
+		}
+		p.pos++
+		var value *node
+		var err error
+		switch {
+		case rest != "":
+			value, err = parseScalar(l.number, rest)
+		case p.pos < len(p.lines) && p.lines[p.pos].indent > indent:
+			value, err = p.parseBlock(p.lines[p.pos].indent)
+		case p.pos < len(p.lines) && p.lines[p.pos].indent == indent && isSeqItem(p.lines[p.pos].text):
+			value, err = p.parseSeq(indent)
+		default:
+			value = &node{kind: scalarNode, line: l.number}
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err := n.set(l.number, key, value); err != nil {
+			return nil, err
+		}
+	}
+	return n, nil
+}
+
+// parseSeq parses a block sequence with the indentation.
+func (p *yamlParser) parseSeq(indent int) (*node, error) {
+	n := &node{kind: seqNode, line: p.lines[p.pos].number}
+	for p.pos < len(p.lines) {
+		l := p.lines[p.pos]
+		if l.indent != indent || !isSeqItem(l.text) {
+			if l.indent > indent {
+				return nil, errors.New(ErrSyntax, errorMessages, l.number, "unexpected indentation")
+			}
+			break
+		}
+		rest := strings.TrimLeft(l.text[1:], " ")
+		var item *node
+		var err error
+		switch {
+		case rest == "":
+			p.pos++
+			if p.pos < len(p.lines) && p.lines[p.pos].indent > indent {
+				item, err = p.parseBlock(p.lines[p.pos].indent)
+			} else {
+				item = &node{kind: scalarNode, line: l.number}
+			}
+		default:
+			// The item continues as block on the same line.
+			itemIndent := indent + len(l.text) - len(rest)
+			p.lines[p.pos] = yamlLine{l.number, itemIndent, rest}
+			item, err = p.parseBlock(itemIndent)
+		}
+		if err != nil {
+			return nil, err
+		}
+		n.items = append(n.items, item)
+	}
+	return n, nil
+}
+
+// parseScalar parses an inline value, which may also be a flow
+// sequence or mapping.
+func parseScalar(line int, text string) (*node, error) {
+	text = strings.TrimSpace(text)
+	switch {
+	case strings.HasPrefix(text, "["):
+		if !strings.HasSuffix(text, "]") {
+			return nil, errors.New(ErrSyntax, errorMessages, line, "unterminated flow sequence")
+		}
+		n := &node{kind: seqNode, line: line}
+		parts, err := splitFlow(line, text[1:len(text)-1])
+		if err != nil {
+			return nil, err
+		}
+		for _, part := range parts {
+			item, err := parseScalar(line, part)
+			if err != nil {
+				return nil, err
+			}
+			n.items = append(n.items, item)
+		}
+		return n, nil
+	case strings.HasPrefix(text, "{"):
+		if !strings.HasSuffix(text, "}") {
+			return nil, errors.New(ErrSyntax, errorMessages, line, "unterminated flow mapping")
+		}
+		n := newMapNode(line)
+		parts, err := splitFlow(line, text[1:len(text)-1])
+		if err != nil {
+			return nil, err
+		}
+		for _, part := range parts {
+			key, rest, ok := splitKey(part)
+			if !ok {
+				return nil, errors.New(ErrSyntax, errorMessages, line, "expected key in flow mapping")
+			}
+			value, err := parseScalar(line, rest)
+			if err != nil {
+				return nil, err
+			}
+			if err := n.set(line, key, value); err != nil {
+				return nil, err
+			}
+		}
+		return n, nil
+	case strings.HasPrefix(text, `"`):
+		s, err := strconv.Unquote(text)
+		if err != nil {
+			return nil, errors.New(ErrSyntax, errorMessages, line, "invalid quoted string")
+		}
+		return &node{kind: scalarNode, line: line, value: s}, nil
+	case strings.HasPrefix(text, `'`):
+		if quoteEnd(text, 0) != len(text)-1 {
+			return nil, errors.New(ErrSyntax, errorMessages, line, "invalid quoted string")
+		}
+		s := strings.Replace(text[1:len(text)-1], `''`, `'`, -1)
+		return &node{kind: scalarNode, line: line, value: s}, nil
+	}
+	return &node{kind: scalarNode, line: line, value: plainValue(text)}, nil
+}
+
+// plainValue converts a plain scalar into a nil, boolean,
+// integer, float, or string value.
+func plainValue(text string) interface{} {
+	switch text {
+	case "", "~", "null", "Null", "NULL":
+		return nil
+	case "true", "True", "TRUE":
+		return true
+	case "false", "False", "FALSE":
+		return false
+	}
+	if i, err := strconv.ParseInt(text, 10, 64); err == nil {
+		return int(i)
+	}
+	if f, err := strconv.ParseFloat(text, 64); err == nil {
+		return f
+	}
+	return text
+}
+
+//--------------------
+// HELPERS
+//--------------------
+
+// isSeqItem checks if the text is an item of a block sequence.
+func isSeqItem(text string) bool {
+	return text == "-" || strings.HasPrefix(text, "- ")
+}
+
+// splitKey splits "key: value" outside of quotes and flows.
+func splitKey(text string) (string, string, bool) {
+	if strings.HasPrefix(text, "[") || strings.HasPrefix(text, "{") {
+		return "", "", false
+	}
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case (c == '"' || c == '\'') && quotable(text, i):
+			if i = quoteEnd(text, i); i < 0 {
+				return "", "", false
+			}
+		case c == ':' && (i == len(text)-1 || text[i+1] == ' '):
+			key := strings.TrimSpace(text[:i])
+			if s, err := strconv.Unquote(key); err == nil {
+				key = s
+			} else if len(key) > 1 && key[0] == '\'' && key[len(key)-1] == '\'' {
+				key = key[1 : len(key)-1]
+			}
+			return key, strings.TrimSpace(text[i+1:]), key != ""
+		}
+	}
+	return "", "", false
+}
+
+// splitFlow splits the content of a flow sequence or mapping
+// at the commas outside of quotes and nested flows.
+func splitFlow(line int, text string) ([]string, error) {
+	parts := []string{}
+	depth := 0
+	start := 0
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case (c == '"' || c == '\'') && quotable(text, i):
+			if i = quoteEnd(text, i); i < 0 {
+				return nil, errors.New(ErrSyntax, errorMessages, line, "unterminated quoted string")
+			}
+		case c == '[' || c == '{':
+			depth++
+		case c == ']' || c == '}':
+			depth--
+		case c == ',' && depth == 0:
+			parts = append(parts, text[start:i])
+			start = i + 1
+		}
+	}
+	if depth != 0 {
+		return nil, errors.New(ErrSyntax, errorMessages, line, "unbalanced flow")
+	}
+	if last := strings.TrimSpace(text[start:]); last != "" || len(parts) > 0 {
+		parts = append(parts, text[start:])
+	}
+	return parts, nil
+}
+
+// quotable checks if a quote at the position starts a quoted
+// scalar and isn't only a character inside of a plain one.
+func quotable(text string, i int) bool {
+	return i == 0 || strings.IndexByte(" \t[{,:", text[i-1]) >= 0
+}
+
+// quoteEnd returns the position of the quote closing the quoted
+// scalar starting at the position, or -1 if it's unterminated.
+// Double quoted scalars escape with backslashes, single quoted
+// ones with doubled single quotes.
+func quoteEnd(text string, i int) int {
+	quote := text[i]
+	for i++; i < len(text); i++ {
+		switch {
+		case quote == '"' && text[i] == '\\':
+			i++
+		case text[i] != quote:
+		case quote == '\'' && i+1 < len(text) && text[i+1] == '\'':
+			i++
+		default:
+			return i
+		}
+	}
+	return -1
+}
+
+// stripComment removes a comment outside of quotes.
+func stripComment(text string) string {
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case (c == '"' || c == '\'') && quotable(text, i):
+			if i = quoteEnd(text, i); i < 0 {
+				// Unterminated, the scalar parsing reports it.
+				return text
+			}
+		case c == '#' && (i == 0 || text[i-1] == ' ' || text[i-1] == '\t'):
+			return text[:i]
+		}
+	}
+	return text
+}
+
+// EOF
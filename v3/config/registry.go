@@ -0,0 +1,191 @@
+// Tideland Go Cell Network - Config - Registry
+//
+// Copyright (C) 2010-2015 Frank Mueller / Tideland / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package config
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/tideland/gocn/v3/behaviors"
+	"github.com/tideland/gocn/v3/cells"
+)
+
+//--------------------
+// REGISTRY
+//--------------------
+
+// Constructor creates a behavior out of the parameters of a cell
+// in the document. They can be read with the typed getters of the
+// payload.
+type Constructor func(params cells.Payload) (cells.Behavior, error)
+
+// registry contains the registered behavior constructors.
+var registry = struct {
+	sync.RWMutex
+	byName map[string]Constructor
+}{
+	byName: make(map[string]Constructor),
+}
+
+// RegisterBehavior registers a behavior constructor with a name.
+// The standard behaviors "broadcaster", "collector", "counter",
+// "filter", "logger", "roundrobin", "router", and "ticker" are
+// registered by default.
+func RegisterBehavior(name string, constructor Constructor) {
+	registry.Lock()
+	defer registry.Unlock()
+	registry.byName[name] = constructor
+}
+
+// BehaviorNames returns the sorted names of the
+// registered behaviors.
+func BehaviorNames() []string {
+	registry.RLock()
+	defer registry.RUnlock()
+	names := []string{}
+	for name := range registry.byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// lookupBehavior returns the constructor registered with the name.
+func lookupBehavior(name string) (Constructor, bool) {
+	registry.RLock()
+	defer registry.RUnlock()
+	constructor, ok := registry.byName[name]
+	return constructor, ok
+}
+
+//--------------------
+// STANDARD BEHAVIORS
+//--------------------
+
+// init registers the standard behaviors.
+func init() {
+	RegisterBehavior("broadcaster", func(params cells.Payload) (cells.Behavior, error) {
+		return behaviors.NewBroadcasterBehavior(), nil
+	})
+	// Parameter "max" is the maximum number of collected events.
+	RegisterBehavior("collector", func(params cells.Payload) (cells.Behavior, error) {
+		max, err := params.GetInt("max", 10)
+		if err != nil {
+			return nil, err
+		}
+		return behaviors.NewCollectorBehavior(max), nil
+	})
+	// Parameter "topics" are the counted topics, default are all.
+	RegisterBehavior("counter", func(params cells.Payload) (cells.Behavior, error) {
+		topics, err := topicSet(params)
+		if err != nil {
+			return nil, err
+		}
+		return behaviors.NewCounterBehavior(func(id string, event cells.Event) []string {
+			if topics != nil && !topics[event.Topic()] {
+				return nil
+			}
+			return []string{event.Topic()}
+		}), nil
+	})
+	// Parameter "topics" are the topics passing the filter.
+	RegisterBehavior("filter", func(params cells.Payload) (cells.Behavior, error) {
+		topics, err := topicSet(params)
+		if err != nil {
+			return nil, err
+		}
+		return behaviors.NewFilterBehavior(func(id string, event cells.Event) bool {
+			return topics[event.Topic()]
+		}), nil
+	})
+	RegisterBehavior("logger", func(params cells.Payload) (cells.Behavior, error) {
+		return behaviors.NewLoggerBehavior(), nil
+	})
+	RegisterBehavior("roundrobin", func(params cells.Payload) (cells.Behavior, error) {
+		return behaviors.NewRoundRobinBehavior(), nil
+	})
+	// Parameter "routes" maps topics to lists of subscriber IDs.
+	RegisterBehavior("router", func(params cells.Payload) (cells.Behavior, error) {
+		routes := make(map[string][]string)
+		value, ok := params.Get("routes")
+		if ok {
+			rmap, ok := value.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("routes have to be a mapping")
+			}
+			for topic, ids := range rmap {
+				sids, err := stringList(ids)
+				if err != nil {
+					return nil, err
+				}
+				routes[topic] = sids
+			}
+		}
+		return behaviors.NewRouterBehavior(func(id string, event cells.Event, subscribers []string) []string {
+			return routes[event.Topic()]
+		}), nil
+	})
+	// Parameter "duration" is the interval of the ticks, default
+	// is one second.
+	RegisterBehavior("ticker", func(params cells.Payload) (cells.Behavior, error) {
+		duration, err := params.GetDuration("duration", time.Second)
+		if err != nil {
+			return nil, err
+		}
+		return behaviors.NewTickerBehavior(duration), nil
+	})
+}
+
+//--------------------
+// HELPERS
+//--------------------
+
+// topicSet returns the parameter "topics" as set, nil
+// if it's not set.
+func topicSet(params cells.Payload) (map[string]bool, error) {
+	value, ok := params.Get("topics")
+	if !ok {
+		return nil, nil
+	}
+	topics, err := stringList(value)
+	if err != nil {
+		return nil, err
+	}
+	set := make(map[string]bool, len(topics))
+	for _, topic := range topics {
+		set[topic] = true
+	}
+	return set, nil
+}
+
+// stringList converts a string or a list of strings.
+func stringList(value interface{}) ([]string, error) {
+	switch v := value.(type) {
+	case string:
+		return []string{v}, nil
+	case []interface{}:
+		list := make([]string, len(v))
+		for i, item := range v {
+			s, ok := item.(string)
+			if !ok {
+				return nil, fmt.Errorf("%v is no string", item)
+			}
+			list[i] = s
+		}
+		return list, nil
+	}
+	return nil, fmt.Errorf("%v is no list of strings", value)
+}
+
+// EOF